@@ -0,0 +1,103 @@
+package sample1
+
+import "hash/maphash"
+
+// sketchDepth is how many counters every key counts on in a frequencySketch
+const sketchDepth = 4
+
+// sketchSeeds spread the key hashes over the counters of every row differently, so keys sharing a counter in a row
+// are unlikely to share it in the others
+var sketchSeeds = [sketchDepth]uint64{0x9e3779b97f4a7c15, 0xc2b2ae3d27d4eb4f, 0x165667b19e3779f9, 0xd6e8feb86659fd93}
+
+// maxFrequency is the highest a frequencySketch counter goes, so they fit in four bits as in TinyLFU
+const maxFrequency = 15
+
+// frequencySketch estimates how often every key was used lately in little memory, as a count-min sketch: a key
+// counts on one counter per row, and its estimate is the lowest of them since the others are shared with more keys
+// Counters are halved once enough uses were counted, so keys no longer used lose their estimate over time
+type frequencySketch struct {
+	rows    [sketchDepth][]uint8
+	shift   uint // how many bits of the spread hash to drop to get a counter
+	added   int  // uses counted since the counters were last halved
+	resetAt int
+}
+
+// newFrequencySketch sizes the sketch for a cache holding capacity keys, with a minimum so the keys of a scan seen
+// once do not share every counter with the keys of a small cache
+func newFrequencySketch(capacity int) *frequencySketch {
+	width, shift := 256, uint(64-8)
+	for width < capacity {
+		width, shift = width*2, shift-1
+	}
+	s := &frequencySketch{shift: shift, resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index returns the counter of the key hash in the row, by multiplicative hashing
+func (s *frequencySketch) index(hash uint64, row int) uint64 {
+	return (hash * sketchSeeds[row]) >> s.shift
+}
+
+// add counts a use of the key hash
+func (s *frequencySketch) add(hash uint64) {
+	for row := range s.rows {
+		i := s.index(hash, row)
+		if s.rows[row][i] < maxFrequency {
+			s.rows[row][i]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		s.halve()
+	}
+}
+
+func (s *frequencySketch) halve() {
+	for row := range s.rows {
+		for i := range s.rows[row] {
+			s.rows[row][i] /= 2
+		}
+	}
+	s.added /= 2
+}
+
+// estimate tells how often the key hash was used lately
+func (s *frequencySketch) estimate(hash uint64) uint8 {
+	frequency := uint8(maxFrequency)
+	for row := range s.rows {
+		frequency = min(frequency, s.rows[row][s.index(hash, row)])
+	}
+	return frequency
+}
+
+// used counts a use of the key for the admission policy, if there is one, the caller must hold the cache-wide lock
+func (c *Cache[K, V]) used(key K) {
+	if c.admission != nil {
+		c.admission.add(maphash.Comparable(c.seed, key))
+	}
+}
+
+// admits reports whether a new key is worth storing, the caller must hold the cache-wide lock
+// Unless the entry would make a key be evicted, or there is no admission policy, every key is admitted. Otherwise it
+// is only admitted when it was used more often lately than the key the eviction policy would evict, if it tells
+func (c *Cache[K, V]) admits(key K, e entry[V]) bool {
+	if c.admission == nil || c.count == 0 {
+		return true
+	}
+	if !(c.maxEntries > 0 && c.count >= c.maxEntries) && !(c.maxBytes > 0 && c.bytes+e.Size > c.maxBytes) {
+		return true
+	}
+	policy, ok := c.policy.(victimPolicy[K])
+	if !ok {
+		return true
+	}
+	victim, ok := policy.Victim()
+	if !ok {
+		return true
+	}
+	candidate := c.admission.estimate(maphash.Comparable(c.seed, key))
+	return candidate > c.admission.estimate(maphash.Comparable(c.seed, victim))
+}
@@ -0,0 +1,102 @@
+package sample1
+
+import (
+	"fmt"
+	"hash/maphash"
+	"testing"
+)
+
+// scanWithHotSet looks the hot items up a few times, then again in every round followed by as many items never seen
+// before as the cache holds, returning how many times the actual service was asked for the hot items
+func scanWithHotSet(t *testing.T, opts ...Option) (*TransparentCache, int) {
+	hot := []string{"h1", "h2", "h3", "h4", "h5"}
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	for i, code := range hot {
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+	}
+	for i := 0; i < 200; i++ {
+		mockService.mockResults[fmt.Sprintf("scan-%d", i)] = mockResult{price: float64(i), err: nil}
+	}
+	cache := NewCacheWithOptions(mockService, append(opts, WithMaxEntries(10))...)
+	for i := 0; i < 3; i++ {
+		getPricesWithNoErr(t, cache, hot...)
+	}
+	scanned := 0
+	for round := 0; round < 20; round++ {
+		getPricesWithNoErr(t, cache, hot...)
+		for i := 0; i < 10; i++ {
+			getPriceWithNoErr(t, cache, fmt.Sprintf("scan-%d", scanned))
+			scanned++
+		}
+	}
+	return cache, mockService.getNumCalls() - scanned
+}
+
+// Check that a scan evicts the hot items from a plain LRU cache, so they keep being fetched
+func TestScanWithHotSet_ThrashesLRU(t *testing.T) {
+	_, hotCalls := scanWithHotSet(t)
+	assertInt(t, 100, hotCalls, "wrong number of service calls for the hot items")
+}
+
+// Check that with frequency admission the hot items survive the scan, fetched only once
+func TestWithFrequencyAdmission_KeepsHotSet(t *testing.T) {
+	cache, hotCalls := scanWithHotSet(t, WithFrequencyAdmission())
+	assertInt(t, 5, hotCalls, "wrong number of service calls for the hot items")
+	assertInt(t, 10, cache.Len(), "wrong number of cached items")
+	for _, code := range []string{"h1", "h2", "h3", "h4", "h5"} {
+		if _, ok := cache.Peek(code); !ok {
+			t.Errorf("expected %v to be cached", code)
+		}
+	}
+}
+
+// Check that the sketch counts how often keys were used, forgetting them over time
+func TestFrequencySketch_EstimatesAndHalves(t *testing.T) {
+	s := newFrequencySketch(10)
+	seed := maphash.MakeSeed()
+	hot, cold, unseen := maphash.String(seed, "hot"), maphash.String(seed, "cold"), maphash.String(seed, "unseen")
+	for i := 0; i < 3; i++ {
+		s.add(hot)
+	}
+	s.add(cold)
+	assertInt(t, 3, int(s.estimate(hot)), "wrong estimate")
+	assertInt(t, 1, int(s.estimate(cold)), "wrong estimate")
+	assertInt(t, 0, int(s.estimate(unseen)), "wrong estimate")
+
+	for i := 0; i < 100; i++ {
+		s.add(hot)
+	}
+	assertInt(t, maxFrequency, int(s.estimate(hot)), "wrong estimate once saturated")
+	s.halve()
+	assertInt(t, maxFrequency/2, int(s.estimate(hot)), "wrong estimate once halved")
+	assertInt(t, 0, int(s.estimate(cold)), "wrong estimate once halved")
+}
+
+// Check that keys sharing their counters in two rows rarely share them in the others, so their estimates stay apart
+func TestFrequencySketch_SpreadsRows(t *testing.T) {
+	s := newFrequencySketch(10)
+	seed := maphash.MakeSeed()
+	first := maphash.Comparable(seed, 0)
+	colliding := 0
+	var shared [sketchDepth]int
+	for i := 1; i < 1<<21; i++ {
+		hash := maphash.Comparable(seed, i)
+		if s.index(hash, 0) != s.index(first, 0) || s.index(hash, 1) != s.index(first, 1) {
+			continue
+		}
+		colliding++
+		for row := 2; row < sketchDepth; row++ {
+			if s.index(hash, row) == s.index(first, row) {
+				shared[row]++
+			}
+		}
+	}
+	if colliding == 0 {
+		t.Fatal("expected keys sharing the counters of the first two rows")
+	}
+	for row := 2; row < sketchDepth; row++ {
+		if shared[row] > colliding/4 {
+			t.Errorf("expected the keys to be spread in row %v, %v of %v share the counter", row, shared[row], colliding)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMissingFromBatch is returned for a key the batch fetcher did not return a value for
+var ErrMissingFromBatch = errors.New("missing from batch response")
+
+// BatchFetcher is a Fetcher that can also get the values for several keys in a single call
+// Keys missing from the returned map get ErrMissingFromBatch, unless the error returned is KeyErrors telling theirs
+type BatchFetcher[K comparable, V any] interface {
+	Fetcher[K, V]
+	FetchMany(keys []K) (map[K]V, error)
+}
+
+// KeyErrors is the error a BatchFetcher returns along with the values it got when only some keys failed, telling
+// the error of every one of them, so the rest of the keys still get their values
+type KeyErrors[K comparable] map[K]error
+
+func (e KeyErrors[K]) Error() string {
+	return fmt.Sprintf("%d keys failed in the batch", len(e))
+}
+
+// batch collects the keys missed during a batch window, to be fetched in a single call once it ends
+type batch[K comparable, V any] struct {
+	batcher BatchFetcher[K, V] // of the fetcher when the batch started, see SetFetcher
+	keys    []K
+	done    chan struct{} // closed once values and err are set
+	values  map[K]V
+	err     error
+}
+
+// loadBatched adds the key to the pending batch, starting one for batcher if there is none, and waits for its value
+func (c *Cache[K, V]) loadBatched(batcher BatchFetcher[K, V], key K) (V, error) {
+	c.mutex.Lock()
+	b := c.pending
+	if b == nil {
+		b = &batch[K, V]{batcher: batcher, done: make(chan struct{})}
+		c.pending = b
+		time.AfterFunc(c.batchWindow, func() { c.flush(b) })
+	}
+	b.keys = append(b.keys, key)
+	c.mutex.Unlock()
+
+	<-b.done
+	var zero V
+	var keyErrs KeyErrors[K]
+	if errors.As(b.err, &keyErrs) {
+		if err, ok := keyErrs[key]; ok {
+			return zero, err
+		}
+	} else if b.err != nil {
+		return zero, b.err
+	}
+	value, ok := b.values[key]
+	if !ok {
+		return zero, ErrMissingFromBatch
+	}
+	return value, nil
+}
+
+// flush fetches every key of the batch in a single call and releases the callers waiting on it
+func (c *Cache[K, V]) flush(b *batch[K, V]) {
+	c.mutex.Lock()
+	if c.pending == b {
+		c.pending = nil
+	}
+	c.mutex.Unlock()
+	defer close(b.done)
+
+	if b.err = c.throttle(context.Background()); b.err != nil {
+		return
+	}
+	if !c.acquire() {
+		b.err = ErrTooManyInFlight
+		return
+	}
+	defer c.release()
+	defer recovered(&b.err)
+	b.values, b.err = b.batcher.FetchMany(b.keys)
+}
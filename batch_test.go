@@ -0,0 +1,114 @@
+package sample1
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockBatchPriceService also answers several items in a single call
+type mockBatchPriceService struct {
+	mockPriceService
+	batches [][]string // item codes asked for on every batch call
+	err     error
+}
+
+func (m *mockBatchPriceService) GetPricesFor(itemCodes []string) (map[string]float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.batches = append(m.batches, append([]string{}, itemCodes...))
+	if m.err != nil {
+		return nil, m.err
+	}
+	prices := map[string]float64{}
+	for _, itemCode := range itemCodes {
+		if result, ok := m.mockResults[itemCode]; ok {
+			prices[itemCode] = result.price
+		}
+	}
+	return prices, nil
+}
+
+func (m *mockBatchPriceService) getBatches() [][]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.batches
+}
+
+// Check that concurrent misses are fetched with a single batch call
+func TestWithBatchWindow_CoalescesMisses(t *testing.T) {
+	mockService := &mockBatchPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+				"p3": {price: 9, err: nil},
+			},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithBatchWindow(50*time.Millisecond))
+
+	codes := []string{"p1", "p2", "p3"}
+	prices := make([]float64, len(codes))
+	var wg sync.WaitGroup
+	for i, code := range codes {
+		wg.Add(1)
+		go func(i int, code string) {
+			defer wg.Done()
+			prices[i] = getPriceWithNoErr(t, cache, code)
+		}(i, code)
+	}
+	wg.Wait()
+
+	assertFloatsInOrder(t, []float64{5, 7, 9}, prices, "wrong prices returned")
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of single service calls")
+	batches := mockService.getBatches()
+	assertInt(t, 1, len(batches), "wrong number of batch service calls")
+	sort.Strings(batches[0])
+	if fmt.Sprint(batches[0]) != fmt.Sprint(codes) {
+		t.Errorf("wrong item codes in batch: expected %v, got %v", codes, batches[0])
+	}
+
+	// the batched prices are cached as any other
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 1, len(mockService.getBatches()), "wrong number of batch service calls")
+}
+
+// Check that items missing from the batch response and batch failures are reported as errors
+func TestWithBatchWindow_Errors(t *testing.T) {
+	mockService := &mockBatchPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithBatchWindow(time.Millisecond))
+	if _, err := cache.GetPriceFor("p1"); !errors.Is(err, ErrMissingFromBatch) {
+		t.Errorf("expected ErrMissingFromBatch, got %v", err)
+	}
+
+	serviceErr := errors.New("some error")
+	mockService.mutex.Lock()
+	mockService.err = serviceErr
+	mockService.mutex.Unlock()
+	if _, err := cache.GetPriceFor("p1"); !errors.Is(err, serviceErr) {
+		t.Errorf("expected the service error, got %v", err)
+	}
+}
+
+// Check that a batch service is called one item at a time unless a batch window is set
+func TestWithBatchWindow_DisabledByDefault(t *testing.T) {
+	mockService := &mockBatchPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+			},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of single service calls")
+	assertInt(t, 0, len(mockService.getBatches()), "wrong number of batch service calls")
+}
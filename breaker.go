@@ -0,0 +1,115 @@
+package sample1
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling the fetcher while the circuit breaker is open, see WithCircuitBreaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker around the fetcher
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // the fetcher is called as usual
+	CircuitOpen                         // the fetcher kept failing, so it is not called until the cooldown ends
+	CircuitHalfOpen                     // the cooldown ended, a single call probes whether the fetcher recovered
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker trips open after "threshold" consecutive failures, a nil breaker never does
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	mutex     sync.Mutex
+	state     CircuitState
+	failures  int // consecutive failures while closed
+	openedAt  time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether the fetcher can be called, letting a single probe through once the cooldown ends
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// the probe is still in-flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call it allowed
+// An unlearned outcome, like the fetcher not being called or the caller giving up on it, says nothing about the
+// fetcher, so it is not counted
+func (b *breaker) record(err error, unlearned bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch {
+	case err == nil:
+		b.state = CircuitClosed
+		b.failures = 0
+	case unlearned:
+		// there is nothing to learn, but the next call can probe instead
+		if b.state == CircuitHalfOpen {
+			b.state = CircuitOpen
+		}
+	case b.state == CircuitHalfOpen:
+		b.state = CircuitOpen
+		b.openedAt = now
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.state = CircuitOpen
+			b.openedAt = now
+			b.failures = 0
+		}
+	}
+}
+
+// current returns the breaker state, an open one reading as half-open once its cooldown ended
+func (b *breaker) current(now time.Time) CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == CircuitOpen && now.Sub(b.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
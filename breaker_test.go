@@ -0,0 +1,101 @@
+package sample1
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Check that consecutive failures trip the breaker, short-circuiting calls until a probe finds the service back
+func TestWithCircuitBreaker_TripsAndRecovers(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock), WithCircuitBreaker(2, time.Minute))
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetPriceFor("p1"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected the service error, got %v", err)
+		}
+	}
+	if cache.Stats().Circuit != CircuitOpen {
+		t.Errorf("expected the breaker to be open, got %v", cache.Stats().Circuit)
+	}
+
+	// short-circuited during the cooldown
+	for i := 0; i < 5; i++ {
+		if _, err := cache.GetPriceFor("p1"); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("expected ErrCircuitOpen, got %v", err)
+		}
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	// a failing probe opens it again
+	clock.Advance(time.Minute)
+	if cache.Stats().Circuit != CircuitHalfOpen {
+		t.Errorf("expected the breaker to be half-open, got %v", cache.Stats().Circuit)
+	}
+	if _, err := cache.GetPriceFor("p1"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the service error, got %v", err)
+	}
+	if _, err := cache.GetPriceFor("p1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+
+	// a successful probe closes it
+	clock.Advance(time.Minute)
+	mockService.setResult("p1", mockResult{price: 5, err: nil})
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	if cache.Stats().Circuit != CircuitClosed {
+		t.Errorf("expected the breaker to be closed, got %v", cache.Stats().Circuit)
+	}
+}
+
+// Check that an open breaker serves the expired price when stale prices are allowed
+func TestWithCircuitBreaker_ServesStale(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock),
+		WithCircuitBreaker(1, time.Hour), WithStaleIfError())
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(time.Minute)
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("some error")})
+	getPriceWithNoErr(t, cache, "p1") // trips the breaker
+
+	price, stale, err := cache.GetPriceForWithStale("p1")
+	if err != nil || !stale {
+		t.Errorf("expected the stale price, got stale %v and error %v", stale, err)
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that lookups failing fast over the rate limit do not open the breaker, since the service was never called
+func TestWithCircuitBreaker_IgnoresRateLimited(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithRateLimit(1), WithFailWhenBusy(), WithCircuitBreaker(2, time.Hour))
+	getPriceWithNoErr(t, cache, "p1")
+	for _, itemCode := range []string{"p2", "p3"} {
+		if _, err := cache.GetPriceFor(itemCode); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("expected ErrRateLimited for %v, got %v", itemCode, err)
+		}
+	}
+	if cache.Stats().Circuit != CircuitClosed {
+		t.Errorf("expected the breaker to stay closed, got %v", cache.Stats().Circuit)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
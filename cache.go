@@ -1,98 +1,753 @@
 package sample1
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrEmptyItemCode is returned for an empty item code, without asking the cache or the actual service for it
+	ErrEmptyItemCode = errors.New("empty item code")
+	// ErrInvalidPrice is returned for a price the actual service returned but was rejected, see WithRejectZeroPrice
+	ErrInvalidPrice = errors.New("invalid price")
+	// ErrNilService is returned when creating a cache without an actual service to get the prices from
+	ErrNilService = errors.New("nil price service")
+	// ErrNegativeMaxAge is returned when creating a cache with a negative max age, see NewCheckedTransparentCache
+	ErrNegativeMaxAge = errors.New("negative max age")
+	// ErrParamsUnsupported is returned for an item looked up with parameters when the actual service is not a
+	// ParamPriceService, see GetPriceForWithParams
+	ErrParamsUnsupported = errors.New("price service does not take parameters")
+	// ErrNotCached is returned by the read-only view of a cache for an item without a fresh cached price, see ReadOnly
+	ErrNotCached = errors.New("price not cached")
+	// ErrDeadlineExceeded is returned for an item whose price was not ready in time, see GetPricesForWithDeadline
+	// It is a context.DeadlineExceeded, so errors.Is works for both
+	ErrDeadlineExceeded = fmt.Errorf("price not ready in time : %w", context.DeadlineExceeded)
+)
+
 // PriceService is a service that we can use to get prices for the items
 // Calls to this service are expensive (they take time)
 type PriceService interface {
 	GetPriceFor(itemCode string) (float64, error)
 }
 
-type priceValue struct {
-	Price float64
-	CreatedAt time.Time
+// BatchPriceService is a PriceService that can also get the prices for several items in a single call
+// Items missing from the returned map are reported as failed
+type BatchPriceService interface {
+	PriceService
+	GetPricesFor(itemCodes []string) (map[string]float64, error)
+}
+
+// ContextPriceService is a PriceService that can stop getting a price once its context is done
+// It is given the context of the lookup that started the call, along with its values, like a trace ID or the
+// credentials of the request, by GetPriceForContext and GetPricesForContext. Lookups without a context of their own,
+// like GetPriceFor or the refreshes made in the background, give it context.Background()
+type ContextPriceService interface {
+	GetPriceForContext(ctx context.Context, itemCode string) (float64, error)
+}
+
+// TTLPriceService is a PriceService that also tells how long every price can be cached for, like a max-age header
+// would, taking precedence over "maxAge" for that price. A TTL of zero or less means there is no hint
+type TTLPriceService interface {
+	GetPriceWithTTL(itemCode string) (float64, time.Duration, error)
+}
+
+// ParamPriceService is a PriceService that also takes extra parameters for an item, like its currency or region,
+// so the same item can have different prices, see GetPriceForWithParams
+type ParamPriceService interface {
+	PriceService
+	GetPriceForWithParams(itemCode string, params map[string]string) (float64, error)
+}
+
+// PriceWriter is a service that can also store prices, so updates made through the cache reach it
+type PriceWriter interface {
+	SetPriceFor(itemCode string, price float64) error
+}
+
+// PriceFetchError is returned when the actual service fails to get the price for an item
+// It wraps the service error, so callers can still check it with errors.Is and errors.As
+type PriceFetchError struct {
+	ItemCode string
+	Err      error
+}
+
+func (e *PriceFetchError) Error() string {
+	return fmt.Sprintf("getting price for %v from service : %v", e.ItemCode, e.Err)
+}
+
+func (e *PriceFetchError) Unwrap() error {
+	return e.Err
+}
+
+// priceFetcher adapts a PriceService to the Fetcher the generic cache works with
+type priceFetcher struct {
+	actualPriceService PriceService
+}
+
+func (f priceFetcher) Fetch(itemCode string) (float64, error) {
+	if service, ok := f.actualPriceService.(ParamPriceService); ok {
+		if code, params, ok := splitParamsKey(itemCode); ok {
+			price, err := service.GetPriceForWithParams(code, params)
+			if err != nil {
+				return 0, &PriceFetchError{ItemCode: itemCode, Err: err}
+			}
+			return price, nil
+		}
+	}
+	price, err := f.actualPriceService.GetPriceFor(itemCode)
+	if err != nil {
+		return 0, &PriceFetchError{ItemCode: itemCode, Err: err}
+	}
+	return price, nil
+}
+
+// FetchContext gets the price from the actual service with the context, as long as it is a ContextPriceService
+func (f priceFetcher) FetchContext(ctx context.Context, itemCode string) (float64, error) {
+	service, ok := f.actualPriceService.(ContextPriceService)
+	if !ok || f.hasParams(itemCode) {
+		return f.Fetch(itemCode)
+	}
+	price, err := service.GetPriceForContext(ctx, itemCode)
+	if err != nil {
+		return 0, &PriceFetchError{ItemCode: itemCode, Err: err}
+	}
+	return price, nil
+}
+
+// FetchWithTTL gets the price and how long it can be cached for from the actual service, as long as it is a
+// TTLPriceService, or else gets it like FetchContext without a TTL
+func (f priceFetcher) FetchWithTTL(ctx context.Context, itemCode string) (float64, time.Duration, error) {
+	service, ok := f.actualPriceService.(TTLPriceService)
+	if !ok || f.hasParams(itemCode) {
+		price, err := f.FetchContext(ctx, itemCode)
+		return price, 0, err
+	}
+	price, ttl, err := service.GetPriceWithTTL(itemCode)
+	if err != nil {
+		return 0, 0, &PriceFetchError{ItemCode: itemCode, Err: err}
+	}
+	return price, ttl, nil
+}
+
+// Write sets the price in the actual service, as long as it is a PriceWriter
+func (f priceFetcher) Write(itemCode string, price float64) error {
+	writer, ok := f.actualPriceService.(PriceWriter)
+	if !ok {
+		return ErrReadOnly
+	}
+	if err := writer.SetPriceFor(itemCode, price); err != nil {
+		return fmt.Errorf("setting price for %v in service : %w", itemCode, err)
+	}
+	return nil
+}
+
+// batchPriceFetcher adapts a BatchPriceService, so misses can be fetched in batches, see WithBatchWindow
+type batchPriceFetcher struct {
+	priceFetcher
+	actualBatchService BatchPriceService
+}
+
+// FetchMany gets the prices for the items without parameters in a single call, and the ones with parameters one by
+// one since the batch call cannot take them, telling the errors of the ones failing with KeyErrors
+func (f batchPriceFetcher) FetchMany(itemCodes []string) (map[string]float64, error) {
+	plain := make([]string, 0, len(itemCodes))
+	withParams := []string{}
+	for _, itemCode := range itemCodes {
+		if f.hasParams(itemCode) {
+			withParams = append(withParams, itemCode)
+		} else {
+			plain = append(plain, itemCode)
+		}
+	}
+	prices := map[string]float64{}
+	if len(plain) > 0 {
+		var err error
+		if prices, err = f.actualBatchService.GetPricesFor(plain); err != nil {
+			return nil, fmt.Errorf("getting prices for %v from service : %w", plain, err)
+		}
+	}
+	failed := KeyErrors[string]{}
+	for _, itemCode := range withParams {
+		price, err := f.Fetch(itemCode)
+		if err != nil {
+			failed[itemCode] = err
+			continue
+		}
+		prices[itemCode] = price
+	}
+	if len(failed) > 0 {
+		return prices, failed
+	}
+	return prices, nil
+}
+
+// paramsSeparator splits the item code from its parameters in the keys built by paramsKey
+const paramsSeparator = "?"
+
+// paramsKey builds the key an item is cached under with its parameters, like a URL query: the item code escaped so
+// it holds no separator, then the parameters sorted by name, so the same parameters always make the same key
+// Without parameters the key is the item code as is, so it shares the price with GetPriceFor
+func paramsKey(itemCode string, params map[string]string) string {
+	if len(params) == 0 {
+		return itemCode
+	}
+	query := url.Values{}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	return url.PathEscape(itemCode) + paramsSeparator + query.Encode()
 }
 
-type priceResponse struct {
-	Price float64
-	Err   error
+// splitParamsKey tells the item code and parameters back from a key built by paramsKey, reporting false for a key
+// without parameters
+func splitParamsKey(key string) (string, map[string]string, bool) {
+	escaped, encoded, ok := strings.Cut(key, paramsSeparator)
+	if !ok {
+		return key, nil, false
+	}
+	itemCode, err := url.PathUnescape(escaped)
+	if err != nil {
+		return key, nil, false
+	}
+	query, err := url.ParseQuery(encoded)
+	if err != nil {
+		return key, nil, false
+	}
+	params := make(map[string]string, len(query))
+	for name := range query {
+		params[name] = query.Get(name)
+	}
+	return itemCode, params, true
 }
 
+// hasParams reports whether the key is one built by paramsKey for a ParamPriceService, any other service taking
+// the item codes as they are, whatever they hold
+func (f priceFetcher) hasParams(key string) bool {
+	_, ok := f.actualPriceService.(ParamPriceService)
+	return ok && strings.Contains(key, paramsSeparator)
+}
+
+// newPriceFetcher adapts the actual service, taking advantage of batch calls when it supports them
+// It panics for a nil service, which would otherwise panic on the first miss, deep in a background goroutine
+func newPriceFetcher(actualPriceService PriceService) Fetcher[string, float64] {
+	if actualPriceService == nil {
+		panic(ErrNilService)
+	}
+	if batchService, ok := actualPriceService.(BatchPriceService); ok {
+		return batchPriceFetcher{priceFetcher{actualPriceService}, batchService}
+	}
+	return priceFetcher{actualPriceService}
+}
+
+// PriceEntry is a cached price as saved and loaded by a PriceCodec
+type PriceEntry = StoredEntry[float64]
+
+// PriceCodec writes and reads cached prices in some format, see SaveToWith and LoadFromWith
+type PriceCodec = EntryCodec[string, float64]
+
+// PriceCache is what TransparentCache offers to get and set prices, so its users can depend on it and mock it
+// It is not named Cache since that is the generic cache TransparentCache wraps
+type PriceCache interface {
+	GetPriceFor(itemCode string) (float64, error)
+	GetPriceForContext(ctx context.Context, itemCode string) (float64, error)
+	GetPriceForWithSource(itemCode string) (price float64, fromCache bool, err error)
+	GetPriceForWithStale(itemCode string) (price float64, stale bool, err error)
+	GetPricesFor(itemCodes ...string) ([]float64, error)
+	GetPricesForContext(ctx context.Context, itemCodes ...string) ([]float64, error)
+	GetPricesForAll(itemCodes ...string) ([]float64, error)
+	GetPricesForDetailed(itemCodes ...string) []ItemResult
+	SetPrice(itemCode string, price float64)
+	SetPriceTTL(itemCode string, ttl time.Duration)
+	UpdatePrice(itemCode string, price float64) error
+}
+
+var _ PriceCache = (*TransparentCache)(nil)
+
 // TransparentCache is a cache that wraps the actual service
 // The cache will remember prices we ask for, so that we don't have to wait on every call
 // Cache should only return a price if it is not older than "maxAge", so that we don't get stale prices
+// A "maxAge" of zero or less disables caching, so every call goes straight to the actual service
+// It is a thin wrapper around a Cache of prices keyed by item code, see Cache for the full behavior
 type TransparentCache struct {
-	actualPriceService PriceService
-	maxAge             time.Duration
-	prices             map[string]priceValue
-	mutex              sync.Mutex
+	*Cache[string, float64]
+	opts []Option // the cache was built with, for Derive
 }
 
+// NewTransparentCache creates a cache for the actual service, panicking with ErrNilService if there is none, see
+// NewCheckedTransparentCache
+// A negative "maxAge" is taken as zero, disabling caching
 func NewTransparentCache(actualPriceService PriceService, maxAge time.Duration) *TransparentCache {
+	return NewBoundedTransparentCache(actualPriceService, maxAge, 0)
+}
+
+// NewCheckedTransparentCache is like NewTransparentCache but returns ErrNilService instead of panicking if there is
+// no actual service, and ErrNegativeMaxAge for a negative "maxAge", most likely a mistake, instead of disabling
+// caching
+func NewCheckedTransparentCache(actualPriceService PriceService, maxAge time.Duration) (*TransparentCache, error) {
+	if actualPriceService == nil {
+		return nil, ErrNilService
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("%w : %v", ErrNegativeMaxAge, maxAge)
+	}
+	return NewTransparentCache(actualPriceService, maxAge), nil
+}
+
+// NewBoundedTransparentCache creates a cache holding at most maxEntries items, zero meaning unbounded
+func NewBoundedTransparentCache(actualPriceService PriceService, maxAge time.Duration, maxEntries int) *TransparentCache {
+	return NewCacheWithOptions(actualPriceService, WithMaxAge(maxAge), WithMaxEntries(maxEntries))
+}
+
+// NewMultiSourceCache creates a cache for several actual services, like a fast one backed by a slower authoritative
+// one: a miss asks them in order until one returns a price, which is the one cached, and when all of them fail
+// their errors are returned joined
+// It panics with ErrNilService if there are no services or any of them is nil
+func NewMultiSourceCache(services []PriceService, maxAge time.Duration) *TransparentCache {
+	if len(services) == 0 {
+		panic(ErrNilService)
+	}
+	for _, service := range services {
+		if service == nil {
+			panic(ErrNilService)
+		}
+	}
+	return NewTransparentCache(serviceChain(append([]PriceService{}, services...)), maxAge)
+}
+
+// serviceChain is a service asking its services in order until one of them returns a price, see NewMultiSourceCache
+type serviceChain []PriceService
+
+func (s serviceChain) GetPriceFor(itemCode string) (float64, error) {
+	errs := make([]error, 0, len(s))
+	for _, service := range s {
+		price, err := service.GetPriceFor(itemCode)
+		if err == nil {
+			return price, nil
+		}
+		errs = append(errs, err)
+	}
+	return 0, errors.Join(errs...)
+}
+
+// NewCacheWithOptions creates a cache for the actual service configured by the given options, see Option for the
+// defaults
+func NewCacheWithOptions(actualPriceService PriceService, opts ...Option) *TransparentCache {
 	return &TransparentCache{
-		actualPriceService: actualPriceService,
-		maxAge:             maxAge,
-		prices:             map[string]priceValue{},
+		Cache: NewCacheWith(newPriceFetcher(actualPriceService), opts...),
+		opts:  opts,
+	}
+}
+
+// SetPriceService replaces the actual service, keeping the cached prices, like when switching providers without
+// downtime: the calls in-flight finish with the service they started with and the next misses call the new one, see
+// SetFetcher. It returns ErrNilService, keeping the current service, if there is none
+func (c *TransparentCache) SetPriceService(actualPriceService PriceService) error {
+	if actualPriceService == nil {
+		return ErrNilService
+	}
+	c.SetFetcher(newPriceFetcher(actualPriceService))
+	return nil
+}
+
+// Derive creates a new cache for the same actual service, with prices and stats of its own, like one per tenant
+// It is built with the options of this cache followed by opts, so opts override them. Settings changed since this
+// cache was built are not carried over, and options sharing something, like WithMetrics, share it with this cache
+// unless overridden
+func (c *TransparentCache) Derive(opts ...Option) *TransparentCache {
+	return NewCacheWithOptions(c.service(), append(append([]Option{}, c.opts...), opts...)...)
+}
+
+// WithDefaultPrice makes a lookup return the price given by fn, when it reports one, if the actual service fails and
+// there is no stale price to serve instead, see WithDefault
+func WithDefaultPrice(fn func(itemCode string) (float64, bool)) Option {
+	return WithDefault(fn)
+}
+
+// WithSecondaryPriceCache puts a secondary cache of prices between the cache and the actual service, see
+// WithSecondaryCache
+func WithSecondaryPriceCache(secondary SecondaryCache[string, float64]) Option {
+	return WithSecondaryCache(secondary)
+}
+
+// WithDistributedPriceLock makes a miss take a distributed lock for the item before calling the actual service, see
+// WithDistributedLock
+func WithDistributedPriceLock(lock DistributedLock[string], poll time.Duration) Option {
+	return WithDistributedLock(lock, poll)
+}
+
+// WithRefreshService makes the background refreshes get prices from service instead of the actual service, which
+// misses keep calling, like a new provider validated before moving to it, see WithRefreshFetcher
+func WithRefreshService(service PriceService) Option {
+	return WithRefreshFetcher(newPriceFetcher(service))
+}
+
+// WithCanonicalItemCodes makes every item code go through canonicalize, like an alias resolved to the canonical ID of
+// a product, so aliases of the same product share a single cached price, see WithKeyResolver
+func WithCanonicalItemCodes(canonicalize func(itemCode string) (string, error)) Option {
+	return WithKeyResolver(canonicalize)
+}
+
+// WithRejectZeroPrice makes a zero price from the actual service fail with ErrInvalidPrice instead of being cached,
+// for services that return zero for items they do not know
+func WithRejectZeroPrice() Option {
+	return WithValidation(func(itemCode string, price float64) error {
+		if price == 0 {
+			return &PriceFetchError{ItemCode: itemCode, Err: ErrInvalidPrice}
+		}
+		return nil
+	})
+}
+
+// WithRelatedItems makes a miss warm the prices of the items returned by related in the background, see
+// WithRelatedKeys
+func WithRelatedItems(related func(itemCode string) []string) Option {
+	return WithRelatedKeys[string, float64](related)
+}
+
+// SetPriceTTL sets how old the cached price for the item can be, taking precedence over "maxAge" for that item only
+// Items without a TTL keep using "maxAge"
+func (c *TransparentCache) SetPriceTTL(itemCode string, ttl time.Duration) {
+	c.SetTTL(itemCode, ttl)
+}
+
+// String summarizes the cache in a single line, for logs and test failures
+// The actual service is only told by its type
+func (c *TransparentCache) String() string {
+	return fmt.Sprintf("TransparentCache{service: %T, %s}", c.service(), c.summary())
+}
+
+// service returns the actual service the prices are got from
+func (c *TransparentCache) service() PriceService {
+	switch f := c.upstream.Load().fetcher.(type) {
+	case priceFetcher:
+		return f.actualPriceService
+	case batchPriceFetcher:
+		return f.actualPriceService
+	}
+	return nil
+}
+
+// ReadOnly returns a view of the cache serving the fresh cached prices, and failing with ErrNotCached for the rest
+// instead of asking the actual service, for components that must never cause an expensive call
+// Like Peek it has no side effects on the cache
+func (c *TransparentCache) ReadOnly() PriceService {
+	return readOnlyCache{c}
+}
+
+// readOnlyCache is the PriceService returned by ReadOnly
+type readOnlyCache struct {
+	cache *TransparentCache
+}
+
+func (r readOnlyCache) GetPriceFor(itemCode string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
+	}
+	price, ok := r.cache.Peek(itemCode)
+	if !ok {
+		return 0, ErrNotCached
 	}
+	return price, nil
+}
+
+// SortedKeys returns a copy of the item codes currently cached sorted lexicographically, so it is the same across
+// calls for the same codes whatever the order they were cached in
+// The codes are sorted once copied, without holding any lock
+func (c *TransparentCache) SortedKeys() []string {
+	keys := c.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// InvalidatePrefix removes the prices for every item whose code starts with prefix, like "US:" for the items of a
+// region, returning how many were removed
+func (c *TransparentCache) InvalidatePrefix(prefix string) int {
+	prefix = c.normalized(prefix)
+	return c.InvalidateFunc(func(itemCode string) bool {
+		return strings.HasPrefix(itemCode, prefix)
+	})
+}
+
+// SetPrices stores every price as if they had just been fetched together, see SetMany
+func (c *TransparentCache) SetPrices(prices map[string]float64) {
+	c.SetMany(prices)
+}
+
+// SetPriceWithTags is like SetPrice but also tags the price, like with the supplier of the item, so the prices
+// carrying any of its tags can be invalidated together, see InvalidateTag
+func (c *TransparentCache) SetPriceWithTags(itemCode string, price float64, tags ...string) {
+	c.SetWithTags(itemCode, price, tags...)
+}
+
+// SetPrice stores the price for the item as if it had just been fetched, without calling the actual service
+func (c *TransparentCache) SetPrice(itemCode string, price float64) {
+	c.Set(itemCode, price)
+}
+
+// UpdatePrice sets the price for the item in the actual service, which must be a PriceWriter, and caches it once
+// the service accepted it. If the service fails the cached price is left as it was
+func (c *TransparentCache) UpdatePrice(itemCode string, price float64) error {
+	if itemCode == "" {
+		return ErrEmptyItemCode
+	}
+	return c.Update(itemCode, price)
 }
 
 // GetPriceFor gets the price for the item, either from the cache or the actual service if it was not cached or too old
 func (c *TransparentCache) GetPriceFor(itemCode string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
+	}
+	return c.Get(itemCode)
+}
 
-	v, ok := c.prices[itemCode]
-	if ok {
-		if time.Since(v.CreatedAt) < c.maxAge {
-			return v.Price, nil
-		}
+// GetPriceForWithParams is like GetPriceFor for an item priced with extra parameters, like its currency or region,
+// asking the actual service, which must be a ParamPriceService, for it. Every set of parameters is cached on its own
+// whatever their order, and no parameters at all share the price of GetPriceFor
+// With a ParamPriceService item codes holding a "?" are taken as cached with parameters, even by GetPriceFor
+func (c *TransparentCache) GetPriceForWithParams(itemCode string, params map[string]string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
 	}
-	price, err := c.actualPriceService.GetPriceFor(itemCode)
-	if err != nil {
-		return 0, fmt.Errorf("getting price from service : %v", err.Error())
+	if _, ok := c.service().(ParamPriceService); !ok && len(params) > 0 {
+		return 0, ErrParamsUnsupported
+	}
+	return c.Get(paramsKey(itemCode, params))
+}
+
+// GetPriceForFresh is like GetPriceFor but always gets the price from the actual service, even if the cached one is
+// still fresh, caching it for the next lookups, see Refresh
+func (c *TransparentCache) GetPriceForFresh(itemCode string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
 	}
-	c.mutex.Lock()
-	c.prices[itemCode] = priceValue{
-		Price: price,
-		CreatedAt: time.Now(),
+	return c.Refresh(itemCode)
+}
+
+// GetPriceForRefreshing is like GetPriceFor but, when the cached price expires within threshold, it waits for a new
+// one from the actual service instead, see GetRefreshing
+func (c *TransparentCache) GetPriceForRefreshing(itemCode string, threshold time.Duration) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
 	}
-	c.mutex.Unlock()
+	return c.GetRefreshing(itemCode, threshold)
+}
 
-	return price, nil
+// GetPriceForMaxAge is like GetPriceFor but takes the cached price as fresh only while it is younger than maxAge,
+// for callers needing fresher prices, or fine with older ones, than the rest, see GetMaxAge
+func (c *TransparentCache) GetPriceForMaxAge(itemCode string, maxAge time.Duration) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
+	}
+	return c.GetMaxAge(itemCode, maxAge)
+}
+
+// GetPriceForContext is like GetPriceFor but stops waiting on the actual service once ctx is done, returning ctx.Err()
+// A ContextPriceService called for this lookup is given ctx, so it can stop too. Any other service cannot be
+// interrupted: the caller just stops waiting, while the call finishes in the background and its price is cached
+func (c *TransparentCache) GetPriceForContext(ctx context.Context, itemCode string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
+	}
+	return c.GetContext(ctx, itemCode)
+}
+
+// GetPriceForWithSource is like GetPriceFor but also reports whether the price was served from the cache, which is
+// only true when a fresh cached price was returned without calling the actual service
+func (c *TransparentCache) GetPriceForWithSource(itemCode string) (price float64, fromCache bool, err error) {
+	if itemCode == "" {
+		return 0, false, ErrEmptyItemCode
+	}
+	return c.GetWithSource(itemCode)
+}
+
+// GetPriceForWithTime is like GetPriceFor but also returns when the price was fetched, which is when it was cached
+// for a cached price, or zero for a price that was not, like a default one, see GetWithTime
+func (c *TransparentCache) GetPriceForWithTime(itemCode string) (price float64, createdAt time.Time, err error) {
+	if itemCode == "" {
+		return 0, time.Time{}, ErrEmptyItemCode
+	}
+	return c.GetWithTime(itemCode)
 }
 
 // GetPricesFor gets the prices for several items at once, some might be found in the cache, others might not
-// If any of the operations returns an error, it should return an error as well
+// If any of the operations returns an error, it should return an error as well, along with the prices told by
+// WithErrorResults
+// Prices are returned in the same order as the given item codes
+// No item codes return an empty slice and no error, without calling the actual service nor starting any goroutine
 func (c *TransparentCache) GetPricesFor(itemCodes ...string) ([]float64, error) {
-	output := make(chan priceResponse, len(itemCodes))
-	defer close(output)
-
-	var wg sync.WaitGroup
-	worker := func(code string) {
-		price, err := c.GetPriceFor(code)
-		output <- priceResponse{
-			Price: price,
-			Err:   err,
+	return c.GetPricesForSlice(itemCodes)
+}
+
+// GetPricesForSlice is GetPricesFor for a slice of item codes, for callers building the list as they go
+func (c *TransparentCache) GetPricesForSlice(itemCodes []string) ([]float64, error) {
+	if err := checkItemCodes(itemCodes); err != nil {
+		return c.failedResults(make([]float64, len(itemCodes)), 0), err
+	}
+	return c.GetMany(itemCodes...)
+}
+
+// GetPricesForContext is like GetPricesFor but every item stops waiting on the actual service once ctx is done
+// A ctx already done returns ctx.Err() right away, without looking any item up
+func (c *TransparentCache) GetPricesForContext(ctx context.Context, itemCodes ...string) ([]float64, error) {
+	if err := checkItemCodes(itemCodes); err != nil {
+		return c.failedResults(make([]float64, len(itemCodes)), 0), err
+	}
+	return c.GetManyContext(ctx, itemCodes...)
+}
+
+// GetPricesForAll is like GetPricesFor but goes through every item even if some fail
+// Prices are returned in the same order as the given item codes, with zero for the ones that failed, and the errors
+// for every failing item joined
+func (c *TransparentCache) GetPricesForAll(itemCodes ...string) ([]float64, error) {
+	if err := checkItemCodes(itemCodes); err != nil {
+		return make([]float64, len(itemCodes)), err
+	}
+	return c.GetAll(itemCodes...)
+}
+
+// GetPricesMap is like GetPricesFor but returns the prices by item code, once per item however many times it was
+// given, for callers that do not need them in order
+// Along with an error it returns the prices of the items before the failing one, leaving the failing items out
+// even with ZeroFilledResults, since their zero price could not be told from a real one, or nil for NoResults
+func (c *TransparentCache) GetPricesMap(itemCodes ...string) (map[string]float64, error) {
+	var prices []float64
+	failed := 0
+	err := checkItemCodes(itemCodes)
+	if err == nil {
+		prices, failed, err = c.getMany(context.Background(), itemCodes)
+	}
+	if err != nil && c.errorResults == NoResults {
+		return nil, err
+	}
+	byCode := make(map[string]float64, failed)
+	for i, price := range prices[:failed] {
+		byCode[itemCodes[i]] = price
+	}
+	return byCode, err
+}
+
+// checkItemCodes returns ErrEmptyItemCode for the first empty item code, telling its index
+func checkItemCodes(itemCodes []string) error {
+	for i, itemCode := range itemCodes {
+		if itemCode == "" {
+			return fmt.Errorf("item code at index %d : %w", i, ErrEmptyItemCode)
 		}
-		wg.Done()
 	}
+	return nil
+}
 
-	wg.Add(len(itemCodes))
-	for _, code := range itemCodes {
-		go worker(code)
+// ItemResult is the outcome of getting the price for a single item among several
+type ItemResult struct {
+	Code      string
+	Price     float64
+	Err       error
+	FromCache bool // whether the price was a fresh cached one, see GetPriceForWithSource
+}
+
+// GetPricesForDetailed is like GetPricesFor but reports the outcome of every item on its own, in the same order as
+// the given item codes, so callers can use the prices found even if others failed
+// Empty item codes get ErrEmptyItemCode, the rest are looked up as usual
+func (c *TransparentCache) GetPricesForDetailed(itemCodes ...string) []ItemResult {
+	return c.GetPricesForResilient(context.Background(), itemCodes...)
+}
+
+// GetPricesForWithDeadline is like GetPricesForDetailed but stops waiting at deadline, for a soft limit on how long
+// the whole batch takes. Items not done by then get ErrDeadlineExceeded, the service calls for them finish in the
+// background and their prices are still cached. So do the items a context aware service timed out on
+func (c *TransparentCache) GetPricesForWithDeadline(deadline time.Time, itemCodes ...string) []ItemResult {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	results := c.GetPricesForResilient(ctx, itemCodes...)
+	for i, r := range results {
+		if errors.Is(r.Err, context.DeadlineExceeded) {
+			results[i].Err = ErrDeadlineExceeded
+		}
 	}
-	wg.Wait()
+	return results
+}
 
-	results := []float64{}
-	for i := 0; i < len(itemCodes); i++ {
-		r := <-output
-		if r.Err != nil {
-			return results, r.Err
+// GetPricesForResilient is GetPricesForDetailed with a context: every item stops waiting on the actual service once
+// ctx is done, failing with ctx.Err() if it was not done by then, without failing the ones already done. There is
+// still always one result for every item code given, in the same order, carrying the price or the error of that
+// item alone: a panicking service fails only the items it panicked for, with ErrServicePanic
+func (c *TransparentCache) GetPricesForResilient(ctx context.Context, itemCodes ...string) []ItemResult {
+	results := make([]ItemResult, len(itemCodes))
+	valid := make([]string, 0, len(itemCodes))
+	positions := make([]int, 0, len(itemCodes))
+	for i, itemCode := range itemCodes {
+		if itemCode == "" {
+			results[i] = ItemResult{Err: ErrEmptyItemCode}
+			continue
 		}
-		results = append(results, r.Price)
+		valid = append(valid, itemCode)
+		positions = append(positions, i)
+	}
+	for i, r := range c.GetManyDetailedContext(ctx, valid...) {
+		results[positions[i]] = ItemResult{Code: r.Key, Price: r.Value, Err: r.Err, FromCache: r.FromCache}
 	}
+	return results
+}
+
+// StreamPricesFor is like GetPricesForDetailed but sends the outcome of every item on the returned channel as soon as
+// it is done, in no particular order, so callers can start working on the first prices of a large batch
+// The channel is closed once every item was sent, or once ctx is done, leaving out the items not sent by then, so
+// callers have to either drain it or cancel ctx
+func (c *TransparentCache) StreamPricesFor(ctx context.Context, itemCodes ...string) <-chan ItemResult {
+	results := make(chan ItemResult)
+	go func() {
+		defer close(results)
+		valid := make([]string, 0, len(itemCodes))
+		for _, itemCode := range itemCodes {
+			if itemCode != "" {
+				valid = append(valid, itemCode)
+				continue
+			}
+			select {
+			case results <- ItemResult{Err: ErrEmptyItemCode}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for r := range c.Stream(ctx, valid...) {
+			select {
+			case results <- ItemResult{Code: r.Key, Price: r.Value, Err: r.Err, FromCache: r.FromCache}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// GetPriceForBestEffort returns the cached price for the item right away, even if expired, reporting whether there
+// was one, refreshing an expired price in the background without telling its failure, see GetBestEffort
+// Only an item without a price waits for the actual service, reporting false if it fails
+func (c *TransparentCache) GetPriceForBestEffort(itemCode string) (float64, bool) {
+	if itemCode == "" {
+		return 0, false
+	}
+	return c.GetBestEffort(itemCode)
+}
+
+// GetPriceForStrict is like GetPriceFor but returns the error of the actual service when it fails, never a stale,
+// last good or default price instead, whatever the options of the cache, see GetStrict
+func (c *TransparentCache) GetPriceForStrict(itemCode string) (float64, error) {
+	if itemCode == "" {
+		return 0, ErrEmptyItemCode
+	}
+	return c.GetStrict(itemCode)
+}
 
-	return results, nil
+// GetPriceForWithStale is like GetPriceFor but also reports whether the price is an expired one, served because the
+// actual service failed and stale prices are allowed, see WithStaleIfError
+func (c *TransparentCache) GetPriceForWithStale(itemCode string) (price float64, stale bool, err error) {
+	if itemCode == "" {
+		return 0, false, ErrEmptyItemCode
+	}
+	return c.GetWithStale(itemCode)
 }
@@ -1,10 +1,15 @@
 package sample1
 
 import (
-	"testing"
-	"time"
+	"context"
+	"errors"
 	"fmt"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 )
 
 // mockResult has the float64 and err to return
@@ -14,24 +19,60 @@ type mockResult struct {
 }
 
 type mockPriceService struct {
+	mutex       sync.Mutex
 	numCalls    int
-	mockResults map[string]mockResult // what price and err to return for a particular itemCode
-	callDelay   time.Duration         // how long to sleep on each call so that we can simulate calls to be expensive
+	mockResults map[string]mockResult    // what price and err to return for a particular itemCode
+	callDelay   time.Duration            // how long to sleep on each call so that we can simulate calls to be expensive
+	itemDelays  map[string]time.Duration // per item sleep, overrides callDelay when present
+	inFlight    int                      // calls currently running
+	maxInFlight int                      // highest number of calls running at the same time
 }
 
 func (m *mockPriceService) GetPriceFor(itemCode string) (float64, error) {
 
-	m.numCalls++            // increase the number of calls
-	time.Sleep(m.callDelay) // sleep to simulate expensive call
+	m.mutex.Lock()
+	m.numCalls++ // increase the number of calls
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		m.inFlight--
+		m.mutex.Unlock()
+	}()
+	delay, ok := m.itemDelays[itemCode]
+	if !ok {
+		delay = m.callDelay
+	}
+	time.Sleep(delay) // sleep to simulate expensive call
 
+	m.mutex.Lock()
 	result, ok := m.mockResults[itemCode]
+	m.mutex.Unlock()
 	if !ok {
 		panic(fmt.Errorf("bug in the tests, we didn't have a mock result for [%v]", itemCode))
 	}
 	return result.price, result.err
 }
 
+// setResult changes what the service returns for an item, safe to call while the cache is using the service
+func (m *mockPriceService) setResult(itemCode string, result mockResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.mockResults[itemCode] = result
+}
+
+func (m *mockPriceService) getMaxInFlight() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.maxInFlight
+}
+
 func (m *mockPriceService) getNumCalls() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.numCalls
 }
 
@@ -78,6 +119,19 @@ func assertFloats(t *testing.T, expected []float64, actual []float64, msg string
 	}
 }
 
+func assertFloatsInOrder(t *testing.T, expected []float64, actual []float64, msg string) {
+	if len(expected) != len(actual) {
+		t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, actual))
+		return
+	}
+	for i, expectedValue := range expected {
+		if expectedValue != actual[i] {
+			t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, actual))
+			return
+		}
+	}
+}
+
 // Check that we are caching results (we should not call the external service for all calls)
 func TestGetPriceFor_CachesResults(t *testing.T) {
 	mockService := &mockPriceService{
@@ -170,3 +224,1949 @@ func TestGetPricesFor_ParallelizeCalls(t *testing.T) {
 		t.Error("calls took too long, expected them to take a bit over one second")
 	}
 }
+
+// Check that concurrent reads and writes on the same and different keys do not race (run with -race)
+func TestGetPriceFor_ConcurrentAccess(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	expected := map[string]float64{"p1": 5, "p2": 7, "p3": 9}
+	codes := []string{"p1", "p2", "p3"}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			price, err := cache.GetPriceFor(code)
+			if err != nil {
+				t.Error("error getting price for", code)
+			}
+			assertFloat(t, expected[code], price, "wrong price returned")
+		}(codes[i%len(codes)])
+	}
+	wg.Wait()
+}
+
+// Check that prices are returned in the same order as the item codes, no matter which call finishes first
+func TestGetPricesFor_PreservesInputOrder(t *testing.T) {
+	mockService := &mockPriceService{
+		itemDelays: map[string]time.Duration{
+			"p1": 150 * time.Millisecond,
+			"p2": 100 * time.Millisecond,
+			"p3": 0,
+		},
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	assertFloatsInOrder(t, []float64{5, 7, 9}, getPricesWithNoErr(t, cache, "p1", "p2", "p3"), "wrong price order")
+	assertFloatsInOrder(t, []float64{9, 5, 7}, getPricesWithNoErr(t, cache, "p3", "p1", "p2"), "wrong price order")
+}
+
+// waitForGoroutines waits a bit for background goroutines to finish, failing if there are more than expected
+func waitForGoroutines(t *testing.T, expected int) {
+	for i := 0; i < 50; i++ {
+		if runtime.NumGoroutine() <= expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("goroutines leaked", fmt.Sprintf("expected : %v, got : %v", expected, runtime.NumGoroutine()))
+}
+
+// Check that a cancelled context stops waiting on a slow service
+func TestGetPriceForContext_ReturnsOnDeadline(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 300 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cache.GetPriceForContext(ctx, "p1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("call took too long, expected it to return on deadline")
+	}
+
+	// the service call finishes in the background and warms the cache
+	waitForGoroutines(t, goroutines)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a cancelled context stops waiting on every item of a batch
+func TestGetPricesForContext_ReturnsOnCancel(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 300 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := cache.GetPricesForContext(ctx, "p1", "p2")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("calls took too long, expected them to return on cancel")
+	}
+	waitForGoroutines(t, goroutines)
+}
+
+// Check that a context already done fails right away, for single and batch lookups, without calling the service
+func TestGetPricesForContext_ShortCircuitsDoneContext(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 300 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if _, err := cache.GetPricesForContext(ctx, "p1", "p2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	if _, err := cache.GetPriceForContext(ctx, "p1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	results := cache.GetPricesForWithDeadline(time.Now().Add(-time.Second), "p1", "p2")
+	for _, r := range results {
+		if !errors.Is(r.Err, ErrDeadlineExceeded) {
+			t.Errorf("expected ErrDeadlineExceeded for %v, got %v", r.Code, r.Err)
+		}
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("calls took too long, expected them to return right away")
+	}
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a single and a batch lookup missing the same item at the same time share a single service call
+func TestGetPriceFor_SharesCallWithBatch(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 100 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	}()
+	go func() {
+		defer wg.Done()
+		assertFloatsInOrder(t, []float64{5, 7}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong prices returned")
+	}()
+	wg.Wait()
+	// one call for "p1" and another for "p2"
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that several failing items return an error without panicking on in-flight responses
+func TestGetPricesFor_ReturnsFirstErrorWithSeveralFailures(t *testing.T) {
+	mockService := &mockPriceService{
+		itemDelays: map[string]time.Duration{
+			"p1": 30 * time.Millisecond,
+			"p3": 10 * time.Millisecond,
+		},
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("p2 error")},
+			"p3": {price: 7, err: nil},
+			"p4": {price: 0, err: fmt.Errorf("p4 error")},
+			"p5": {price: 0, err: fmt.Errorf("p5 error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		_, err := cache.GetPricesFor("p1", "p2", "p3", "p4", "p5")
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if !strings.Contains(err.Error(), "p2 error") {
+			t.Errorf("expected the first failing item error, got %v", err)
+		}
+	}
+	waitForGoroutines(t, goroutines)
+}
+
+// ctxPriceService fails "p1" right away and waits for the context on any other item
+type ctxPriceService struct {
+	mutex     sync.Mutex
+	cancelled []string
+	delay     time.Duration // how long the items other than "p1" take, a second when zero
+}
+
+func (s *ctxPriceService) GetPriceFor(itemCode string) (float64, error) {
+	return s.GetPriceForContext(context.Background(), itemCode)
+}
+
+func (s *ctxPriceService) GetPriceForContext(ctx context.Context, itemCode string) (float64, error) {
+	if itemCode == "p1" {
+		time.Sleep(10 * time.Millisecond)
+		return 0, fmt.Errorf("p1 error")
+	}
+	delay := s.delay
+	if delay == 0 {
+		delay = time.Second
+	}
+	select {
+	case <-ctx.Done():
+		s.mutex.Lock()
+		s.cancelled = append(s.cancelled, itemCode)
+		s.mutex.Unlock()
+		return 0, ctx.Err()
+	case <-time.After(delay):
+		return 1, nil
+	}
+}
+
+// traceIDKey is the context key of the trace ID of a request
+type traceIDKey struct{}
+
+// tracingPriceService keeps the trace ID found in the context of every call, by item code
+type tracingPriceService struct {
+	mutex    sync.Mutex
+	traceIDs map[string]any
+}
+
+func (s *tracingPriceService) GetPriceFor(itemCode string) (float64, error) {
+	return s.GetPriceForContext(context.Background(), itemCode)
+}
+
+func (s *tracingPriceService) GetPriceForContext(ctx context.Context, itemCode string) (float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.traceIDs[itemCode] = ctx.Value(traceIDKey{})
+	return 5, nil
+}
+
+// Check that the values of the context of a lookup reach the service, for single and batch lookups
+func TestGetPriceForContext_PassesContextValues(t *testing.T) {
+	service := &tracingPriceService{traceIDs: map[string]any{}}
+	cache := NewTransparentCache(service, time.Minute)
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "trace-1")
+	if _, err := cache.GetPriceForContext(ctx, "p1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx = context.WithValue(context.Background(), traceIDKey{}, "trace-2")
+	if _, err := cache.GetPricesForContext(ctx, "p2", "p3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getPriceWithNoErr(t, cache, "p4")
+	expected := map[string]any{"p1": "trace-1", "p2": "trace-2", "p3": "trace-2", "p4": nil}
+	for itemCode, traceID := range expected {
+		if service.traceIDs[itemCode] != traceID {
+			t.Errorf("wrong trace ID for %v, expected : %v, got : %v", itemCode, traceID, service.traceIDs[itemCode])
+		}
+	}
+}
+
+// Check that the first failing item cancels the service calls for the items after it
+func TestGetPricesForContext_CancelsOnFirstError(t *testing.T) {
+	service := &ctxPriceService{}
+	cache := NewTransparentCache(service, time.Minute)
+	goroutines := runtime.NumGoroutine()
+	start := time.Now()
+	_, err := cache.GetPricesForContext(context.Background(), "p1", "p2", "p3")
+	if err == nil || !strings.Contains(err.Error(), "p1 error") {
+		t.Errorf("expected the p1 error, got %v", err)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Error("calls took too long, expected them to be cancelled")
+	}
+	cache.Close()
+	service.mutex.Lock()
+	sort.Strings(service.cancelled)
+	if strings.Join(service.cancelled, ",") != "p2,p3" {
+		t.Errorf("wrong cancelled items, expected : [p2 p3], got : %v", service.cancelled)
+	}
+	service.mutex.Unlock()
+	waitForGoroutines(t, goroutines)
+}
+
+// Check that a cancelled lookup is not negatively cached, whether it was cancelled by a failing item of its batch or by
+// its caller, so the next lookups of the item fetch it again
+func TestWithNegativeTTL_DoesNotCacheCancelledLookups(t *testing.T) {
+	service := &ctxPriceService{delay: 20 * time.Millisecond}
+	cache := NewCacheWithOptions(service, WithNegativeTTL(time.Minute))
+	if _, err := cache.GetPricesForContext(context.Background(), "p1", "p2"); err == nil {
+		t.Error("expected the p1 error")
+	}
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := cache.GetPriceForContext(ctx, "p3"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond) // the call for "p3" keeps going in the background until the service gives up
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p3"), "wrong price returned")
+}
+
+// Check that a lookup sharing the service call of a batch item does not fail when a failing sibling cancels it, but
+// gets the price from a new call
+func TestGetPricesForContext_CancelledItemDoesNotFailFollowers(t *testing.T) {
+	service := &ctxPriceService{delay: 50 * time.Millisecond}
+	cache := NewTransparentCache(service, time.Minute)
+	batchDone := make(chan error)
+	go func() {
+		_, err := cache.GetPricesForContext(context.Background(), "p1", "p2")
+		batchDone <- err
+	}()
+	time.Sleep(5 * time.Millisecond) // the call for "p2" is in-flight, to be cancelled once "p1" fails
+	price, err := cache.GetPriceFor("p2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFloat(t, 1, price, "wrong price returned")
+	if err := <-batchDone; err == nil || !strings.Contains(err.Error(), "p1 error") {
+		t.Errorf("expected the p1 error, got %v", err)
+	}
+}
+
+// Check that an item TTL overrides the max age for that item only
+func TestSetPriceTTL_OverridesMaxAge(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetPriceTTL("p1", 50*time.Millisecond)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	time.Sleep(80 * time.Millisecond)
+	// "p1" expired by its own TTL, "p2" is still fresh by max age
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the least recently used item is evicted when the cache is full
+func TestNewBoundedTransparentCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 2)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	// "p1" becomes the most recently used, so "p3" evicts "p2"
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 9, getPriceWithNoErr(t, cache, "p3"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that zero max entries means the cache is unbounded
+func TestNewBoundedTransparentCache_ZeroMeansUnbounded(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	for i := 0; i < 100; i++ {
+		mockService.mockResults[fmt.Sprintf("p%d", i)] = mockResult{price: float64(i), err: nil}
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 0)
+	for code := range mockService.mockResults {
+		getPriceWithNoErr(t, cache, code)
+	}
+	assertInt(t, 100, cache.Len(), "wrong number of cached items")
+}
+
+// Check that concurrent misses for the same item produce a single service call
+func TestGetPriceFor_SharesConcurrentMisses(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 100 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+		}()
+	}
+	wg.Wait()
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a price close to expire is served from the cache while it gets refreshed in the background
+func TestSetRefreshThreshold_RefreshesAhead(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 50 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, 200*time.Millisecond)
+	cache.SetRefreshThreshold(100 * time.Millisecond)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+
+	// within the refresh window, the old price comes back right away
+	time.Sleep(120 * time.Millisecond)
+	start := time.Now()
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	if time.Since(start) > 20*time.Millisecond {
+		t.Error("calls took too long, expected them to be served from the cache")
+	}
+
+	// the background refresh updated the price before it expired
+	time.Sleep(100 * time.Millisecond)
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a service error is remembered for the negative TTL
+func TestSetNegativeTTL_CachesErrors(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetNegativeTTL(50 * time.Millisecond)
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Errorf("expected cached error, got nil")
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+
+	// once the negative TTL expires the service is called again
+	mockService.setResult("p1", mockResult{price: 5, err: nil})
+	time.Sleep(80 * time.Millisecond)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that errors are not cached unless negative caching is enabled
+func TestGetPriceFor_DoesNotCacheErrorsByDefault(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.GetPriceFor("p1")
+	cache.GetPriceFor("p1")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that an invalidated item is fetched again even though it had not expired
+func TestInvalidate_ForcesRefetch(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+	cache.Invalidate("p1")
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that invalidating everything makes every item to be fetched again
+func TestInvalidateAll_ForcesRefetch(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 2)
+	assertFloats(t, []float64{5, 7}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong price returned")
+	cache.InvalidateAll()
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+	assertFloats(t, []float64{5, 7}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong price returned")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that invalidating by prefix only removes the matching items, telling the eviction callback about them
+func TestInvalidatePrefix_RemovesMatchingItems(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"US:SHOE-42": {price: 5, err: nil},
+			"US:SOCK-1":  {price: 2, err: nil},
+			"EU:SHOE-42": {price: 6, err: nil},
+			"USED:HAT-3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	evicted := []string{}
+	cache.OnEvict(func(itemCode string, price float64) {
+		evicted = append(evicted, itemCode)
+	})
+	getPricesWithNoErr(t, cache, "US:SHOE-42", "US:SOCK-1", "EU:SHOE-42", "USED:HAT-3")
+
+	assertInt(t, 2, cache.InvalidatePrefix("US:"), "wrong number of removed items")
+	keys := cache.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "EU:SHOE-42,USED:HAT-3" {
+		t.Errorf("wrong keys, expected : [EU:SHOE-42 USED:HAT-3], got : %v", keys)
+	}
+	sort.Strings(evicted)
+	if strings.Join(evicted, ",") != "US:SHOE-42,US:SOCK-1" {
+		t.Errorf("wrong evicted items, expected : [US:SHOE-42 US:SOCK-1], got : %v", evicted)
+	}
+	assertInt(t, 0, cache.InvalidatePrefix("US:"), "wrong number of removed items")
+}
+
+// Check that the item codes are sorted the same way whatever the order they were cached in
+func TestSortedKeys_DeterministicOrder(t *testing.T) {
+	codes := []string{"p3", "p1", "p10", "p2"}
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	for i, code := range codes {
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+	}
+	forward := NewTransparentCache(mockService, time.Minute)
+	getPricesWithNoErr(t, forward, codes...)
+	backward := NewTransparentCache(mockService, time.Minute)
+	for i := len(codes) - 1; i >= 0; i-- {
+		getPriceWithNoErr(t, backward, codes[i])
+	}
+
+	expected := "p1,p10,p2,p3"
+	for i := 0; i < 3; i++ {
+		if keys := strings.Join(forward.SortedKeys(), ","); keys != expected {
+			t.Errorf("wrong keys, expected : %v, got : %v", expected, keys)
+		}
+		if keys := strings.Join(backward.SortedKeys(), ","); keys != expected {
+			t.Errorf("wrong keys, expected : %v, got : %v", expected, keys)
+		}
+	}
+}
+
+// Check that a derived cache shares the service but not the prices nor the stats, with its options overriding the
+// parent ones
+func TestDerive_SeparatesState(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	parent := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithMaxEntries(10))
+	derived := parent.Derive(WithMaxAge(time.Hour))
+	if derived.MaxAge() != time.Hour {
+		t.Errorf("wrong max age, expected : %v, got : %v", time.Hour, derived.MaxAge())
+	}
+	assertInt(t, 10, derived.maxEntries, "wrong max entries")
+
+	assertFloat(t, 5, getPriceWithNoErr(t, parent, "p1"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, derived, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	derived.SetPrice("p2", 8)
+	if _, ok := parent.Peek("p2"); ok {
+		t.Error("expected the price set in the derived cache not to be in the parent")
+	}
+	assertFloat(t, 7, getPriceWithNoErr(t, parent, "p2"), "wrong price returned")
+	assertFloat(t, 8, getPriceWithNoErr(t, derived, "p2"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 0, int(parent.Stats().Hits), "wrong number of hits")
+	assertInt(t, 1, int(derived.Stats().Hits), "wrong number of hits")
+}
+
+// Check that the read-only view serves the fresh cached prices and fails for the rest, never calling the service
+func TestReadOnly_NeverFetches(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	view := cache.ReadOnly()
+
+	price, err := view.GetPriceFor("p1")
+	if err != nil {
+		t.Error("error getting price for", "p1")
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+	if _, err := view.GetPriceFor("p2"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("expected ErrNotCached, got %v", err)
+	}
+	clock.Advance(time.Minute)
+	if _, err := view.GetPriceFor("p1"); !errors.Is(err, ErrNotCached) {
+		t.Errorf("expected ErrNotCached for the expired price, got %v", err)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 1, cache.Len(), "wrong number of cached items")
+}
+
+// Check that a missing service is reported when creating the cache instead of on its first miss
+func TestNewTransparentCache_NilService(t *testing.T) {
+	if _, err := NewCheckedTransparentCache(nil, time.Minute); !errors.Is(err, ErrNilService) {
+		t.Errorf("expected ErrNilService, got %v", err)
+	}
+	defer func() {
+		if r := recover(); r != ErrNilService {
+			t.Errorf("expected a panic with ErrNilService, got %v", r)
+		}
+	}()
+	NewTransparentCache(nil, time.Minute)
+}
+
+// Check that a negative max age is reported when creating a checked cache, and otherwise taken as zero
+func TestNewTransparentCache_NegativeMaxAge(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	if _, err := NewCheckedTransparentCache(mockService, -time.Minute); !errors.Is(err, ErrNegativeMaxAge) {
+		t.Errorf("expected ErrNegativeMaxAge, got %v", err)
+	}
+	cache := NewTransparentCache(mockService, -time.Minute)
+	if cache.MaxAge() != 0 {
+		t.Errorf("expected the max age to be taken as zero, got %v", cache.MaxAge())
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a miss falls back to the next service when one fails, caching its price, and that the errors of every
+// service are returned when all of them fail
+func TestNewMultiSourceCache_FallsBackInOrder(t *testing.T) {
+	primaryErr := errors.New("primary error")
+	secondaryErr := errors.New("secondary error")
+	primary := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: primaryErr},
+			"p2": {price: 0, err: primaryErr},
+		},
+	}
+	secondary := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: secondaryErr},
+		},
+	}
+	cache := NewMultiSourceCache([]PriceService{primary, secondary}, time.Minute)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, primary.getNumCalls(), "wrong number of primary service calls")
+	assertInt(t, 1, secondary.getNumCalls(), "wrong number of secondary service calls")
+
+	_, err := cache.GetPriceFor("p2")
+	if !errors.Is(err, primaryErr) || !errors.Is(err, secondaryErr) {
+		t.Errorf("expected the errors of both services, got %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != ErrNilService {
+			t.Errorf("expected a panic with ErrNilService, got %v", r)
+		}
+	}()
+	NewMultiSourceCache([]PriceService{primary, nil}, time.Minute)
+}
+
+// Check that swapping the service keeps the cached prices, lets the call in-flight finish with the old service and
+// sends the next misses to the new one
+func TestSetPriceService_SwapsServiceKeepingPrices(t *testing.T) {
+	oldService := &mockPriceService{
+		callDelay: 50 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	newService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p2": {price: 8, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(oldService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	inFlight := make(chan float64)
+	go func() {
+		price, _ := cache.GetPriceFor("p2")
+		inFlight <- price
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := cache.SetPriceService(newService); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFloat(t, 7, <-inFlight, "wrong price returned by the call in-flight")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong cached price returned")
+	assertFloat(t, 9, getPriceWithNoErr(t, cache, "p3"), "wrong price returned")
+	assertInt(t, 2, oldService.getNumCalls(), "wrong number of old service calls")
+	assertInt(t, 1, newService.getNumCalls(), "wrong number of new service calls")
+
+	if err := cache.SetPriceService(nil); !errors.Is(err, ErrNilService) {
+		t.Errorf("expected ErrNilService, got %v", err)
+	}
+	cache.Invalidate("p2")
+	assertFloat(t, 8, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+}
+
+// panickingPriceService is a PriceService that panics for the item codes given, working like the mock for the rest
+type panickingPriceService struct {
+	mockPriceService
+	panicCodes map[string]bool
+}
+
+func (m *panickingPriceService) GetPriceFor(itemCode string) (float64, error) {
+	if m.panicCodes[itemCode] {
+		panic("buggy service")
+	}
+	return m.mockPriceService.GetPriceFor(itemCode)
+}
+
+// Check that every item of a resilient batch gets its own outcome in order, a price, an error or a recovered panic
+func TestGetPricesForResilient_ReportsEveryOutcome(t *testing.T) {
+	mockService := &panickingPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 0, err: fmt.Errorf("p2 error")},
+			},
+		},
+		panicCodes: map[string]bool{"p3": true},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	results := cache.GetPricesForResilient(context.Background(), "p1", "p2", "p3")
+	assertInt(t, 3, len(results), "wrong number of results")
+	for i, code := range []string{"p1", "p2", "p3"} {
+		if results[i].Code != code {
+			t.Errorf("expected result %d for %s, got %s", i, code, results[i].Code)
+		}
+	}
+	if results[0].Err != nil {
+		t.Errorf("unexpected error for p1: %v", results[0].Err)
+	}
+	assertFloat(t, 5, results[0].Price, "wrong price returned")
+	if results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "p2 error") {
+		t.Errorf("expected the p2 error, got %v", results[1].Err)
+	}
+	if !errors.Is(results[2].Err, ErrServicePanic) {
+		t.Errorf("expected ErrServicePanic, got %v", results[2].Err)
+	}
+
+	// a cancelled context still gets one outcome for every item, the context error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = cache.GetPricesForResilient(ctx, "p4", "p5")
+	assertInt(t, 2, len(results), "wrong number of results")
+	for i, code := range []string{"p4", "p5"} {
+		if results[i].Code != code || !errors.Is(results[i].Err, context.Canceled) {
+			t.Errorf("expected result %d for %s to be cancelled, got %+v", i, code, results[i])
+		}
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a panicking service fails the item it panicked for, without crashing nor failing the other items
+func TestGetPricesFor_RecoversServicePanic(t *testing.T) {
+	mockService := &panickingPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p3": {price: 9, err: nil},
+			},
+		},
+		panicCodes: map[string]bool{"p2": true},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	prices, err := cache.GetPricesForAll("p1", "p2", "p3")
+	if !errors.Is(err, ErrServicePanic) {
+		t.Errorf("expected ErrServicePanic, got %v", err)
+	}
+	assertFloats(t, []float64{5, 0, 9}, prices, "wrong prices returned")
+	if _, err := cache.GetPriceFor("p2"); !errors.Is(err, ErrServicePanic) {
+		t.Errorf("expected ErrServicePanic, got %v", err)
+	}
+}
+
+// ttlPriceService is a PriceService that also tells a TTL for every item, working like the mock for the prices
+type ttlPriceService struct {
+	mockPriceService
+	ttls map[string]time.Duration
+}
+
+func (m *ttlPriceService) GetPriceWithTTL(itemCode string) (float64, time.Duration, error) {
+	price, err := m.mockPriceService.GetPriceFor(itemCode)
+	return price, m.ttls[itemCode], err
+}
+
+// Check that every price expires according to the TTL the service told for it, or the max age if it told none
+func TestTTLPriceService_ExpiresByServiceTTL(t *testing.T) {
+	mockService := &ttlPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+				"p3": {price: 9, err: nil},
+			},
+		},
+		ttls: map[string]time.Duration{"p1": 10 * time.Second, "p2": 2 * time.Minute},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPricesWithNoErr(t, cache, "p1", "p2", "p3")
+
+	clock.Advance(30 * time.Second) // "p1" expired
+	getPricesWithNoErr(t, cache, "p1", "p2", "p3")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+	clock.Advance(45 * time.Second) // "p3" expired by the max age, and "p1" again
+	getPricesWithNoErr(t, cache, "p1", "p2", "p3")
+	assertInt(t, 6, mockService.getNumCalls(), "wrong number of service calls")
+	clock.Advance(50 * time.Second) // "p2" expired
+	getPriceWithNoErr(t, cache, "p2")
+	assertInt(t, 7, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that invalidating while reading does not race (run with -race)
+func TestInvalidate_ConcurrentWithReads(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if i%10 == 0 {
+				cache.InvalidateAll()
+			} else {
+				cache.Invalidate("p1")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Check that service errors can be inspected through the cache error
+func TestGetPriceFor_WrapsServiceError(t *testing.T) {
+	errNotFound := errors.New("not found")
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: errNotFound},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	_, err := cache.GetPriceFor("p1")
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("expected error to wrap %v, got %v", errNotFound, err)
+	}
+	var fetchErr *PriceFetchError
+	if !errors.As(err, &fetchErr) {
+		t.Fatalf("expected a PriceFetchError, got %T", err)
+	}
+	if fetchErr.ItemCode != "p1" {
+		t.Errorf("wrong item code in error, expected : p1, got : %v", fetchErr.ItemCode)
+	}
+}
+
+// Check that a batch never runs more service calls at the same time than the configured concurrency
+func TestSetConcurrency_LimitsParallelCalls(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay:   20 * time.Millisecond,
+		mockResults: map[string]mockResult{},
+	}
+	codes := []string{}
+	expected := []float64{}
+	for i := 0; i < 20; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+		expected = append(expected, float64(i))
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetConcurrency(3)
+	assertFloatsInOrder(t, expected, getPricesWithNoErr(t, cache, codes...), "wrong price returned")
+	assertInt(t, 20, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 3, mockService.getMaxInFlight(), "wrong number of parallel service calls")
+}
+
+// Check that warming up leaves every item cached and fresh
+func TestWarmUp_CachesEveryItem(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	if err := cache.WarmUp("p1", "p2", "p3"); err != nil {
+		t.Errorf("unexpected error warming up: %v", err)
+	}
+	assertInt(t, 3, cache.Len(), "wrong number of cached items")
+	assertFloatsInOrder(t, []float64{5, 7, 9}, getPricesWithNoErr(t, cache, "p1", "p2", "p3"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that warming up goes through every item and reports all failures
+func TestWarmUp_JoinsErrors(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("p1 error")},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 0, err: fmt.Errorf("p3 error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	err := cache.WarmUp("p1", "p2", "p3")
+	if err == nil || !strings.Contains(err.Error(), "p1 error") || !strings.Contains(err.Error(), "p3 error") {
+		t.Errorf("expected both errors, got %v", err)
+	}
+	assertInt(t, 1, cache.Len(), "wrong number of cached items")
+}
+
+// Check that warming up with a context tells the progress of every item, and stops fetching once canceled
+func TestWarmUpContext_ProgressAndCancel(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := make([]string, 10)
+	for i := range codes {
+		codes[i] = fmt.Sprintf("p%d", i)
+		mockService.mockResults[codes[i]] = mockResult{price: float64(i), err: nil}
+	}
+	cache := NewCacheWithOptions(mockService, WithConcurrency(2))
+	calls := 0
+	err := cache.WarmUpContext(context.Background(), func(done, total int) {
+		calls++
+		assertInt(t, calls, done, "wrong number of items done")
+		assertInt(t, len(codes), total, "wrong total number of items")
+	}, codes...)
+	if err != nil {
+		t.Errorf("unexpected error warming up: %v", err)
+	}
+	assertInt(t, len(codes), calls, "wrong number of progress calls")
+	assertInt(t, len(codes), cache.Len(), "wrong number of cached items")
+
+	// canceling after the first items are done leaves the rest unfetched
+	mockService = &mockPriceService{mockResults: mockService.mockResults, callDelay: 10 * time.Millisecond}
+	cache = NewCacheWithOptions(mockService, WithConcurrency(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = cache.WarmUpContext(ctx, func(done, total int) {
+		if done == 2 {
+			cancel()
+		}
+	}, codes...)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if mockService.getNumCalls() > 3 {
+		t.Errorf("expected the remaining items not to be fetched, got %d service calls", mockService.getNumCalls())
+	}
+}
+
+// Check that every failing item is reported while the rest of the prices are still returned
+func TestGetPricesForAll_ReportsEveryFailure(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+			"p3": {price: 7, err: nil},
+			"p4": {price: 0, err: fmt.Errorf("some error")},
+			"p5": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	prices, err := cache.GetPricesForAll("p1", "p2", "p3", "p4", "p5")
+	assertFloatsInOrder(t, []float64{5, 0, 7, 0, 0}, prices, "wrong price returned")
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	for _, code := range []string{"p2", "p4", "p5"} {
+		if !strings.Contains(err.Error(), code) {
+			t.Errorf("expected error to mention %v, got %v", code, err)
+		}
+	}
+	for _, code := range []string{"p1", "p3"} {
+		if strings.Contains(err.Error(), code) {
+			t.Errorf("expected error not to mention %v, got %v", code, err)
+		}
+	}
+}
+
+// Check that the price source is reported for cold misses, fresh hits and stale entries
+func TestGetPriceForWithSource_ReportsCacheHits(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	assertSource := func(expected bool, msg string) {
+		price, fromCache, err := cache.GetPriceForWithSource("p1")
+		if err != nil {
+			t.Error("error getting price for", "p1")
+		}
+		assertFloat(t, 5, price, "wrong price returned")
+		if fromCache != expected {
+			t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, fromCache))
+		}
+	}
+	assertSource(false, "cold miss reported as cache hit")
+	assertSource(true, "fresh hit not reported as cache hit")
+	clock.Advance(time.Minute)
+	assertSource(false, "stale entry reported as cache hit")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the time a price was fetched at is returned for misses and hits, by the injected clock, and that a
+// default price is returned without one
+func TestGetPriceForWithTime_ReturnsFetchTime(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: errors.New("p2 error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock),
+		WithDefaultPrice(func(itemCode string) (float64, bool) { return 1, true }))
+	assertTime := func(itemCode string, price float64, expected time.Time, msg string) {
+		actualPrice, createdAt, err := cache.GetPriceForWithTime(itemCode)
+		if err != nil {
+			t.Error("error getting price for", itemCode)
+		}
+		assertFloat(t, price, actualPrice, "wrong price returned")
+		if !createdAt.Equal(expected) {
+			t.Error(msg, fmt.Sprintf("expected : %v, got : %v", expected, createdAt))
+		}
+	}
+	fetchedAt := clock.Now()
+	assertTime("p1", 5, fetchedAt, "wrong time for a cold miss")
+	clock.Advance(30 * time.Second)
+	assertTime("p1", 5, fetchedAt, "wrong time for a fresh hit")
+	clock.Advance(time.Minute)
+	assertTime("p1", 5, clock.Now(), "wrong time for a refetched price")
+	assertTime("p2", 1, time.Time{}, "wrong time for a default price")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+
+	// a default price served in place of an expired one is not given the time of the expired one
+	mockService.setResult("p1", mockResult{price: 0, err: errors.New("p1 error")})
+	clock.Advance(time.Minute)
+	assertTime("p1", 1, time.Time{}, "wrong time for a default price replacing an expired one")
+}
+
+// Check that many readers can hit fresh prices while a single writer keeps refreshing one of them (run with -race)
+func TestGetPriceFor_ConcurrentReadersAndWriter(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPricesWithNoErr(t, cache, "p1", "p2")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cache.Invalidate("p2")
+			getPriceWithNoErr(t, cache, "p2")
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+}
+
+// Check that every item is returned once by its code, however many times it was asked for, and that only the prices
+// before the first failing item are returned along with its error
+func TestGetPricesMap_ReturnsPricesByCode(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	prices, err := cache.GetPricesMap("p2", "p1", "p2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertInt(t, 2, len(prices), "wrong number of prices returned")
+	assertFloat(t, 5, prices["p1"], "wrong price returned")
+	assertFloat(t, 7, prices["p2"], "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	prices, err = cache.GetPricesMap("p1", "p3", "p2")
+	if err == nil {
+		t.Error("expected an error for the failing item")
+	}
+	if len(prices) != 1 || prices["p1"] != 5 {
+		t.Errorf("expected only the price before the failing item, got %v", prices)
+	}
+
+	// zero filled results do not make the failing items look like zero prices
+	zeroFilled := NewCacheWithOptions(mockService, WithErrorResults(ZeroFilledResults))
+	prices, err = zeroFilled.GetPricesMap("p1", "p3")
+	if err == nil {
+		t.Error("expected an error for the failing item")
+	}
+	if _, ok := prices["p3"]; ok || len(prices) != 1 || prices["p1"] != 5 {
+		t.Errorf("expected the failing item to be left out, got %v", prices)
+	}
+}
+
+// Check that no item codes return an empty slice, without calling the service nor allocating anything
+func TestGetPricesFor_NoItemCodes(t *testing.T) {
+	mockService := &mockPriceService{}
+	cache := NewTransparentCache(mockService, time.Minute)
+	prices, err := cache.GetPricesFor()
+	if err != nil || prices == nil || len(prices) != 0 {
+		t.Errorf("expected an empty slice and no error, got %v, %v", prices, err)
+	}
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+	allocs := testing.AllocsPerRun(100, func() {
+		cache.GetPricesFor()
+	})
+	assertInt(t, 0, int(allocs), "wrong number of allocations")
+}
+
+// Check that a batch of items all cached is served without setting up any lookup, only allocating what it returns
+// along with the entries it found, and that every item is counted as a hit
+func TestGetPricesFor_AllCached(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	itemCodes := []string{"p1", "p2", "p1"}
+	cache.GetPricesFor(itemCodes...)
+	prices, err := cache.GetPricesFor(itemCodes...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFloatsInOrder(t, []float64{5, 7, 5}, prices, "wrong prices returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 3, int(cache.Stats().Hits), "wrong number of hits")
+	allocs := testing.AllocsPerRun(100, func() {
+		cache.GetPricesFor(itemCodes...)
+	})
+	assertInt(t, 2, int(allocs), "wrong number of allocations")
+}
+
+// Check that every item gets its own outcome, in the same order as asked for
+func TestGetPricesForDetailed_ReportsEveryItem(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	results := cache.GetPricesForDetailed("p3", "p2", "p1")
+	assertInt(t, 3, len(results), "wrong number of results")
+	for i, expected := range []ItemResult{{Code: "p3", Price: 9}, {Code: "p2"}, {Code: "p1", Price: 5}} {
+		r := results[i]
+		if r.Code != expected.Code {
+			t.Errorf("wrong item code at %d, expected : %v, got : %v", i, expected.Code, r.Code)
+		}
+		assertFloat(t, expected.Price, r.Price, "wrong price returned")
+		if (r.Err != nil) != (r.Code == "p2") {
+			t.Errorf("wrong error for %v: %v", r.Code, r.Err)
+		}
+	}
+}
+
+// Check that every item of a batch tells whether its price was a fresh cached one, the expired and missing ones not
+func TestGetPricesForDetailed_ReportsCacheHits(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"fresh":   {price: 5, err: nil},
+			"stale":   {price: 7, err: nil},
+			"missing": {price: 9, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "stale")
+	clock.Advance(40 * time.Second)
+	getPriceWithNoErr(t, cache, "fresh")
+	clock.Advance(40 * time.Second)
+
+	results := cache.GetPricesForDetailed("stale", "fresh", "missing", "fresh")
+	for i, expected := range []bool{false, true, false, true} {
+		r := results[i]
+		if r.Err != nil {
+			t.Errorf("unexpected error for %v: %v", r.Code, r.Err)
+		}
+		if r.FromCache != expected {
+			t.Errorf("wrong cache hit for %v, expected : %v, got : %v", r.Code, expected, r.FromCache)
+		}
+	}
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a price set directly is served without calling the service, and expires like a fetched one
+func TestSetPrice_SeedsCache(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	cache.SetPrice("p1", 3)
+	assertFloat(t, 3, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+
+	clock.Advance(time.Minute)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that empty item codes are rejected without calling the service nor caching them
+func TestGetPriceFor_EmptyItemCode(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"A": {price: 5, err: nil},
+			"B": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	if _, err := cache.GetPriceFor(""); !errors.Is(err, ErrEmptyItemCode) {
+		t.Errorf("expected ErrEmptyItemCode, got %v", err)
+	}
+	_, err := cache.GetPricesFor("A", "", "B")
+	if !errors.Is(err, ErrEmptyItemCode) {
+		t.Errorf("expected ErrEmptyItemCode, got %v", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("expected the error to tell the bad index, got %v", err)
+	}
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+
+	results := cache.GetPricesForDetailed("A", "")
+	if results[0].Err != nil || !errors.Is(results[1].Err, ErrEmptyItemCode) {
+		t.Errorf("expected only the empty item code to fail, got %+v", results)
+	}
+}
+
+// Check that the items not done by the deadline are reported as timed out, while the others succeed
+func TestGetPricesForWithDeadline_TimesOutSlowItems(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+		itemDelays: map[string]time.Duration{"p2": 300 * time.Millisecond},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	defer cache.Close()
+	start := time.Now()
+	results := cache.GetPricesForWithDeadline(start.Add(50*time.Millisecond), "p1", "p2", "p3")
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected to stop waiting at the deadline, took %v", elapsed)
+	}
+	if results[0].Err != nil || results[0].Price != 5 || results[2].Err != nil || results[2].Price != 9 {
+		t.Errorf("expected the fast items to succeed, got %+v", results)
+	}
+	if !errors.Is(results[1].Err, ErrDeadlineExceeded) || results[1].Code != "p2" {
+		t.Errorf("expected the slow item to time out, got %+v", results[1])
+	}
+}
+
+// timeoutPriceService is a context aware PriceService giving up on every item on its own after its timeout, sooner
+// than the deadline of its caller, like a client with a timeout of its own would
+type timeoutPriceService struct {
+	timeout time.Duration
+}
+
+func (s *timeoutPriceService) GetPriceFor(itemCode string) (float64, error) {
+	return s.GetPriceForContext(context.Background(), itemCode)
+}
+
+func (s *timeoutPriceService) GetPriceForContext(ctx context.Context, itemCode string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// Check that items failing with the deadline error of a context aware service, wrapped with their item code, time
+// out like the ones the cache stopped waiting for
+func TestGetPricesForWithDeadline_TimesOutContextAwareService(t *testing.T) {
+	service := &timeoutPriceService{timeout: 5 * time.Millisecond}
+	cache := NewTransparentCache(service, time.Minute)
+	defer cache.Close()
+	results := cache.GetPricesForWithDeadline(time.Now().Add(time.Second), "p1", "p2")
+	for _, r := range results {
+		if !errors.Is(r.Err, ErrDeadlineExceeded) {
+			t.Errorf("expected %v to time out, got %v", r.Code, r.Err)
+		}
+	}
+}
+
+// Check that every item is sent as soon as it is done, the slow one last, and the channel closed after all of them
+func TestStreamPricesFor_SendsEveryItem(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+		itemDelays: map[string]time.Duration{"p1": 100 * time.Millisecond},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	defer cache.Close()
+	prices := map[string]float64{}
+	var last ItemResult
+	for r := range cache.StreamPricesFor(context.Background(), "p1", "", "p2", "p3") {
+		if r.Code == "" {
+			if !errors.Is(r.Err, ErrEmptyItemCode) {
+				t.Errorf("expected ErrEmptyItemCode for the empty item code, got %v", r.Err)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("unexpected error for %v: %v", r.Code, r.Err)
+		}
+		prices[r.Code] = r.Price
+		last = r
+	}
+	assertInt(t, 3, len(prices), "wrong number of items sent")
+	assertFloats(t, []float64{5, 7, 9}, []float64{prices["p1"], prices["p2"], prices["p3"]}, "wrong prices sent")
+	if last.Code != "p1" {
+		t.Errorf("expected the slow item to be sent last, got %v", last.Code)
+	}
+}
+
+// Check that cancelling the context closes the channel without waiting on the slow items
+func TestStreamPricesFor_StopsOnCancel(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+		itemDelays: map[string]time.Duration{"p2": 300 * time.Millisecond, "p3": 300 * time.Millisecond},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	defer cache.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	results := cache.StreamPricesFor(ctx, "p1", "p2", "p3")
+	r := <-results
+	if r.Code != "p1" || r.Err != nil {
+		t.Errorf("expected the fast item first, got %+v", r)
+	}
+	cancel()
+	for r := range results {
+		// an item looked up when ctx got done may still be sent, with ctx.Err()
+		if r.Err == nil {
+			t.Errorf("expected no more prices after cancelling, got %+v", r)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the channel to be closed once cancelled, took %v", elapsed)
+	}
+}
+
+// Check that getting a fresh price always calls the service and restarts the age of the cached price
+func TestGetPriceForFresh_AlwaysCallsService(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(20 * time.Second)
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+
+	for i := 0; i < 3; i++ {
+		price, err := cache.GetPriceForFresh("p1")
+		if err != nil {
+			t.Error("error getting fresh price for", "p1")
+		}
+		assertFloat(t, 6, price, "wrong price returned")
+	}
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+	if age, _ := cache.AgeOf("p1"); age != 0 {
+		t.Errorf("expected the age to restart, got %v", age)
+	}
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+	if _, err := cache.GetPriceForFresh(""); !errors.Is(err, ErrEmptyItemCode) {
+		t.Errorf("expected ErrEmptyItemCode, got %v", err)
+	}
+}
+
+// Check that a fresh price is served as is, one expiring soon is refreshed right away and an expired one fetched
+func TestGetPriceForRefreshing_RefreshesNearExpiry(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPrice := func() float64 {
+		price, err := cache.GetPriceForRefreshing("p1", 10*time.Second)
+		if err != nil {
+			t.Error("error getting refreshing price for", "p1")
+		}
+		return price
+	}
+	assertFloat(t, 5, getPrice(), "wrong price returned")
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+
+	// fresh
+	clock.Advance(30 * time.Second)
+	assertFloat(t, 5, getPrice(), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+
+	// near expiry
+	clock.Advance(25 * time.Second)
+	assertFloat(t, 6, getPrice(), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	if age, _ := cache.AgeOf("p1"); age != 0 {
+		t.Errorf("expected the age to restart, got %v", age)
+	}
+	assertFloat(t, 6, getPrice(), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	// expired
+	mockService.setResult("p1", mockResult{price: 7, err: nil})
+	clock.Advance(time.Minute)
+	assertFloat(t, 7, getPrice(), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+	if _, err := cache.GetPriceForRefreshing("", time.Second); !errors.Is(err, ErrEmptyItemCode) {
+		t.Errorf("expected ErrEmptyItemCode, got %v", err)
+	}
+}
+
+// Check that the same cached price is a hit for a lenient max age and a miss for a strict one, leaving the max age
+// of the cache as it was
+func TestGetPriceForMaxAge_OverridesFreshness(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPrice := func(maxAge time.Duration) float64 {
+		price, err := cache.GetPriceForMaxAge("p1", maxAge)
+		if err != nil {
+			t.Error("error getting price for", "p1")
+		}
+		return price
+	}
+	getPriceWithNoErr(t, cache, "p1")
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+
+	// strict, even if fresh for the cache
+	clock.Advance(30 * time.Second)
+	assertFloat(t, 6, getPrice(10*time.Second), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 2, int(cache.Stats().Misses), "wrong number of misses")
+
+	// lenient, even if expired for the cache
+	mockService.setResult("p1", mockResult{price: 7, err: nil})
+	clock.Advance(90 * time.Second)
+	assertFloat(t, 6, getPrice(2*time.Minute), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 1, int(cache.Stats().Hits), "wrong number of hits")
+
+	if cache.MaxAge() != time.Minute {
+		t.Errorf("wrong max age, expected : %v, got : %v", time.Minute, cache.MaxAge())
+	}
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that getting the prices for a slice works the same as for the item codes one by one
+func TestGetPricesForSlice_MatchesVariadic(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	codes := []string{"p2", "p1", "p2"}
+	prices, err := cache.GetPricesForSlice(codes)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assertFloatsInOrder(t, getPricesWithNoErr(t, cache, codes...), prices, "wrong prices returned")
+
+	_, sliceErr := cache.GetPricesForSlice([]string{"p1", "p3"})
+	_, variadicErr := cache.GetPricesFor("p1", "p3")
+	if sliceErr == nil || variadicErr == nil || sliceErr.Error() != variadicErr.Error() {
+		t.Errorf("expected the same error, got %v and %v", sliceErr, variadicErr)
+	}
+	if _, err := cache.GetPricesForSlice([]string{"p1", ""}); !errors.Is(err, ErrEmptyItemCode) {
+		t.Errorf("expected ErrEmptyItemCode, got %v", err)
+	}
+}
+
+// mockWriterPriceService also stores the prices it is told
+type mockWriterPriceService struct {
+	mockPriceService
+	written map[string]float64
+	err     error
+}
+
+func (m *mockWriterPriceService) SetPriceFor(itemCode string, price float64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.written[itemCode] = price
+	return nil
+}
+
+// Check that updated prices reach the service and are cached only when the service accepts them
+func TestUpdatePrice_WritesThrough(t *testing.T) {
+	mockService := &mockWriterPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+			},
+		},
+		written: map[string]float64{},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+
+	if err := cache.UpdatePrice("p1", 6); err != nil {
+		t.Errorf("unexpected error updating: %v", err)
+	}
+	assertFloat(t, 6, mockService.written["p1"], "wrong price written")
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+
+	mockService.err = errors.New("some error")
+	if err := cache.UpdatePrice("p1", 7); !errors.Is(err, mockService.err) {
+		t.Errorf("expected the service error, got %v", err)
+	}
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that an updated alias is written and cached by its canonical ID, resolving the alias only
+func TestUpdatePrice_ResolvesItemCodeOnce(t *testing.T) {
+	mockService := &mockWriterPriceService{written: map[string]float64{}}
+	resolutions := map[string]int{}
+	cache := NewCacheWithOptions(mockService, WithCanonicalItemCodes(func(itemCode string) (string, error) {
+		resolutions[itemCode]++
+		return strings.TrimPrefix(itemCode, "sku-"), nil
+	}))
+
+	if err := cache.UpdatePrice("sku-p1", 6); err != nil {
+		t.Errorf("unexpected error updating: %v", err)
+	}
+	assertFloat(t, 6, mockService.written["p1"], "wrong price written")
+	assertInt(t, 1, resolutions["sku-p1"], "wrong number of resolutions")
+	assertInt(t, 0, resolutions["p1"], "wrong number of resolutions")
+	if keys := cache.Keys(); len(keys) != 1 || keys[0] != "p1" {
+		t.Errorf("expected the price to be cached by its canonical ID, got %v", keys)
+	}
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "sku-p1"), "wrong price returned")
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that updating fails for a service that cannot store prices
+func TestUpdatePrice_ReadOnlyService(t *testing.T) {
+	cache := NewTransparentCache(&mockPriceService{}, time.Minute)
+	if err := cache.UpdatePrice("p1", 6); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+}
+
+// Check that an item asked for several times at once calls the service once, its price returned at every position
+func TestGetPricesFor_DeduplicatesItems(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 10 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"A": {price: 5, err: nil},
+			"B": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	prices := getPricesWithNoErr(t, cache, "A", "A", "B", "A", "B")
+	assertFloatsInOrder(t, []float64{5, 5, 7, 5, 7}, prices, "wrong prices returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	assertStats(t, Stats{Misses: 2, Entries: 2}, cache.Stats())
+}
+
+// mockPriceCache is how a user of the package would mock it in its own tests
+type mockPriceCache struct {
+	PriceCache // panics on any method not mocked
+	prices     map[string]float64
+}
+
+func (m *mockPriceCache) GetPriceFor(itemCode string) (float64, error) {
+	price, ok := m.prices[itemCode]
+	if !ok {
+		return 0, fmt.Errorf("no price for %v", itemCode)
+	}
+	return price, nil
+}
+
+// Check that code depending on PriceCache works with both the cache and a mock of it
+func TestPriceCache_CanBeMocked(t *testing.T) {
+	total := func(cache PriceCache, itemCodes ...string) float64 {
+		sum := 0.0
+		for _, itemCode := range itemCodes {
+			price, err := cache.GetPriceFor(itemCode)
+			if err != nil {
+				t.Fatalf("unexpected error getting %v: %v", itemCode, err)
+			}
+			sum += price
+		}
+		return sum
+	}
+	mock := &mockPriceCache{prices: map[string]float64{"p1": 5, "p2": 7}}
+	assertFloat(t, 12, total(mock, "p1", "p2"), "wrong total with the mock")
+
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	assertFloat(t, 12, total(NewTransparentCache(mockService, time.Minute), "p1", "p2"), "wrong total with the cache")
+}
+
+// Check that a zero price is rejected and not cached, while other prices are cached as usual
+func TestWithRejectZeroPrice_RejectsZero(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithRejectZeroPrice())
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetPriceFor("p1"); !errors.Is(err, ErrInvalidPrice) {
+			t.Errorf("expected ErrInvalidPrice, got %v", err)
+		}
+	}
+	if _, ok := cache.peek("p1"); ok {
+		t.Error("expected the zero price not to be cached")
+	}
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that lowering the max age makes the prices already cached expire by the new one
+func TestSetMaxAge_AffectsCachedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p1")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+
+	cache.SetMaxAge(20 * time.Second)
+	if cache.MaxAge() != 20*time.Second {
+		t.Errorf("wrong max age, expected : 20s, got : %v", cache.MaxAge())
+	}
+	getPriceWithNoErr(t, cache, "p1")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a max age of zero disables caching, calling the service every time without storing anything
+func TestGetPriceFor_ZeroMaxAgeDisablesCaching(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, 0)
+	for i := 0; i < 10; i++ {
+		assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+		assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	}
+	assertInt(t, 20, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+}
+
+// BenchmarkGetPricesFor_AllCached measures a batch of items that are all fresh in the cache, run with -benchmem to
+// see it only allocates its results and the entries it found
+func BenchmarkGetPricesFor_AllCached(b *testing.B) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	itemCodes := make([]string, 100)
+	for i := range itemCodes {
+		itemCodes[i] = fmt.Sprintf("p%d", i)
+		mockService.mockResults[itemCodes[i]] = mockResult{price: float64(i), err: nil}
+	}
+	cache := NewTransparentCache(mockService, time.Hour)
+	if _, err := cache.GetPricesFor(itemCodes...); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetPricesFor(itemCodes...)
+	}
+}
+
+// BenchmarkGetPriceFor_ConcurrentReaders measures fresh hits from many goroutines while a single writer keeps
+// replacing another price. "exclusive" serializes every call behind one more mutex, like a plain sync.Mutex would,
+// to compare it with the read locks the cache takes
+func BenchmarkGetPriceFor_ConcurrentReaders(b *testing.B) {
+	for _, exclusive := range []bool{false, true} {
+		name := "shared"
+		if exclusive {
+			name = "exclusive"
+		}
+		b.Run(name, func(b *testing.B) {
+			mockService := &mockPriceService{
+				mockResults: map[string]mockResult{
+					"p1": {price: 5, err: nil},
+					"p2": {price: 7, err: nil},
+				},
+			}
+			cache := NewTransparentCache(mockService, time.Hour)
+			cache.GetPricesFor("p1", "p2")
+			var mutex sync.Mutex
+			get := func(code string) {
+				if exclusive {
+					mutex.Lock()
+					defer mutex.Unlock()
+				}
+				cache.GetPriceFor(code)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						cache.Invalidate("p2")
+						get("p2")
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					get("p1")
+				}
+			})
+		})
+	}
+}
+
+// paramPriceService is a PriceService that also takes the currency of an item, pricing "p1" in "EUR" as the mock
+// does for "p1/EUR"
+type paramPriceService struct {
+	mockPriceService
+}
+
+func (m *paramPriceService) GetPriceForWithParams(itemCode string, params map[string]string) (float64, error) {
+	return m.mockPriceService.GetPriceFor(itemCode + "/" + params["currency"])
+}
+
+// Check that every set of params is cached on its own, whatever their order, with a single service call each
+func TestGetPriceForWithParams_CachesEveryParamSet(t *testing.T) {
+	mockService := &paramPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1":     {price: 5, err: nil},
+				"p1/USD": {price: 6, err: nil},
+				"p1/EUR": {price: 7, err: nil},
+			},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPrice := func(params map[string]string) float64 {
+		price, err := cache.GetPriceForWithParams("p1", params)
+		if err != nil {
+			t.Error("error getting price for p1 with", params)
+		}
+		return price
+	}
+	for i := 0; i < 3; i++ {
+		assertFloat(t, 6, getPrice(map[string]string{"currency": "USD", "region": "AR"}), "wrong price returned")
+		assertFloat(t, 7, getPrice(map[string]string{"region": "AR", "currency": "EUR"}), "wrong price returned")
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 3, cache.Len(), "wrong number of cached items")
+
+	// a service without params cannot tell them apart
+	plain := NewTransparentCache(&mockService.mockPriceService, time.Minute)
+	_, err := plain.GetPriceForWithParams("p1", map[string]string{"currency": "USD"})
+	if !errors.Is(err, ErrParamsUnsupported) {
+		t.Errorf("expected ErrParamsUnsupported, got %v", err)
+	}
+}
+
+// paramBatchPriceService is a mockBatchPriceService that also takes the currency of an item like paramPriceService
+type paramBatchPriceService struct {
+	mockBatchPriceService
+}
+
+func (m *paramBatchPriceService) GetPriceForWithParams(itemCode string, params map[string]string) (float64, error) {
+	return m.mockPriceService.GetPriceFor(itemCode + "/" + params["currency"])
+}
+
+// Check that item codes holding the params separator are taken as they are by services without params, keeping the
+// context and the batching
+func TestGetPriceFor_SeparatorInCodeWithoutParamsService(t *testing.T) {
+	tracing := &tracingPriceService{traceIDs: map[string]any{}}
+	cache := NewTransparentCache(tracing, time.Minute)
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "trace-1")
+	if _, err := cache.GetPriceForContext(ctx, "p1?v=2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tracing.traceIDs["p1?v=2"] != "trace-1" {
+		t.Errorf("expected the context to reach the service, got trace ID %v", tracing.traceIDs["p1?v=2"])
+	}
+
+	batching := &mockBatchPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1":     {price: 5, err: nil},
+				"p1?v=2": {price: 6, err: nil},
+			},
+		},
+	}
+	batched := NewCacheWithOptions(batching, WithBatchWindow(50*time.Millisecond))
+	assertFloatsInOrder(t, []float64{5, 6}, getPricesWithNoErr(t, batched, "p1", "p1?v=2"), "wrong price returned")
+	batches := batching.getBatches()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("expected both items in a single batch, got %v", batches)
+	}
+	assertInt(t, 0, batching.getNumCalls(), "wrong number of single service calls")
+}
+
+// Check that an item with params failing in a batch gets the error of the service, while the rest of the batch
+// still gets its prices
+func TestGetPriceForWithParams_BatchedItemGetsItsError(t *testing.T) {
+	mockService := &paramBatchPriceService{
+		mockBatchPriceService: mockBatchPriceService{
+			mockPriceService: mockPriceService{
+				mockResults: map[string]mockResult{
+					"p1":     {price: 5, err: nil},
+					"p1/USD": {price: 6, err: nil},
+					"p1/ARS": {price: 0, err: errors.New("no ARS price")},
+				},
+			},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithBatchWindow(50*time.Millisecond))
+	params := []map[string]string{nil, {"currency": "USD"}, {"currency": "ARS"}}
+	prices := make([]float64, len(params))
+	errs := make([]error, len(params))
+	var wg sync.WaitGroup
+	for i := range params {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			prices[i], errs[i] = cache.GetPriceForWithParams("p1", params[i])
+		}(i)
+	}
+	wg.Wait()
+	assertInt(t, 1, len(mockService.getBatches()), "wrong number of batch calls")
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("unexpected errors: %v, %v", errs[0], errs[1])
+	}
+	assertFloatsInOrder(t, []float64{5, 6}, prices[:2], "wrong price returned")
+	if errs[2] == nil || !strings.Contains(errs[2].Error(), "no ARS price") || errors.Is(errs[2], ErrMissingFromBatch) {
+		t.Errorf("expected the service error, got %v", errs[2])
+	}
+}
@@ -0,0 +1,28 @@
+package sample1
+
+import "time"
+
+// Clock tells the cache what time it is, so tests can control how old the cached values are
+type Clock interface {
+	Now() time.Time
+}
+
+// TickerClock is a Clock that also makes the tickers of the background tasks of the cache, like StartAutoSave and
+// StartSweeper, so tests can tick them along with the time. A ticker ticks every d until stop is called
+// Other clocks tick with the system time
+type TickerClock interface {
+	Clock
+	NewTicker(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+// realClock is the default Clock, using the system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,143 @@
+package sample1
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a TickerClock that only moves when told to
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// fakeTicker ticks once every time the clock is advanced past its next tick, with Advance waiting for the tick to be
+// received, so what the ticker runs is done by the time the clock is advanced again
+type fakeTicker struct {
+	every   time.Duration
+	next    time.Time
+	ticks   chan time.Time
+	stopped chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 3, 16, 12, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	f.now = f.now.Add(d)
+	now := f.now
+	var due []*fakeTicker
+	for _, ticker := range f.tickers {
+		if !ticker.next.After(now) {
+			due = append(due, ticker)
+			for !ticker.next.After(now) {
+				ticker.next = ticker.next.Add(ticker.every)
+			}
+		}
+	}
+	f.mutex.Unlock()
+	for _, ticker := range due {
+		select {
+		case ticker.ticks <- now:
+		case <-ticker.stopped:
+		}
+	}
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ticker := &fakeTicker{every: d, next: f.now.Add(d), ticks: make(chan time.Time), stopped: make(chan struct{})}
+	f.tickers = append(f.tickers, ticker)
+	var once sync.Once
+	return ticker.ticks, func() { once.Do(func() { close(ticker.stopped) }) }
+}
+
+// Check that prices expire according to the injected clock, without sleeping
+func TestSetClock_ExpiresWithFakeClock(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(59 * time.Second)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	clock.Advance(time.Second)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// steppingClock is a fakeClock that moves forward by step every time it is read
+type steppingClock struct {
+	*fakeClock
+	step time.Duration
+}
+
+func (s steppingClock) Now() time.Time {
+	now := s.fakeClock.Now()
+	s.Advance(s.step)
+	return now
+}
+
+// Check that every item in a batch is checked for freshness against the time the batch started
+func TestGetPricesFor_SharesReferenceTime(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := []string{}
+	for i := 0; i < 5; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPricesWithNoErr(t, cache, codes...)
+	clock.Advance(55 * time.Second)
+
+	// every read of the clock moves it 2s, so "p2" onwards would expire if checked against their own time
+	cache.SetClock(steppingClock{fakeClock: clock, step: 2 * time.Second})
+	getPricesWithNoErr(t, cache, codes...)
+	assertInt(t, 5, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a price created after the current time, like after the clock went back, is taken as stale and fetched
+// again, warning about it, and that the sweeper drops the fetched again price once it expires
+func TestSetClock_RefetchesPricesCreatedInTheFuture(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	handler := &capturingHandler{}
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock),
+		WithLogger(slog.New(handler)))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(-time.Hour)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	if r, ok := handler.find("cache entry created in the future"); !ok || r.attrs["skew"].Duration() != time.Hour {
+		t.Errorf("wrong skew warning: %v", r)
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	clock.Advance(time.Minute)
+	assertInt(t, 1, cache.sweep(), "wrong number of prices swept")
+}
@@ -0,0 +1,72 @@
+package sample1
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// eventBufferSize is how many events are kept for a slow consumer before dropping new ones
+const eventBufferSize = 256
+
+// EventKind tells what happened to a key
+type EventKind int
+
+const (
+	EventHit    EventKind = iota // a fresh cached value was served
+	EventMiss                    // the value was absent or too old, so the fetcher was asked for it
+	EventInsert                  // a value was stored
+	EventEvict                   // a value left the cache, whether evicted, invalidated or swept
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventInsert:
+		return "insert"
+	case EventEvict:
+		return "evict"
+	default:
+		return "unknown"
+	}
+}
+
+// CacheEvent is something that happened to a key, as streamed by Events
+type CacheEvent[K comparable] struct {
+	Kind EventKind
+	Key  K
+	At   time.Time
+}
+
+// events holds the channel returned by Events, nil until someone asks for it
+type events[K comparable] struct {
+	ch atomic.Pointer[chan CacheEvent[K]]
+}
+
+// Events returns a channel streaming the cache events as they happen
+// Events are never waited for: when the channel buffer is full they are dropped, so a slow consumer cannot stall the
+// cache. Every call returns the same channel, which is never closed
+func (c *Cache[K, V]) Events() <-chan CacheEvent[K] {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ch := c.events.ch.Load(); ch != nil {
+		return *ch
+	}
+	ch := make(chan CacheEvent[K], eventBufferSize)
+	c.events.ch.Store(&ch)
+	return ch
+}
+
+// emit sends the event unless nobody asked for events or the channel is full
+func (c *Cache[K, V]) emit(kind EventKind, key K) {
+	ch := c.events.ch.Load()
+	if ch == nil {
+		return
+	}
+	select {
+	case *ch <- CacheEvent[K]{Kind: kind, Key: key, At: c.now()}:
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+package sample1
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Check that the events follow the lookups, stores and evictions of the cache
+func TestEvents_StreamsOperations(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxEntries(1), WithClock(clock))
+	events := cache.Events()
+
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p2") // evicts "p1"
+
+	got := []string{}
+	for len(events) > 0 {
+		e := <-events
+		if !e.At.Equal(clock.Now()) {
+			t.Errorf("wrong event time, expected : %v, got : %v", clock.Now(), e.At)
+		}
+		got = append(got, fmt.Sprintf("%v %v", e.Kind, e.Key))
+	}
+	expected := "miss p1,insert p1,hit p1,miss p2,insert p2,evict p1"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("wrong events, expected : %v, got : %v", expected, strings.Join(got, ","))
+	}
+}
+
+// Check that events are dropped instead of blocking the cache when nobody reads them
+func TestEvents_DropsWhenFull(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	events := cache.Events()
+	for i := 0; i < eventBufferSize*2; i++ {
+		getPriceWithNoErr(t, cache, "p1")
+	}
+	assertInt(t, eventBufferSize, len(events), "wrong number of buffered events")
+}
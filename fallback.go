@@ -0,0 +1,89 @@
+package sample1
+
+import (
+	"context"
+	"time"
+)
+
+// strictLookup marks the context of the lookups refusing fallback values, see GetStrict
+type strictLookup struct{}
+
+// GetStrict is like Get but never serves a fallback value, whatever the options of the cache: when the fetcher fails
+// it returns its error instead of a stale, last good or default value, for callers that must not get an outdated
+// one. Callers sharing the fetcher call with it still get the fallback value
+func (c *Cache[K, V]) GetStrict(key K) (V, error) {
+	value, _, err := c.get(context.WithValue(context.Background(), strictLookup{}, true), key, nil)
+	return value, err
+}
+
+// GetBestEffort returns the cached value for the key right away, even if expired, reporting whether there was one
+// An expired value is refreshed in the background, whose failure is not told to the caller, so the value keeps being
+// served until it is refreshed. Only a key without a value waits for the fetcher, reporting false if it fails
+func (c *Cache[K, V]) GetBestEffort(key K) (V, bool) {
+	if resolved, err := c.resolve(key); err == nil && !c.isClosed() && !c.disabled() {
+		now := c.now()
+		e, fresh, refresh := c.cached(resolved, now)
+		switch {
+		case e.CreatedAt.IsZero() || e.Err != nil:
+			// there is no value to serve, so it is a miss like any other
+		case fresh:
+			c.hit(resolved, e, refresh)
+			return e.Value, true
+		default:
+			c.missed(resolved, e, now)
+			c.refreshAhead(resolved)
+			return e.Value, true
+		}
+	}
+	value, err := c.Get(key)
+	return value, err == nil
+}
+
+// fallback returns the value to serve for the key when the fetcher failed, if there is one: the stale value first,
+// or else the default one
+func (c *Cache[K, V]) fallback(key K) (V, source, bool) {
+	if value, ok := c.stale(key); ok {
+		return value, sourceStale, true
+	}
+	if c.defaultValue != nil {
+		if value, ok := c.defaultValue(key); ok {
+			return value, sourceDefault, true
+		}
+	}
+	var zero V
+	return zero, sourceFetcher, false
+}
+
+// stale returns the expired cached value for the key when stale values are allowed, or else the last good one, as
+// long as it is not older than "maxStaleness"
+func (c *Cache[K, V]) stale(key K) (V, bool) {
+	now := c.now()
+	sh := c.shardFor(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	if e, ok := sh.entries[key]; c.staleIfError && ok && e.Err == nil && c.servable(e, now) {
+		return e.Value, true
+	}
+	if e, ok := sh.lastGood[key]; ok && c.servable(e, now) { // only kept with WithLastGoodFallback
+		return e.Value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// staleWhileFetched returns the value of the expired entry, found at now, to serve while its key is being fetched
+// again, when it is allowed and still not too old to be served, see WithServeStaleWhileRefreshing
+func (c *Cache[K, V]) staleWhileFetched(ctx context.Context, e entry[V], now time.Time) (V, bool) {
+	if !c.staleRefetch || e.CreatedAt.IsZero() || e.Err != nil || !c.servable(e, now) ||
+		ctx.Value(strictLookup{}) != nil {
+		var zero V
+		return zero, false
+	}
+	setCreated(ctx, e.CreatedAt)
+	return e.Value, true
+}
+
+// servable reports whether the stale entry is not too old to be served, see WithMaxStaleness
+func (c *Cache[K, V]) servable(e entry[V], now time.Time) bool {
+	return c.maxStaleness <= 0 || now.Sub(e.CreatedAt) <= c.maxStaleness
+}
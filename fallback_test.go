@@ -0,0 +1,253 @@
+package sample1
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Check that a lookup of an expired price being fetched again for another caller gets the expired price right away,
+// while the caller that missed it first waits for the new one
+func TestWithServeStaleWhileRefreshing_ServesExpiredPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock),
+		WithServeStaleWhileRefreshing())
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(2 * time.Minute)
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+	mockService.callDelay = 100 * time.Millisecond
+
+	first := make(chan float64)
+	go func() {
+		price, _ := cache.GetPriceFor("p1")
+		first <- price
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	price, stale, err := cache.GetPriceForWithStale("p1")
+	if err != nil || !stale {
+		t.Errorf("expected the stale price, got stale %v and error %v", stale, err)
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("expected the stale price not to wait for the service")
+	}
+
+	assertFloat(t, 6, <-first, "wrong price returned to the first caller")
+	price, stale, err = cache.GetPriceForWithStale("p1")
+	if err != nil || stale {
+		t.Errorf("expected a fresh price, got stale %v and error %v", stale, err)
+	}
+	assertFloat(t, 6, price, "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a best effort lookup gets an expired price right away, refreshing it in the background, that a failing
+// refresh keeps the price being served, and that only an item without a price waits for the service
+func TestGetPriceForBestEffort_ServesExpiredPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 0, err: fmt.Errorf("p3 error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	assertBestEffort := func(itemCode string, expected float64, found bool) {
+		price, ok := cache.GetPriceForBestEffort(itemCode)
+		if ok != found {
+			t.Errorf("wrong price found for %v, expected : %v, got : %v", itemCode, found, ok)
+		}
+		assertFloat(t, expected, price, "wrong price returned")
+	}
+	waitCalls := func(n int) {
+		for i := 0; i < 50 && mockService.getNumCalls() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond) // for the refresh to be stored once the call returned
+		assertInt(t, n, mockService.getNumCalls(), "wrong number of service calls")
+	}
+	assertBestEffort("p1", 5, true)
+	clock.Advance(2 * time.Minute)
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("p1 error")})
+
+	start := time.Now()
+	assertBestEffort("p1", 5, true)
+	if time.Since(start) > 20*time.Millisecond {
+		t.Error("expected the expired price not to wait for the service")
+	}
+	waitCalls(2)
+	assertBestEffort("p1", 5, true)
+	waitCalls(3)
+
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+	assertBestEffort("p1", 5, true)
+	waitCalls(4)
+	assertBestEffort("p1", 6, true)
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+
+	assertBestEffort("p2", 7, true)
+	assertBestEffort("p3", 0, false)
+}
+
+// Check that an expired price is served when the service fails and stale prices are allowed
+func TestWithStaleIfError_ServesExpiredPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithStaleIfError())
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(2 * time.Minute)
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("some error")})
+
+	price, stale, err := cache.GetPriceForWithStale("p1")
+	if err != nil {
+		t.Errorf("expected the stale price, got error %v", err)
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+	if !stale {
+		t.Error("expected the price to be reported as stale")
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	// once the service is back the price is fresh again
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+	price, stale, err = cache.GetPriceForWithStale("p1")
+	if err != nil || stale {
+		t.Errorf("expected a fresh price, got stale %v and error %v", stale, err)
+	}
+	assertFloat(t, 6, price, "wrong price returned")
+}
+
+// Check that the service error is returned when there is no expired price to serve
+func TestWithStaleIfError_ReturnsErrorWithoutPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithStaleIfError())
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+// Check that the default price is served when the service fails, for the items it has one for
+func TestWithDefaultPrice_ServesDefault(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithDefaultPrice(func(itemCode string) (float64, bool) {
+		return 1, itemCode == "p1"
+	}))
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	if _, err := cache.GetPriceFor("p2"); err == nil {
+		t.Error("expected error for an item without default, got nil")
+	}
+	// the default is not cached, so the service is asked again
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the last good price is served once the cached one expired and was swept, until it is invalidated
+func TestWithLastGoodFallback_ServesLastGoodPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithLastGoodFallback())
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(2 * time.Minute)
+	assertInt(t, 1, cache.sweep(), "wrong number of swept items")
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("some error")})
+
+	price, stale, err := cache.GetPriceForWithStale("p1")
+	if err != nil {
+		t.Errorf("expected the last good price, got error %v", err)
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+	if !stale {
+		t.Error("expected the price to be reported as stale")
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	cache.Invalidate("p1")
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Error("expected error once the last good price was invalidated, got nil")
+	}
+}
+
+// Check that a stale price is only served while it is not older than the max staleness
+func TestWithMaxStaleness_LimitsStalePrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithStaleIfError(),
+		WithMaxStaleness(10*time.Minute))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("some error")})
+
+	clock.Advance(10 * time.Minute) // just inside
+	price, stale, err := cache.GetPriceForWithStale("p1")
+	if err != nil || !stale {
+		t.Errorf("expected the stale price, got stale %v and error %v", stale, err)
+	}
+	assertFloat(t, 5, price, "wrong price returned")
+
+	clock.Advance(time.Second) // just outside
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Error("expected error for a price older than the max staleness, got nil")
+	}
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a strict lookup returns the error of the failing service while a normal one gets the stale price, and
+// that neither last good nor default prices are served to it
+func TestGetPriceForStrict_RefusesFallbacks(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithStaleIfError(),
+		WithLastGoodFallback(), WithDefaultPrice(func(itemCode string) (float64, bool) {
+			return 1, true
+		}))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(2 * time.Minute)
+	mockService.setResult("p1", mockResult{price: 0, err: fmt.Errorf("some error")})
+
+	if price, err := cache.GetPriceForStrict("p1"); err == nil {
+		t.Errorf("expected the service error, got price %v", price)
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, cache.sweep(), "wrong number of prices swept")
+	if price, err := cache.GetPriceForStrict("p1"); err == nil {
+		t.Errorf("expected the service error instead of the last good price, got price %v", price)
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	if price, err := cache.GetPriceForStrict("p2"); err == nil {
+		t.Errorf("expected the service error instead of the default price, got price %v", price)
+	}
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 7, mockService.getNumCalls(), "wrong number of service calls")
+}
@@ -0,0 +1,2025 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by a cache that was closed
+	ErrClosed = errors.New("cache is closed")
+	// ErrTooManyInFlight is returned instead of waiting when the fetcher calls in-flight are at their limit, see
+	// WithFailWhenBusy
+	ErrTooManyInFlight = errors.New("too many calls in-flight")
+	// ErrReadOnly is returned by Update when the fetcher cannot write values back, see Writer
+	ErrReadOnly = errors.New("fetcher does not support writes")
+	// ErrServicePanic is returned when the fetcher, the actual service, panics while getting a value
+	ErrServicePanic = errors.New("service panicked")
+	// ErrFetchTimeout is returned to a caller that gave up waiting on the fetcher call of another one, see
+	// WithSingleFlightTimeout
+	ErrFetchTimeout = errors.New("timed out waiting for the fetcher call in-flight")
+)
+
+// Fetcher is the actual source of the values we cache
+// Calls to it are expected to be expensive (they take time)
+type Fetcher[K comparable, V any] interface {
+	Fetch(key K) (V, error)
+}
+
+// ContextFetcher is a Fetcher that can stop fetching once its context is done
+// It is given the context of the lookup that started the call. If that lookup is cancelled, the callers sharing the
+// call that are not start a new one instead of getting its error
+type ContextFetcher[K comparable, V any] interface {
+	FetchContext(ctx context.Context, key K) (V, error)
+}
+
+// TTLFetcher is a Fetcher that also tells how long every value it fetches can be cached for, taking precedence over
+// "maxAge" but not over SetTTL for that value. A TTL of zero or less means there is no hint, so "maxAge" is used
+type TTLFetcher[K comparable, V any] interface {
+	FetchWithTTL(ctx context.Context, key K) (V, time.Duration, error)
+}
+
+// Writer is a Fetcher that can also store values back where they are fetched from
+type Writer[K comparable, V any] interface {
+	Write(key K, value V) error
+}
+
+// FetcherFunc lets an ordinary function be used as a Fetcher
+type FetcherFunc[K comparable, V any] func(key K) (V, error)
+
+func (f FetcherFunc[K, V]) Fetch(key K) (V, error) {
+	return f(key)
+}
+
+type entry[V any] struct {
+	Value     V
+	Err       error // set when the fetcher failed and the error is negatively cached
+	CreatedAt time.Time
+	Jitter    float64       // fraction of its max age the entry lives longer (or shorter, if negative)
+	Took      time.Duration // how long the value took to fetch, only set WithProbabilisticExpiry
+	TTL       time.Duration // max age told by a TTLFetcher, zero when there is none
+	Version   uint64        // set when stored, higher for every entry stored after it, see storeSince
+	Tags      []string      // see SetWithTags, kept from the entry it replaces when nil
+	Size      int           // estimated bytes of the value, only set with WithMaxBytes
+}
+
+// call is an in-flight request to the fetcher, shared by every caller missing the same key
+type call[V any] struct {
+	done    chan struct{} // closed once value and err are set
+	created time.Time     // when the value was fetched or stored, zero when it was not cached, see GetWithTime
+	value   V
+	source  source
+	err     error
+	failure error // the fetcher error when a fallback value is served instead, see GetStrict
+	gaveUp  bool  // whether err is only because the lookup running the call was canceled or timed out
+}
+
+// response is the outcome of looking up one of the keys asked for at once, Index being its position among them
+type response[K comparable, V any] struct {
+	Index     int
+	Key       K
+	Value     V
+	Err       error
+	FromCache bool // see GetWithSource
+}
+
+// Cache is a cache that wraps the actual fetcher
+// The cache will remember values we ask for, so that we don't have to wait on every call
+// Cache should only return a value if it is not older than "maxAge", so that we don't get stale values
+// A key can override "maxAge" with its own TTL, see SetTTL
+// When "maxEntries" is set, the least recently used key is evicted to make room for new ones, see WithEvictionPolicy
+// When "maxBytes" is set, the least recently used keys are evicted until the estimated size of the values fits
+// Concurrent misses for the same key share a single call to the fetcher, whichever methods they come from
+// A "maxAge" of zero or less disables caching: every lookup goes straight to the fetcher and nothing is stored
+//
+// Keys are spread over shards with a lock each, so lookups and stores for different keys go on in parallel. The
+// cache-wide lock is only taken to keep the eviction policy of a bounded cache, and to change its settings
+// Locks are always taken cache-wide lock first, and never more than one shard write lock at a time
+type Cache[K comparable, V any] struct {
+	upstream        atomic.Pointer[upstream[K, V]]
+	maxEntries      int
+	maxBytes        int
+	size            func(value V) int // estimates the bytes of a value, set along with maxBytes
+	normalize       func(key K) K     // nil when keys are used as given, see WithKeyNormalizer
+	probeKey        K                 // fetched by HealthCheck when probe is set, see WithHealthProbe
+	probe           bool
+	bytes           int // estimated bytes of the values cached, guarded by the cache-wide lock
+	expiryJitter    float64
+	slots           chan struct{} // one per fetcher call in-flight, nil when unlimited
+	failWhenBusy    bool          // whether to fail instead of waiting for a free slot or the rate limit
+	limiter         *limiter      // nil when the fetcher calls are not rate limited
+	staleIfError    bool
+	maxStaleness    time.Duration    // how old a stale value can be to be served, zero for no limit
+	compress        bool             // whether snapshots are gzip compressed, see WithSnapshotCompression
+	resetOnLoad     bool             // whether loading a snapshot zeroes the counters instead of restoring them
+	lastGood        bool             // whether the last value fetched for every key is kept, see WithLastGoodFallback
+	staleRefetch    bool             // whether a value being fetched again is served stale meanwhile
+	followerWait    time.Duration    // how long a caller waits on the call of another one, zero for no limit
+	sliding         bool             // whether a hit restarts the lifetime of the entry
+	expiryBeta      float64          // weight of the fetch time in the chances to expire early, see expiresEarly
+	random          func() float64   // draws the chances to expire early
+	sequential      bool             // whether batches look up the keys in the calling goroutine, see getChunk
+	returnEarly     bool             // whether GetMany returns on the first error without waiting, see getChunk
+	retries         int              // how many times a failed fetcher call is retried
+	backoff         time.Duration    // how long to wait before the first retry, doubled for every next one
+	retryable       func(error) bool // nil when every error is retried
+	errorResults    ErrorResults     // what GetMany returns along with an error, see WithErrorResults
+	breaker         *breaker         // nil when there is no circuit breaker
+	batchWindow     time.Duration
+	pending         *batch[K, V] // the batch collecting keys, nil when there is none
+	settings        atomic.Pointer[settings]
+	versions        atomic.Uint64 // the version of the last entry stored
+	tags            tagIndex[K]
+	tagResolver     func(key K) []string // tags every value stored without tags, nil when there is none
+	shards          []*shard[K, V]
+	seed            maphash.Seed
+	policy          EvictionPolicy[K] // chooses the keys to evict, only told about them when bounded
+	count           int               // keys cached when bounded, guarded by the cache-wide lock
+	pinned          map[K]struct{}    // keys the policy is not told about, guarded by the cache-wide lock, see Pin
+	admission       *frequencySketch  // how often keys were used, nil when every new key is admitted
+	pressure        func() bool       // tells the sweeper to shed keys, nil when there is no memory pressure hook
+	shedFraction    float64           // how many of the keys are shed under memory pressure
+	counters        counters
+	metrics         MetricsCollector
+	logger          *slog.Logger
+	latencies       latencies
+	events          events[K]
+	defaultValue    func(key K) (V, bool) // the value to serve when the fetcher fails, if there is one
+	secondary       SecondaryCache[K, V]
+	lock            DistributedLock[K]         // nil when only the calls of this cache are shared
+	lockPoll        time.Duration              // how often the secondary cache is checked while the lock is taken
+	validate        func(key K, value V) error // rejects fetched values, nil when they are all accepted
+	transform       func(key K, value V) V     // changes fetched values before they are validated and cached
+	related         func(key K) []K            // keys warmed in the background when the key is missed
+	refresher       Fetcher[K, V]              // called by the background refreshes instead, nil for the fetcher
+	negativeTTL     func(error) time.Duration  // how long every error is cached, nil for the negative TTL setting
+	resolveKey      func(key K) (K, error)     // nil when keys are used normalized, see WithKeyResolver
+	resolved        sync.Map                   // keys resolved by resolveKey, by the key normalized
+	onEvict         func(key K, value V)
+	onAutoSaveError func(err error)
+	done            chan struct{}  // closed by Close
+	background      sync.WaitGroup // goroutines Close waits for
+	mutex           sync.RWMutex
+}
+
+// settings are the ones that can change while the cache is in use
+// They are replaced as a whole, so they can be read without taking any lock
+type settings struct {
+	maxAge           time.Duration
+	refreshThreshold time.Duration
+	negativeTTL      time.Duration
+	concurrency      int
+	clock            Clock
+}
+
+// DefaultConcurrency is how many keys GetMany looks up at the same time unless SetConcurrency says otherwise
+const DefaultConcurrency = 16
+
+// NewCache creates a cache for the values of the fetcher
+func NewCache[K comparable, V any](fetcher Fetcher[K, V], maxAge time.Duration) *Cache[K, V] {
+	return NewBoundedCache(fetcher, maxAge, 0)
+}
+
+// NewBoundedCache creates a cache holding at most maxEntries keys, zero meaning unbounded
+func NewBoundedCache[K comparable, V any](fetcher Fetcher[K, V], maxAge time.Duration, maxEntries int) *Cache[K, V] {
+	return NewCacheWith(fetcher, WithMaxAge(maxAge), WithMaxEntries(maxEntries))
+}
+
+// NewCacheWith creates a cache for the values of the fetcher configured by the given options, see Option for the
+// defaults
+func NewCacheWith[K comparable, V any](fetcher Fetcher[K, V], opts ...Option) *Cache[K, V] {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c := &Cache[K, V]{
+		maxEntries:   cfg.maxEntries,
+		expiryJitter: cfg.expiryJitter,
+		expiryBeta:   cfg.expiryBeta,
+		random:       rand.Float64,
+		failWhenBusy: cfg.failWhenBusy,
+		staleIfError: cfg.staleIfError,
+		maxStaleness: cfg.maxStaleness,
+		compress:     cfg.gzipSnapshots,
+		resetOnLoad:  cfg.resetStatsOnLoad,
+		lastGood:     cfg.lastGood,
+		staleRefetch: cfg.staleRefetch,
+		followerWait: cfg.singleFlightWait,
+		sliding:      cfg.slidingExpiry,
+		sequential:   cfg.sequentialBatch,
+		returnEarly:  cfg.failFast,
+		retries:      cfg.retryAttempts - 1,
+		backoff:      cfg.retryBackoff,
+		retryable:    cfg.retryable,
+		negativeTTL:  cfg.negativeTTLFor,
+		errorResults: cfg.errorResults,
+		breaker:      newBreaker(cfg.breakerThreshold, cfg.breakerCooldown),
+		limiter:      newLimiter(cfg.rateLimit),
+		pressure:     cfg.pressure,
+		shedFraction: cfg.shedFraction,
+		metrics:      cfg.metrics,
+		logger:       cfg.logger,
+		shards:       newShards[K, V](shardCount, cfg.initialCapacity),
+		seed:         maphash.MakeSeed(),
+		policy:       NewLRUPolicy[K](),
+		done:         make(chan struct{}),
+	}
+	c.settings.Store(&settings{
+		maxAge:           cfg.maxAge,
+		refreshThreshold: cfg.refreshThreshold,
+		negativeTTL:      cfg.negativeTTL,
+		concurrency:      cfg.concurrency,
+		clock:            cfg.clock,
+	})
+	if cfg.copyOnWrite {
+		for _, sh := range c.shards {
+			sh.cow = true
+			sh.view.Store(&shardView[K, V]{})
+		}
+	}
+	c.batchWindow = cfg.batchWindow
+	c.upstream.Store(c.newUpstream(fetcher))
+	if lock, ok := cfg.lock.(DistributedLock[K]); ok {
+		c.lock = lock
+		c.lockPoll = cfg.lockPoll
+		if c.lockPoll <= 0 {
+			c.lockPoll = DefaultLockPoll
+		}
+	}
+	if newPolicy, ok := cfg.policy.(func() EvictionPolicy[K]); ok {
+		c.policy = newPolicy()
+	}
+	if size, ok := cfg.size.(func(V) int); ok && cfg.maxBytes > 0 {
+		c.maxBytes = cfg.maxBytes
+		c.size = size
+	}
+	if normalize, ok := cfg.normalizeKey.(func(K) K); ok {
+		c.normalize = normalize
+	}
+	if resolve, ok := cfg.keyResolver.(func(K) (K, error)); ok {
+		c.resolveKey = resolve
+	}
+	if resolver, ok := cfg.tagResolver.(func(K) []string); ok {
+		c.tagResolver = resolver
+	}
+	if key, ok := cfg.probeKey.(K); ok {
+		c.probeKey, c.probe = key, true
+	}
+	if cfg.admission && c.bounded() {
+		c.admission = newFrequencySketch(c.maxEntries)
+	}
+	if cfg.maxInFlight > 0 {
+		c.slots = make(chan struct{}, cfg.maxInFlight)
+	}
+	for _, hook := range cfg.hooks {
+		if hook, ok := hook.(func(*Cache[K, V])); ok {
+			hook(c)
+		}
+	}
+	if cfg.sweepInterval > 0 {
+		c.StartSweeper(cfg.sweepInterval)
+	}
+	return c
+}
+
+// MaxAge returns how old a cached value can be, unless its key has its own TTL
+func (c *Cache[K, V]) MaxAge() time.Duration {
+	return c.settings.Load().maxAge
+}
+
+// SetMaxAge changes how old a cached value can be, taking effect right away for the values already cached too
+// Zero disables caching, see Cache, and a negative one is taken as zero
+func (c *Cache[K, V]) SetMaxAge(maxAge time.Duration) {
+	c.update(func(s *settings) { s.maxAge = max(maxAge, 0) })
+}
+
+// SetRefreshThreshold enables refresh-ahead: a value served within threshold of expiring is refreshed in the
+// background, so callers keep getting the cached value instead of waiting on the fetcher once it expires
+// Zero disables it
+func (c *Cache[K, V]) SetRefreshThreshold(threshold time.Duration) {
+	c.update(func(s *settings) { s.refreshThreshold = threshold })
+}
+
+// SetNegativeTTL enables negative caching: a failure from the fetcher is remembered for ttl, so asking again for
+// the same key returns the same error without calling the fetcher
+// Zero disables it. It has no effect on a cache built WithNegativeTTLFunc
+func (c *Cache[K, V]) SetNegativeTTL(ttl time.Duration) {
+	c.update(func(s *settings) { s.negativeTTL = ttl })
+}
+
+// SetConcurrency sets how many keys GetMany looks up at the same time, values lower than one are ignored
+func (c *Cache[K, V]) SetConcurrency(n int) {
+	if n < 1 {
+		return
+	}
+	c.update(func(s *settings) { s.concurrency = n })
+}
+
+// SetClock replaces the system time used to tell how old the cached values are, mostly useful for tests
+func (c *Cache[K, V]) SetClock(clock Clock) {
+	c.update(func(s *settings) { s.clock = clock })
+}
+
+// update replaces the settings with a copy changed by fn
+func (c *Cache[K, V]) update(fn func(s *settings)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s := *c.settings.Load()
+	fn(&s)
+	c.settings.Store(&s)
+}
+
+// SetFetcher replaces the fetcher of the cache, keeping its cached values: the calls in-flight finish with the
+// fetcher they started with, the keys batched so far included, and the next misses call the new one
+// A nil fetcher is ignored
+func (c *Cache[K, V]) SetFetcher(fetcher Fetcher[K, V]) {
+	if fetcher == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.upstream.Store(c.newUpstream(fetcher))
+	c.pending = nil // the keys missed from now on go to a batch of the new fetcher
+}
+
+// upstream is the fetcher of the cache, along with its batch calls when misses are batched, see SetFetcher
+type upstream[K comparable, V any] struct {
+	fetcher Fetcher[K, V]
+	batcher BatchFetcher[K, V] // set when misses are fetched in batches
+}
+
+// newUpstream returns the upstream of fetcher, batching its calls when it is a BatchFetcher and batches are enabled
+func (c *Cache[K, V]) newUpstream(fetcher Fetcher[K, V]) *upstream[K, V] {
+	up := &upstream[K, V]{fetcher: fetcher}
+	if batcher, ok := fetcher.(BatchFetcher[K, V]); ok && c.batchWindow > 0 {
+		up.batcher = batcher
+	}
+	return up
+}
+
+// SetTTL sets how old the cached value for the key can be, taking precedence over "maxAge" for that key only
+// Keys without a TTL keep using "maxAge"
+func (c *Cache[K, V]) SetTTL(key K, ttl time.Duration) {
+	key = c.key(key)
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	sh.ttls[key] = ttl
+	sh.changed()
+	sh.unlock()
+}
+
+// Get gets the value for the key, either from the cache or the fetcher if it was not cached or too old
+func (c *Cache[K, V]) Get(key K) (V, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but stops waiting on the fetcher once ctx is done, returning ctx.Err()
+// A ContextFetcher started by this lookup is given ctx, so it can stop fetching too. Any other fetcher cannot be
+// interrupted: the caller just stops waiting, while the fetch finishes in the background and its result is cached
+// A ctx already done gets ctx.Err() right away, even for a key cached
+func (c *Cache[K, V]) GetContext(ctx context.Context, key K) (V, error) {
+	value, _, err := c.get(ctx, key, nil)
+	return value, err
+}
+
+// GetOrCompute is like Get but on a miss the value is computed by compute instead of the fetcher, and cached under
+// the same rules. Concurrent misses for the key still share a single call, whether to compute or the fetcher
+// compute is called as is, without the retries, circuit breaker nor in-flight limit of the fetcher
+func (c *Cache[K, V]) GetOrCompute(key K, compute func() (V, error)) (V, error) {
+	value, _, err := c.get(context.Background(), key, compute)
+	return value, err
+}
+
+// GetWithSource is like Get but also reports whether the value was served from the cache, which is only true when
+// a fresh cached value was returned without calling the fetcher
+func (c *Cache[K, V]) GetWithSource(key K) (value V, fromCache bool, err error) {
+	value, src, err := c.get(context.Background(), key, nil)
+	return value, src == sourceCache, err
+}
+
+// GetWithStale is like Get but also reports whether the value is an expired one, served because the fetcher failed
+// and stale values are allowed, see WithStaleIfError, or because it was being fetched again, see
+// WithServeStaleWhileRefreshing
+func (c *Cache[K, V]) GetWithStale(key K) (value V, stale bool, err error) {
+	value, src, err := c.get(context.Background(), key, nil)
+	return value, src == sourceStale, err
+}
+
+// GetWithTime is like Get but also returns when the value was fetched, which is when it was stored for a cached
+// value, telling how old it is. It is zero for a value that was not cached, like a default one
+func (c *Cache[K, V]) GetWithTime(key K) (value V, createdAt time.Time, err error) {
+	value, _, err = c.get(context.WithValue(context.Background(), createdTime{}, &createdAt), key, nil)
+	return value, createdAt, err
+}
+
+// createdTime is the context key of where get sets when the value it returns was fetched, see GetWithTime
+type createdTime struct{}
+
+// setCreated sets the time the value looked up with ctx was fetched at, when ctx asks for it
+func setCreated(ctx context.Context, created time.Time) {
+	if at, ok := ctx.Value(createdTime{}).(*time.Time); ok {
+		*at = created
+	}
+}
+
+// source tells where a looked up value came from
+type source int
+
+const (
+	sourceFetcher source = iota
+	sourceCache          // a fresh cached value
+	sourceStale          // an expired cached value, served because the fetcher failed or while it is fetched again
+	sourceDefault        // the default value, served because the fetcher failed and there was no stale one
+)
+
+// get looks the key up in the cache, falling back to compute on a miss, or the fetcher when it is nil
+func (c *Cache[K, V]) get(ctx context.Context, key K, compute func() (V, error)) (V, source, error) {
+	key, err := c.resolve(key)
+	if c.isClosed() {
+		var zero V
+		return zero, sourceFetcher, ErrClosed
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		var zero V
+		return zero, sourceFetcher, err
+	}
+	if c.disabled() {
+		atomic.AddInt64(&c.counters.misses, 1)
+		c.metrics.IncMiss()
+		value, _, err := c.obtain(ctx, key, compute)
+		if err == nil {
+			setCreated(ctx, c.now())
+		}
+		return value, sourceFetcher, err
+	}
+	now := c.lookupTime(ctx)
+	e, fresh, refresh := c.cached(key, now)
+	if fresh {
+		c.hit(key, e, refresh)
+		if e.Err == nil {
+			setCreated(ctx, e.CreatedAt)
+		}
+		return e.Value, sourceCache, e.Err
+	}
+	c.missed(key, e, now)
+
+	for {
+		value, src, err, retry := c.share(ctx, key, e, now, compute)
+		if !retry {
+			return value, src, err
+		}
+	}
+}
+
+// share joins the fetcher call for the key, running it when there is none going on, and waits for its outcome
+// It reports retry when the call was run by another lookup that was canceled or timed out while this one was not, so
+// its outcome says nothing about the key and a new call has to be run, see call.gaveUp
+func (c *Cache[K, V]) share(ctx context.Context, key K, e entry[V], now time.Time,
+	compute func() (V, error)) (value V, src source, err error, retry bool) {
+	cl, leader := c.join(key)
+	if leader {
+		c.warmRelated(ctx, key)
+		if ctx.Done() == nil {
+			c.run(ctx, key, cl, compute)
+		} else if !c.spawn(func() { c.run(ctx, key, cl, compute) }) {
+			c.run(ctx, key, cl, compute)
+		}
+		// otherwise the call keeps going in the background for the rest of the callers, even if this one gives up
+	} else if value, ok := c.staleWhileFetched(ctx, e, now); ok {
+		return value, sourceStale, nil, false
+	}
+
+	var timeout <-chan time.Time
+	if !leader && c.followerWait > 0 {
+		timer := time.NewTimer(c.followerWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		var zero V
+		return zero, sourceFetcher, ctx.Err(), false
+	case <-timeout:
+		// given up like a failing call, so a fallback value is served if there is one
+		if value, src, ok := c.fallback(key); ok && ctx.Value(strictLookup{}) == nil {
+			return value, src, nil, false
+		}
+		var zero V
+		return zero, sourceFetcher, ErrFetchTimeout, false
+	case <-cl.done:
+		if !leader && cl.gaveUp && ctx.Err() == nil {
+			var zero V
+			return zero, sourceFetcher, nil, true
+		}
+		if cl.failure != nil && ctx.Value(strictLookup{}) != nil {
+			var zero V
+			return zero, sourceFetcher, cl.failure, false
+		}
+		setCreated(ctx, cl.created)
+		return cl.value, cl.source, cl.err, false
+	}
+}
+
+// missed accounts for the key missed at now, along with the entry cached for it if it had one, too old to be served
+func (c *Cache[K, V]) missed(key K, e entry[V], now time.Time) {
+	atomic.AddInt64(&c.counters.misses, 1)
+	c.metrics.IncMiss()
+	c.emit(EventMiss, key)
+	c.logMiss(key, e, now)
+}
+
+// hit accounts for the fresh entry served for the key, refreshing it ahead of time when told to
+func (c *Cache[K, V]) hit(key K, e entry[V], refresh bool) {
+	atomic.AddInt64(&c.counters.hits, 1)
+	c.metrics.IncHit()
+	c.emit(EventHit, key)
+	c.touch(key)
+	if c.sliding {
+		c.slide(key, e)
+	}
+	if refresh {
+		c.refreshAhead(key)
+	}
+}
+
+// Refresh fetches the value for the key right away, even if the cached one is still fresh, caching and returning it
+// Unlike Invalidate it waits for the new value instead of leaving it for the next lookup
+func (c *Cache[K, V]) Refresh(key K) (V, error) {
+	if c.isClosed() {
+		var zero V
+		return zero, ErrClosed
+	}
+	return c.fetch(context.Background(), c.key(key), nil)
+}
+
+// GetRefreshing is like Get but, when the cached value expires within threshold, it fetches a new one right away and
+// returns it instead, so the value keeps being fresh for the next lookups. Unlike refresh-ahead the caller waits for
+// the new value, and gets the fetcher error if it fails. Concurrent callers share a single fetcher call
+func (c *Cache[K, V]) GetRefreshing(key K, threshold time.Duration) (V, error) {
+	if remaining, ok := c.TTL(key); !ok || remaining >= threshold {
+		return c.Get(key)
+	}
+	return c.reload(c.key(key))
+}
+
+// GetMaxAge is like Get but takes the cached value as fresh only while it is younger than maxAge, instead of its own
+// lifetime, which is left as is: a longer maxAge serves values already expired as long as they are still cached, and
+// a shorter one fetches values still fresh. The value fetched is stored as usual
+func (c *Cache[K, V]) GetMaxAge(key K, maxAge time.Duration) (V, error) {
+	key = c.key(key)
+	if c.isClosed() {
+		var zero V
+		return zero, ErrClosed
+	}
+	now := c.now()
+	e, ok := c.peek(key)
+	if ok && e.Err == nil && !c.disabled() && now.Sub(e.CreatedAt) < maxAge && !c.skewed(key, e) {
+		c.hit(key, e, false)
+		return e.Value, nil
+	}
+	c.missed(key, e, now)
+	return c.reload(key)
+}
+
+// reload fetches the value for the key, normalized, whether the cached one is fresh or not, joining the call already
+// in-flight for it if there is one
+func (c *Cache[K, V]) reload(key K) (V, error) {
+	cl, leader := c.join(key)
+	if leader {
+		c.run(context.Background(), key, cl, nil)
+	}
+	<-cl.done
+	return cl.value, cl.err
+}
+
+// key returns the key normalized and resolved, see resolve, or just normalized if it fails to resolve
+func (c *Cache[K, V]) key(key K) K {
+	key, _ = c.resolve(key)
+	return key
+}
+
+// resolve returns the key normalized and then resolved, see WithKeyNormalizer and WithKeyResolver, or normalized
+// along with the error when it fails to resolve
+func (c *Cache[K, V]) resolve(key K) (K, error) {
+	key = c.normalized(key)
+	if c.resolveKey == nil {
+		return key, nil
+	}
+	if resolved, ok := c.resolved.Load(key); ok {
+		return resolved.(K), nil
+	}
+	resolved, err := c.resolveKey(key)
+	if err != nil {
+		return key, err
+	}
+	c.resolved.Store(key, resolved)
+	return resolved, nil
+}
+
+// normalized returns the key normalized, see WithKeyNormalizer
+func (c *Cache[K, V]) normalized(key K) K {
+	if c.normalize == nil {
+		return key
+	}
+	return c.normalize(key)
+}
+
+// disabled reports whether caching is disabled by a "maxAge" of zero or less
+func (c *Cache[K, V]) disabled() bool {
+	return c.settings.Load().maxAge <= 0
+}
+
+// Set stores the value for the key as if it had just been fetched, without calling the fetcher
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.set(c.key(key), value)
+}
+
+// set is Set for a key already normalized and resolved
+func (c *Cache[K, V]) set(key K, value V) {
+	c.store(key, entry[V]{Value: value, CreatedAt: c.now(), Jitter: c.jitter()})
+}
+
+// SetMany stores every value as if they had just been fetched together, like Set but taking the cache-wide lock only
+// once, for seeding the cache with values loaded from elsewhere. Keys are evicted as usual if they do not fit
+func (c *Cache[K, V]) SetMany(values map[K]V) {
+	if c.disabled() {
+		return
+	}
+	now := c.now()
+	entries := make(map[K]entry[V], len(values))
+	for key, value := range values {
+		key = c.key(key)
+		e := entry[V]{Value: value, CreatedAt: now, Jitter: c.jitter()}
+		if c.tagResolver != nil {
+			e.Tags = c.tagResolver(key)
+		}
+		if c.size != nil {
+			e.Size = c.size(e.Value)
+		}
+		entries[key] = e
+	}
+	var removed []keyValue[K, V]
+	c.mutex.Lock()
+	for key, e := range entries {
+		var stored bool
+		if removed, stored = c.storeLocked(key, e, anyVersion, removed); !stored {
+			delete(entries, key)
+		}
+		removed = c.evictLocked(removed)
+	}
+	c.mutex.Unlock()
+	for key, e := range entries {
+		c.inserted(key, e)
+	}
+	c.evicted(removed)
+}
+
+// Update writes the value for the key through the fetcher, caching it only once the write succeeded
+// The fetcher must be a Writer, otherwise ErrReadOnly is returned
+func (c *Cache[K, V]) Update(key K, value V) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	writer, ok := c.upstream.Load().fetcher.(Writer[K, V])
+	if !ok {
+		return ErrReadOnly
+	}
+	key = c.key(key)
+	if err := writer.Write(key, value); err != nil {
+		return err
+	}
+	c.set(key, value)
+	return nil
+}
+
+// join returns the in-flight call for the key, creating one if there is none
+// The caller creating the call is the leader and must run it
+func (c *Cache[K, V]) join(key K) (cl *call[V], leader bool) {
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if cl, ok := sh.inflight[key]; ok {
+		return cl, false
+	}
+	cl = &call[V]{done: make(chan struct{})}
+	sh.inflight[key] = cl
+	return cl, true
+}
+
+// run fetches the value for the call and releases every caller waiting on it
+// Retries stop once ctx is done, so it is the context of the caller that started the call
+// The secondary cache, if any, is asked before fetching
+func (c *Cache[K, V]) run(ctx context.Context, key K, cl *call[V], compute func() (V, error)) {
+	var ok bool
+	if cl.value, ok = c.promote(key); !ok {
+		cl.value, cl.err = c.locked(ctx, key, compute)
+	}
+	if cl.err != nil {
+		if value, src, ok := c.fallback(key); ok {
+			cl.value, cl.source, cl.failure, cl.err = value, src, cl.err, nil
+		}
+	}
+	cl.gaveUp = cl.err != nil && gaveUp(ctx, cl.err)
+	// the value is the one cached, unless it was stored again meanwhile, whether fetched, promoted or stale, but a
+	// default value was never cached, even if an expired one still is
+	cachedValue := cl.source == sourceFetcher || cl.source == sourceStale
+	if e, ok := c.peek(key); ok && cachedValue && cl.err == nil && e.Err == nil {
+		cl.created = e.CreatedAt
+	}
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	delete(sh.inflight, key)
+	sh.mutex.Unlock()
+	close(cl.done)
+}
+
+// cached returns the cached entry for the key and whether it is not too old at now
+// refresh reports that the value is close enough to expire that it should be refreshed ahead of time, or that it
+// expires early, see expiresEarly
+func (c *Cache[K, V]) cached(key K, now time.Time) (e entry[V], fresh bool, refresh bool) {
+	s := c.settings.Load()
+	sh := c.shardFor(key)
+	// a shard copied on write is read from its view, without taking its lock, see WithCopyOnWriteReads
+	view := sh.view.Load()
+	if view == nil {
+		sh.mutex.RLock()
+		defer sh.mutex.RUnlock()
+		view = &shardView[K, V]{entries: sh.entries, ttls: sh.ttls}
+	}
+	entries, ttls := view.entries, view.ttls
+	e, ok := entries[key]
+	if !ok {
+		return e, false, false
+	}
+	age := now.Sub(e.CreatedAt)
+	if age < 0 {
+		if c.skewed(key, e) {
+			return e, false, false
+		}
+		age = 0
+	}
+	lifetime := c.lifetimeWith(ttls, key, e)
+	if e.Err != nil {
+		return e, age < lifetime, false
+	}
+	refresh = s.refreshThreshold > 0 && age >= lifetime-s.refreshThreshold
+	return e, age < lifetime, refresh || age < lifetime && c.expiresEarly(e, age, lifetime)
+}
+
+// expiresEarly reports whether the entry, age old out of its lifetime, is refreshed ahead of time by XFetch: it is
+// when its age plus its fetch time weighted by beta and by the log of a random number reaches its lifetime
+func (c *Cache[K, V]) expiresEarly(e entry[V], age time.Duration, lifetime time.Duration) bool {
+	if c.expiryBeta <= 0 || e.Took <= 0 {
+		return false
+	}
+	early := -float64(e.Took) * c.expiryBeta * math.Log(c.random())
+	return float64(age)+early >= float64(lifetime)
+}
+
+// fresh reports whether the entry for the key is not too old at now, see skewed
+func (c *Cache[K, V]) fresh(key K, e entry[V], now time.Time) bool {
+	age := now.Sub(e.CreatedAt)
+	if age < 0 {
+		return !c.skewed(key, e)
+	}
+	return age < c.lifetime(key, e)
+}
+
+// skewed reports whether the entry for the key was created after the current time, which only happens when the
+// clock went back, like when corrected by NTP. Its age cannot be trusted, it would be served for longer than its
+// lifetime, so it is taken as expired. Entries created after the time keys are looked up as of, but not after the
+// current time, were just stored during the lookup, see lookupTime
+func (c *Cache[K, V]) skewed(key K, e entry[V]) bool {
+	now := c.now()
+	if !e.CreatedAt.After(now) {
+		return false
+	}
+	c.logSkew(key, e, now)
+	return true
+}
+
+// peek returns the cached entry for the key, whether it is fresh or not
+func (c *Cache[K, V]) peek(key K) (entry[V], bool) {
+	sh := c.shardFor(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	e, ok := sh.entries[key]
+	return e, ok
+}
+
+// lifetime returns how old the entry for the key can be before it expires, the caller must hold the key shard lock
+func (c *Cache[K, V]) lifetime(key K, e entry[V]) time.Duration {
+	return c.lifetimeWith(c.shardFor(key).ttls, key, e)
+}
+
+// lifetimeWith is lifetime with the TTLs set for the keys of the shard given, the ones of its view when read without
+// the lock
+func (c *Cache[K, V]) lifetimeWith(ttls map[K]time.Duration, key K, e entry[V]) time.Duration {
+	if e.Err != nil {
+		if e.TTL > 0 {
+			return e.TTL
+		}
+		return c.settings.Load().negativeTTL
+	}
+	lifetime := c.settings.Load().maxAge
+	if e.TTL > 0 {
+		lifetime = e.TTL
+	}
+	if ttl, ok := ttls[key]; ok {
+		lifetime = ttl
+	}
+	return lifetime + time.Duration(float64(lifetime)*e.Jitter)
+}
+
+// refreshAhead fetches the value for the key in the background, unless a call for it is already in-flight
+func (c *Cache[K, V]) refreshAhead(key K) {
+	c.spawn(func() {
+		if cl, leader := c.join(key); leader {
+			previous, _ := c.peek(key)
+			c.run(c.refreshContext(), key, cl, nil)
+			c.logRefresh(key, previous, cl)
+		}
+	})
+}
+
+// ticker returns the ticks every interval of the cache clock if it is a TickerClock, or else of the system time, and
+// the function stopping them
+func (c *Cache[K, V]) ticker(interval time.Duration) (<-chan time.Time, func()) {
+	if clock, ok := c.settings.Load().clock.(TickerClock); ok {
+		return clock.NewTicker(interval)
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// spawn runs fn in a background goroutine that Close waits for, unless the cache is already closed
+func (c *Cache[K, V]) spawn(fn func()) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		fn()
+	}()
+	return true
+}
+
+func (c *Cache[K, V]) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the cache, waiting for its background goroutines to finish
+// Any call made to the cache afterwards returns ErrClosed, closing it again does nothing
+func (c *Cache[K, V]) Close() {
+	c.mutex.Lock()
+	if c.isClosed() {
+		c.mutex.Unlock()
+		return
+	}
+	close(c.done)
+	c.mutex.Unlock()
+	c.background.Wait()
+}
+
+// fetch gets the value from compute, or the fetcher when it is nil, and stores it in the cache and the secondary one
+// Errors are only stored when negative caching is enabled
+// The result is only stored if no other one was stored for the key meanwhile, so a slow fetch does not overwrite a
+// newer value with an older one, and of the fetches going on at the same time for a key, the first one to complete is
+// kept, without the later ones extending its lifetime
+func (c *Cache[K, V]) fetch(ctx context.Context, key K, compute func() (V, error)) (V, error) {
+	since := c.version(key)
+	var start time.Time
+	if c.expiryBeta > 0 {
+		start = c.now()
+	}
+	value, ttl, err := c.obtain(ctx, key, compute)
+	if err == nil && c.validate != nil {
+		err = c.validate(key, value)
+	}
+	if err != nil {
+		e := entry[V]{Err: err, CreatedAt: c.now()}
+		negativeTTL := c.settings.Load().negativeTTL
+		if c.negativeTTL != nil {
+			negativeTTL = c.negativeTTL(err)
+			e.TTL = negativeTTL
+		}
+		_, keepStale := c.stale(key)
+		// being busy, short-circuited or given up on says nothing about the key, so it is not worth remembering, and
+		// neither is an error that would replace a stale value still worth serving
+		if negativeTTL > 0 && !keepStale && !busy(err) && !gaveUp(ctx, err) {
+			c.storeSince(key, e, since)
+		}
+		var zero V
+		return zero, err
+	}
+	e := entry[V]{Value: value, CreatedAt: c.now(), Jitter: c.jitter(), TTL: ttl}
+	if c.expiryBeta > 0 {
+		e.Took = e.CreatedAt.Sub(start)
+	}
+	c.storeSince(key, e, since)
+	if c.secondary != nil {
+		c.secondary.Set(key, value)
+	}
+	return value, nil
+}
+
+// busy reports whether err is about the fetcher not being called at the moment, rather than about the key
+func busy(err error) bool {
+	return errors.Is(err, ErrTooManyInFlight) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrCircuitOpen)
+}
+
+// gaveUp reports whether err is about the lookup with ctx being canceled or timing out, rather than about the key
+func gaveUp(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// obtain gets the value for the key from compute, or else from the fetcher, retrying it if it fails, see WithTransform
+// It also returns the TTL told by the fetcher, if it is a TTLFetcher
+func (c *Cache[K, V]) obtain(ctx context.Context, key K, compute func() (V, error)) (V, time.Duration, error) {
+	if compute != nil {
+		value, err := compute()
+		return value, 0, err
+	}
+	var ttl time.Duration
+	value, err := c.retry(ctx, func() (V, error) {
+		value, t, err := c.load(ctx, key)
+		ttl = t
+		return value, err
+	})
+	if err == nil && c.transform != nil {
+		value = c.transform(key, value)
+	}
+	return value, ttl, err
+}
+
+// jitter returns a random fraction within ±"expiryJitter", so keys stored together do not expire together
+func (c *Cache[K, V]) jitter() float64 {
+	if c.expiryJitter <= 0 {
+		return 0
+	}
+	return (rand.Float64()*2 - 1) * c.expiryJitter
+}
+
+// load calls the fetcher for the key unless the circuit breaker is open
+func (c *Cache[K, V]) load(ctx context.Context, key K) (V, time.Duration, error) {
+	if !c.breaker.allow(c.now()) {
+		var zero V
+		return zero, 0, ErrCircuitOpen
+	}
+	start := c.now()
+	value, ttl, err := c.invoke(ctx, key)
+	end := c.now()
+	c.metrics.ObserveFetchDuration(end.Sub(start))
+	c.latencies.observe(end.Sub(start))
+	c.logFetch(ctx, key, end.Sub(start), err)
+	c.countFailure(ctx, key, err)
+	// being busy, closed or given up on is not the fetcher failing
+	c.breaker.record(err, busy(err) || gaveUp(ctx, err) || errors.Is(err, ErrClosed), end)
+	return value, ttl, err
+}
+
+// invoke calls the fetcher for the key, waiting for the rate limit and then for a free slot when the calls in-flight
+// are limited
+// When batching, the key is fetched together with the other keys missed during the same batch window, unless it is
+// refreshed with the refresh fetcher, see WithRefreshFetcher
+// A panicking fetcher fails the call with ErrServicePanic instead of crashing, see recovered
+func (c *Cache[K, V]) invoke(ctx context.Context, key K) (value V, ttl time.Duration, err error) {
+	fetcher, batcher := c.fetcherFor(ctx)
+	if batcher != nil {
+		value, err = c.loadBatched(batcher, key)
+		return value, 0, err
+	}
+	if err := c.throttle(ctx); err != nil {
+		return value, 0, err
+	}
+	if !c.acquire() {
+		return value, 0, ErrTooManyInFlight
+	}
+	defer c.release()
+	defer recovered(&err)
+	switch fetcher := fetcher.(type) {
+	case TTLFetcher[K, V]:
+		return fetcher.FetchWithTTL(ctx, key)
+	case ContextFetcher[K, V]:
+		value, err = fetcher.FetchContext(ctx, key)
+	default:
+		value, err = fetcher.Fetch(key)
+	}
+	return value, 0, err
+}
+
+// recovered sets err to ErrServicePanic if the fetcher call it is deferred in panicked, it must be deferred directly
+func recovered(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w : %v", ErrServicePanic, r)
+	}
+}
+
+// acquire takes a slot for a fetcher call, waiting for one unless failing when busy, in which case it reports
+// whether it got one
+func (c *Cache[K, V]) acquire() bool {
+	if c.slots == nil {
+		return true
+	}
+	if !c.failWhenBusy {
+		c.slots <- struct{}{}
+		return true
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees the slot taken by acquire
+func (c *Cache[K, V]) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// now returns the current time according to the cache clock
+func (c *Cache[K, V]) now() time.Time {
+	return c.settings.Load().clock.Now()
+}
+
+// anyVersion makes storeSince store the entry whatever the version of the one cached
+const anyVersion uint64 = math.MaxUint64
+
+// version returns the version of the entry cached for the key, zero when there is none
+func (c *Cache[K, V]) version(key K) uint64 {
+	e, _ := c.peek(key)
+	return e.Version
+}
+
+// store saves the entry for the key, replacing the one cached if any, see storeSince
+func (c *Cache[K, V]) store(key K, e entry[V]) {
+	c.storeSince(key, e, anyVersion)
+}
+
+// storeSince saves the entry for the key, evicting keys if the cache is full, unless the
+// entry cached is newer than the version since, meaning another one was stored since then
+// Only the key shard is locked, unless the cache is bounded and the recency has to be kept too
+func (c *Cache[K, V]) storeSince(key K, e entry[V], since uint64) {
+	if c.disabled() {
+		return
+	}
+	if e.Tags == nil && e.Err == nil && c.tagResolver != nil {
+		e.Tags = c.tagResolver(key)
+	}
+	sh := c.shardFor(key)
+	if !c.bounded() {
+		sh.mutex.Lock()
+		stored := c.put(sh, key, e, since)
+		sh.unlock()
+		if stored {
+			c.inserted(key, e)
+		}
+		return
+	}
+
+	if c.size != nil && e.Err == nil {
+		e.Size = c.size(e.Value)
+	}
+	c.mutex.Lock()
+	removed, stored := c.storeLocked(key, e, since, nil)
+	if !stored {
+		c.mutex.Unlock()
+		return
+	}
+	removed = c.evictLocked(removed)
+	c.mutex.Unlock()
+	c.inserted(key, e)
+	c.evicted(removed)
+}
+
+// storeLocked is storeSince for a caller holding the cache-wide lock, appending the keys evicted to make room for
+// a new key to removed. The caller must still evict the keys making the cache full once done, see evictLocked
+// It reports whether the entry was stored, which a new key might not be when there is an admission policy
+func (c *Cache[K, V]) storeLocked(key K, e entry[V], since uint64, removed []keyValue[K, V]) ([]keyValue[K, V], bool) {
+	c.used(key)
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	previous, existed := sh.entries[key]
+	if (!existed && !c.admits(key, e)) || !c.put(sh, key, e, since) {
+		sh.unlock()
+		return removed, false
+	}
+	c.bytes += e.Size - previous.Size
+	sh.unlock()
+	if !c.bounded() {
+		return removed, true
+	}
+	if existed {
+		c.policy.RecordAccess(key)
+		return removed, true
+	}
+	// the room is made before telling the policy about the key, so it is not the one evicted for being the newest
+	c.count++
+	removed = c.evictLocked(removed)
+	if !c.isPinned(key) {
+		c.policy.RecordInsert(key)
+	}
+	return removed, true
+}
+
+// evictLocked evicts the keys chosen by the eviction policy until the cache is not full, the caller must hold the
+// cache-wide lock
+func (c *Cache[K, V]) evictLocked(removed []keyValue[K, V]) []keyValue[K, V] {
+	for c.full() {
+		key, ok := c.policy.Evict()
+		if !ok {
+			break
+		}
+		removed = c.remove(key, removed)
+		atomic.AddInt64(&c.counters.evictions, 1)
+	}
+	return removed
+}
+
+// put sets the entry for the key with a new version, remembering its value as the last good one if it has any
+// It reports false, leaving the entry cached as is, if it is newer than since, see storeSince
+// The caller must hold the key shard write lock
+func (c *Cache[K, V]) put(sh *shard[K, V], key K, e entry[V], since uint64) bool {
+	previous := sh.entries[key]
+	if previous.Version > since {
+		return false
+	}
+	e.Version = c.versions.Add(1)
+	if e.Tags == nil {
+		e.Tags = previous.Tags
+	}
+	c.tags.retag(key, previous.Tags, e.Tags)
+	sh.entries[key] = e
+	sh.changed()
+	if c.lastGood && e.Err == nil {
+		sh.lastGood[key] = e
+	}
+	return true
+}
+
+// bounded reports whether the cache has a limit, or sheds keys under memory pressure, and keeps the recency of its
+// keys
+func (c *Cache[K, V]) bounded() bool {
+	return c.maxEntries > 0 || c.maxBytes > 0 || c.pressure != nil
+}
+
+// full reports whether keys have to be evicted to respect the limits, the caller must hold the cache-wide lock
+// A value too big to fit on its own is evicted as well
+func (c *Cache[K, V]) full() bool {
+	if c.count == 0 {
+		return false
+	}
+	return (c.maxEntries > 0 && c.count > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+// inserted emits the insert event for a stored value, negatively cached errors are not reported
+func (c *Cache[K, V]) inserted(key K, e entry[V]) {
+	if e.Err == nil {
+		c.emit(EventInsert, key)
+	}
+}
+
+// keyValue is a removed key with its value, for the OnEvict callback
+type keyValue[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// remove deletes the key from the cache, the caller must hold the cache-wide write lock
+// The removed value is appended to removed, so the OnEvict callback can be told once the lock is released
+func (c *Cache[K, V]) remove(key K, removed []keyValue[K, V]) []keyValue[K, V] {
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.unlock()
+	return c.removeLocked(sh, key, removed)
+}
+
+// removeLocked is remove for a caller holding the key shard write lock too
+func (c *Cache[K, V]) removeLocked(sh *shard[K, V], key K, removed []keyValue[K, V]) []keyValue[K, V] {
+	delete(sh.lastGood, key)
+	return c.expireLocked(sh, key, removed)
+}
+
+// expireLocked is removeLocked but keeping the last good value for the key, for values removed because they expired
+func (c *Cache[K, V]) expireLocked(sh *shard[K, V], key K, removed []keyValue[K, V]) []keyValue[K, V] {
+	e, ok := sh.entries[key]
+	if !ok {
+		return removed
+	}
+	delete(sh.entries, key)
+	sh.changed()
+	if c.bounded() {
+		c.policy.RecordRemove(key)
+		c.count--
+	}
+	c.bytes -= e.Size
+	c.tags.retag(key, e.Tags, nil)
+	if e.Err != nil {
+		return removed
+	}
+	return append(removed, keyValue[K, V]{key: key, value: e.Value})
+}
+
+// OnEvict sets a callback called every time a value leaves the cache, whether it was evicted to make room for
+// new ones, invalidated or swept. Negatively cached errors are not reported
+// The callback is called without holding any lock, so it is safe for it to use the cache
+func (c *Cache[K, V]) OnEvict(fn func(key K, value V)) {
+	c.mutex.Lock()
+	c.onEvict = fn
+	c.mutex.Unlock()
+}
+
+// evicted emits the evict event and calls the OnEvict callback for every removed value
+// The caller must not hold the lock
+func (c *Cache[K, V]) evicted(removed []keyValue[K, V]) {
+	if len(removed) == 0 {
+		return
+	}
+	for _, kv := range removed {
+		c.emit(EventEvict, kv.key)
+		c.logEvict(kv.key)
+	}
+	c.mutex.RLock()
+	onEvict := c.onEvict
+	c.mutex.RUnlock()
+	if onEvict == nil {
+		return
+	}
+	for _, kv := range removed {
+		onEvict(kv.key, kv.value)
+	}
+}
+
+// Invalidate removes the key from the cache, so the next time it is asked for it is fetched again
+func (c *Cache[K, V]) Invalidate(key K) {
+	c.mutex.Lock()
+	removed := c.remove(c.key(key), nil)
+	c.mutex.Unlock()
+	c.evicted(removed)
+}
+
+// InvalidateAll removes every key from the cache
+func (c *Cache[K, V]) InvalidateAll() {
+	var removed []keyValue[K, V]
+	c.mutex.Lock()
+	for _, sh := range c.shards {
+		sh.mutex.Lock()
+		for key := range sh.entries {
+			removed = c.removeLocked(sh, key, removed)
+		}
+		clear(sh.lastGood) // including the ones of keys already swept
+		sh.unlock()
+	}
+	c.mutex.Unlock()
+	c.evicted(removed)
+}
+
+// InvalidateFunc removes every key match reports true for from the cache, returning how many were removed
+func (c *Cache[K, V]) InvalidateFunc(match func(key K) bool) int {
+	var removed []keyValue[K, V]
+	n := 0
+	c.mutex.Lock()
+	for _, sh := range c.shards {
+		sh.mutex.Lock()
+		for key := range sh.entries {
+			if match(key) {
+				removed = c.removeLocked(sh, key, removed)
+				n++
+			}
+		}
+		for key := range sh.lastGood {
+			if match(key) {
+				delete(sh.lastGood, key) // of a key already swept
+			}
+		}
+		sh.unlock()
+	}
+	c.mutex.Unlock()
+	c.evicted(removed)
+	return n
+}
+
+// EvictIf removes every cached value match reports true for from the cache, given its key, value and age, like the
+// prices above some threshold, returning how many were removed. The OnEvict callback is told about them as usual
+// match is called holding the locks of the cache, so it must not call back into it
+func (c *Cache[K, V]) EvictIf(match func(key K, value V, age time.Duration) bool) int {
+	var removed []keyValue[K, V]
+	now := c.now()
+	c.mutex.Lock()
+	for _, sh := range c.shards {
+		sh.mutex.Lock()
+		for key, e := range sh.entries {
+			if e.Err == nil && match(key, e.Value, max(now.Sub(e.CreatedAt), 0)) {
+				removed = c.removeLocked(sh, key, removed)
+			}
+		}
+		sh.unlock()
+	}
+	c.mutex.Unlock()
+	c.evicted(removed)
+	return len(removed)
+}
+
+// Len returns how many keys are currently cached, including the ones that expired but were not removed yet
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		n += len(sh.entries)
+		sh.mutex.RUnlock()
+	}
+	return n
+}
+
+// Keys returns a copy of the keys currently cached, each one once, in no particular order
+func (c *Cache[K, V]) Keys() []K {
+	keys := []K{}
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		for key := range sh.entries {
+			keys = append(keys, key)
+		}
+		sh.mutex.RUnlock()
+	}
+	return keys
+}
+
+// ForEach calls fn for every cached value with its age, expired ones included but not negatively cached errors, in no
+// particular order, until fn returns false
+// The values are not copied: every shard is read locked while fn goes through its values, so fn must not call back
+// into the cache or it may deadlock
+func (c *Cache[K, V]) ForEach(fn func(key K, value V, age time.Duration) bool) {
+	now := c.now()
+	for _, sh := range c.shards {
+		if !c.forEachIn(sh, now, fn) {
+			return
+		}
+	}
+}
+
+// forEachIn is ForEach for the values of a single shard, reporting whether fn wants to go on
+func (c *Cache[K, V]) forEachIn(sh *shard[K, V], now time.Time, fn func(key K, value V, age time.Duration) bool) bool {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	for key, e := range sh.entries {
+		if e.Err == nil && !fn(key, e.Value, now.Sub(e.CreatedAt)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns a copy of the fresh cached values, leaving out the expired ones and negatively cached errors
+// Every shard is locked while copying, so the copy is consistent with a single point in time
+// Being a map it has no order, so ranging over it twice may go through the keys differently: sort its keys, as
+// SortedKeys does, for a stable output
+func (c *Cache[K, V]) Snapshot() map[K]V {
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+	}
+	defer func() {
+		for _, sh := range c.shards {
+			sh.mutex.RUnlock()
+		}
+	}()
+	now := c.now()
+	values := map[K]V{}
+	for _, sh := range c.shards {
+		for key, e := range sh.entries {
+			if e.Err == nil && c.fresh(key, e, now) {
+				values[key] = e.Value
+			}
+		}
+	}
+	return values
+}
+
+// Peek returns the cached value for the key and true only if it is fresh, without ever calling the fetcher
+// Unlike Get it has no side effects: it is not counted in the stats, does not mark the key as recently used, nor
+// refresh it ahead of time
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	e, fresh, _ := c.cached(c.key(key), c.now())
+	if !fresh || e.Err != nil || c.disabled() {
+		var zero V
+		return zero, false
+	}
+	return e.Value, true
+}
+
+// AgeOf returns how long ago the cached value for the key was fetched, and whether there is one
+// It reports values that expired but were not removed yet too, but not negatively cached errors
+func (c *Cache[K, V]) AgeOf(key K) (time.Duration, bool) {
+	e, ok := c.peek(c.key(key))
+	if !ok || e.Err != nil {
+		return 0, false
+	}
+	return c.now().Sub(e.CreatedAt), true
+}
+
+// TTL returns how long until the cached value for the key expires, and whether there is one still fresh
+// It follows the TTL set for the key, if any, or the one told by a TTLFetcher, see lifetime
+func (c *Cache[K, V]) TTL(key K) (time.Duration, bool) {
+	key = c.key(key)
+	now := c.now()
+	sh := c.shardFor(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	e, ok := sh.entries[key]
+	if !ok || e.Err != nil || c.disabled() || !c.fresh(key, e, now) {
+		return 0, false
+	}
+	remaining := c.lifetime(key, e) - max(now.Sub(e.CreatedAt), 0)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// slide restarts the lifetime of the entry served for the key, unless it was replaced meanwhile
+func (c *Cache[K, V]) slide(key K, served entry[V]) {
+	now := c.now()
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.unlock()
+	if e, ok := sh.entries[key]; ok && e.CreatedAt.Equal(served.CreatedAt) {
+		e.CreatedAt = now
+		sh.entries[key] = e
+		sh.changed()
+	}
+}
+
+// touch tells the eviction policy the key was served
+func (c *Cache[K, V]) touch(key K) {
+	if !c.bounded() {
+		return
+	}
+	c.mutex.Lock()
+	c.policy.RecordAccess(key)
+	c.used(key)
+	c.mutex.Unlock()
+}
+
+// GetMany gets the values for several keys at once, some might be found in the cache, others might not
+// If any of the operations returns an error, it returns the first one in the order of the keys, along with the values
+// told by WithErrorResults
+// Values are returned in the same order as the given keys, no keys returning an empty slice and no error
+// At most "concurrency" keys are looked up at the same time, see SetConcurrency
+// A batch whose keys are all cached and fresh is served by the calling goroutine, without setting up any lookup
+func (c *Cache[K, V]) GetMany(keys ...K) ([]V, error) {
+	return c.GetManyContext(context.Background(), keys...)
+}
+
+// GetManyContext is like GetMany but every key stops waiting on the fetcher once ctx is done
+// A failing key cancels the lookups of the keys after it, whose values are not needed anymore, which a
+// ContextFetcher is told about too
+func (c *Cache[K, V]) GetManyContext(ctx context.Context, keys ...K) ([]V, error) {
+	results, failed, err := c.getMany(ctx, keys)
+	if err != nil {
+		return c.failedResults(results, failed), err
+	}
+	return results, nil
+}
+
+// getMany is GetManyContext returning the values of every key, with the zero value for the ones that failed or were
+// not looked up, along with the position of the first key failing, the number of keys when none did
+func (c *Cache[K, V]) getMany(ctx context.Context, keys []K) ([]V, int, error) {
+	if len(keys) == 0 {
+		return []V{}, 0, nil
+	}
+	if results, ok := c.cachedAll(ctx, keys); ok {
+		return results, len(keys), nil
+	}
+	results := make([]V, len(keys))
+	var err error
+	failed := len(keys)
+	c.getAll(ctx, keys, true, func(r response[K, V]) {
+		if r.Err != nil {
+			if err == nil {
+				err, failed = r.Err, r.Index
+			}
+			return
+		}
+		results[r.Index] = r.Value
+	})
+	return results, failed, err
+}
+
+// failedResults returns what GetMany returns along with an error for the values it got, with the zero value for the
+// keys that failed or were not looked up, when the first key failing is at position failed, see WithErrorResults
+func (c *Cache[K, V]) failedResults(results []V, failed int) []V {
+	switch c.errorResults {
+	case NoResults:
+		return nil
+	case ZeroFilledResults:
+		return results
+	default:
+		return results[:failed]
+	}
+}
+
+// GetAll is like GetMany but goes through every key even if some fail
+// Values are returned in the same order as the given keys, with the zero value for the ones that failed, and all the
+// errors joined
+func (c *Cache[K, V]) GetAll(keys ...K) ([]V, error) {
+	results := make([]V, len(keys))
+	errs := []error{}
+	c.getAll(context.Background(), keys, false, func(r response[K, V]) {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+			return
+		}
+		results[r.Index] = r.Value
+	})
+	return results, errors.Join(errs...)
+}
+
+// Result is the outcome of looking up a single key among several
+type Result[K comparable, V any] struct {
+	Key       K
+	Value     V
+	Err       error
+	FromCache bool // whether the value was a fresh cached one, see GetWithSource
+}
+
+// GetManyDetailed is like GetMany but reports the outcome of every key on its own, in the same order as the given
+// keys, so callers can use the values found even if others failed
+func (c *Cache[K, V]) GetManyDetailed(keys ...K) []Result[K, V] {
+	return c.GetManyDetailedContext(context.Background(), keys...)
+}
+
+// GetManyDetailedContext is like GetManyDetailed but every key stops waiting on the fetcher once ctx is done, getting
+// ctx.Err() while the keys done by then keep their outcome
+func (c *Cache[K, V]) GetManyDetailedContext(ctx context.Context, keys ...K) []Result[K, V] {
+	results := make([]Result[K, V], len(keys))
+	c.getAll(ctx, keys, false, func(r response[K, V]) {
+		results[r.Index] = Result[K, V]{Key: r.Key, Value: r.Value, Err: r.Err, FromCache: r.FromCache}
+	})
+	return results
+}
+
+// Stream looks up every key with a pool of "concurrency" workers like GetManyDetailedContext, but sends the outcome
+// of every key on the returned channel as soon as it is done rather than once they all are, in no particular order
+// The channel is closed once every key was sent, or once ctx is done, leaving out the keys not sent by then, so
+// callers have to either drain it or cancel ctx for the workers to stop
+func (c *Cache[K, V]) Stream(ctx context.Context, keys ...K) <-chan Result[K, V] {
+	results := make(chan Result[K, V])
+	ctx = context.WithValue(ctx, batchTime{}, c.now())
+	workers := min(c.settings.Load().concurrency, len(keys))
+	if c.sequential {
+		workers = min(1, len(keys))
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			n := int(atomic.AddInt64(&next, 1)) - 1
+			if n >= len(keys) {
+				return
+			}
+			value, src, err := c.get(ctx, keys[n], nil)
+			select {
+			case results <- Result[K, V]{Key: keys[n], Value: value, Err: err, FromCache: src == sourceCache}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// WarmUp fetches every key not already cached, so they are fresh before serving traffic
+// Unlike GetMany it goes through every key even if some fail, returning all the errors joined
+func (c *Cache[K, V]) WarmUp(keys ...K) error {
+	errs := []error{}
+	c.getAll(context.Background(), keys, false, func(r response[K, V]) {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// WarmUpContext fetches every key not already cached like WarmUp, with at most "concurrency" at the same time, telling
+// progress how many keys are done out of the total every time one is, if progress is not nil
+// It stops as soon as ctx is done, leaving the remaining keys unfetched and returning ctx.Err()
+func (c *Cache[K, V]) WarmUpContext(ctx context.Context, progress func(done, total int), keys ...K) error {
+	errs := []error{}
+	done := 0
+	for r := range c.Stream(ctx, keys...) {
+		done++
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+		if progress != nil {
+			progress(done, len(keys))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// RefreshExpiring fetches again every cached value expiring within threshold, or already expired but not removed
+// yet, so they are fresh ahead of a traffic peak. The values are fetched "concurrency" at a time, sharing the
+// fetcher calls going on for the same keys, and every failure is returned joined
+func (c *Cache[K, V]) RefreshExpiring(threshold time.Duration) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	now := c.now()
+	var keys []K
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		for key, e := range sh.entries {
+			if e.Err == nil && now.Sub(e.CreatedAt) > c.lifetime(key, e)-threshold {
+				keys = append(keys, key)
+			}
+		}
+		sh.mutex.RUnlock()
+	}
+
+	workers := min(c.settings.Load().concurrency, len(keys))
+	if c.sequential {
+		workers = min(1, len(keys))
+	}
+	errs := make([]error, len(keys))
+	var next int64
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		for {
+			n := int(atomic.AddInt64(&next, 1)) - 1
+			if n >= len(keys) {
+				return
+			}
+			_, errs[n] = c.reload(keys[n])
+		}
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// batchTime is the context key of the time a batch of lookups started, see lookupTime
+type batchTime struct{}
+
+// lookupTime returns the time to tell whether cached values are fresh at, which is the time the batch started for
+// the lookups of a batch, so all of them are checked against the same instant
+func (c *Cache[K, V]) lookupTime(ctx context.Context) time.Time {
+	if now, ok := ctx.Value(batchTime{}).(time.Time); ok {
+		return now
+	}
+	return c.now()
+}
+
+// cachedHit is a fresh entry found by cachedAll, along with whether it has to be refreshed ahead of time
+type cachedHit[V any] struct {
+	entry   entry[V]
+	refresh bool
+}
+
+// cachedAll returns the values for the keys when all of them are cached and fresh, none of them an error, checking
+// them against the same instant like getAll. Hits are only accounted when it reports true, one for every key, even
+// repeated ones, since none of them is looked up more than once anyway
+// Batches larger than a chunk are left to getAll, so it does not keep more entries than a chunk of them
+func (c *Cache[K, V]) cachedAll(ctx context.Context, keys []K) ([]V, bool) {
+	if ctx.Err() != nil || c.isClosed() || c.disabled() || len(keys) > batchChunkSize {
+		return nil, false
+	}
+	now := c.now()
+	hits := make([]cachedHit[V], len(keys))
+	for i, key := range keys {
+		e, fresh, refresh := c.cached(c.key(key), now)
+		if !fresh || e.Err != nil {
+			return nil, false
+		}
+		hits[i] = cachedHit[V]{entry: e, refresh: refresh}
+	}
+	values := make([]V, len(keys))
+	for i, hit := range hits {
+		c.hit(c.key(keys[i]), hit.entry, hit.refresh)
+		values[i] = hit.entry.Value
+	}
+	return values, true
+}
+
+// batchChunkSize is how many keys getAll looks up at a time, so the state it keeps to look them up stays the same
+// however many keys a batch has
+const batchChunkSize = 10000
+
+// getAll looks up every key, handing the response of every key to each in the same order, if each is not nil,
+// batchChunkSize keys at a time: the keys of a chunk are only looked up once the ones of the previous chunk are
+// done, see getChunk. Callers write the responses straight to what they return, so the state kept to look the keys
+// up is bounded by the chunk size however many keys there are
+// With failFast a failing key cancels the lookups of the keys after it, the chunks after it included, which are
+// not looked up at all and fail with context.Canceled
+// Every cached value is checked against the time the batch started, whatever its chunk, see lookupTime
+func (c *Cache[K, V]) getAll(ctx context.Context, keys []K, failFast bool, each func(r response[K, V])) {
+	if each == nil {
+		each = func(response[K, V]) {}
+	}
+	if len(keys) > batchChunkSize {
+		ctx = context.WithValue(ctx, batchTime{}, c.lookupTime(ctx))
+	}
+	failed := false
+	for start := 0; start < len(keys); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(keys))
+		if failed {
+			for i := start; i < end; i++ {
+				each(response[K, V]{Index: i, Key: keys[i], Err: context.Canceled})
+			}
+			continue
+		}
+		for _, r := range c.getChunk(ctx, keys[start:end], failFast) {
+			r.Index += start
+			each(r)
+			failed = failed || failFast && r.Err != nil
+		}
+	}
+}
+
+// getChunk looks up every key with a pool of "concurrency" workers, returning one response per key in the same
+// order
+// A key repeated among the keys is looked up once, its response copied to every position it was asked at
+// The fresh cached values are served right away, only the rest of the keys are handed to the workers
+// With failFast a failing key cancels the lookups of the keys after it, see failFast
+// WithSequentialBatch the missed keys are looked up one after the other by the calling goroutine instead
+// WithFailFast a failing key makes it return right away, without waiting for the lookups of the rest of the keys
+// Every cached value is checked against the time the batch started, see lookupTime
+// A ctx already done fails every key with ctx.Err(), even the ones cached
+func (c *Cache[K, V]) getChunk(ctx context.Context, keys []K, failFast bool) []response[K, V] {
+	if err := ctx.Err(); err != nil {
+		// a context already done fails every key right away, without looking them up nor starting any worker
+		responses := make([]response[K, V], len(keys))
+		for i, key := range keys {
+			responses[i] = response[K, V]{Index: i, Key: key, Err: err}
+		}
+		return responses
+	}
+	now := c.lookupTime(ctx)
+	ctx = context.WithValue(ctx, batchTime{}, now)
+	firsts := make(map[K]int, len(keys))
+	first := make([]int, len(keys)) // index of the first time the key at every index is asked for
+	unique := make([]int, 0, len(keys))
+	for i, key := range keys {
+		key = c.key(key)
+		f, ok := firsts[key]
+		if !ok {
+			f = i
+			firsts[key] = i
+			unique = append(unique, i)
+		}
+		first[i] = f
+	}
+
+	var ff *failFastGroup
+	if failFast {
+		ff = &failFastGroup{first: len(keys), cancels: map[int]context.CancelFunc{}}
+	}
+	responses := make([]response[K, V], len(keys))
+	deliver := func(r response[K, V]) {
+		if r.Err != nil {
+			ff.failed(r.Index)
+		}
+		responses[r.Index] = r
+	}
+	early := failFast && c.returnEarly
+	var mutex sync.Mutex // guards responses, delivered and returned when returning early
+	var delivered []bool // the positions delivered so far, when returning early
+	var returned bool    // set once returned early, so the workers still going on deliver nothing
+	var failure chan error
+	if early {
+		delivered = make([]bool, len(keys))
+		failure = make(chan error, 1) // the first error delivered
+		store := deliver
+		deliver = func(r response[K, V]) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if returned {
+				return
+			}
+			store(r)
+			delivered[r.Index] = true
+			if r.Err != nil {
+				select {
+				case failure <- r.Err:
+				default:
+				}
+			}
+		}
+	}
+	defer func() {
+		// the repeated keys get a copy of the response for the first time they were asked for
+		for i, f := range first {
+			if f != i {
+				r := responses[f]
+				r.Index = i
+				r.Key = keys[i]
+				responses[i] = r
+			}
+		}
+	}()
+
+	missed := unique
+	if !c.isClosed() && !c.disabled() {
+		missed = make([]int, 0, len(unique))
+		for _, i := range unique {
+			key := c.key(keys[i])
+			e, fresh, refresh := c.cached(key, now)
+			if !fresh {
+				missed = append(missed, i)
+				continue
+			}
+			c.hit(key, e, refresh)
+			deliver(response[K, V]{Index: i, Key: keys[i], Value: e.Value, Err: e.Err, FromCache: true})
+		}
+	}
+	if len(missed) == 0 {
+		return responses
+	}
+
+	if c.sequential {
+		// nothing is in-flight once a key fails, the keys after it are just not looked up, so no context to cancel
+		// the lookups with is needed either
+		for _, i := range missed {
+			if ff.skips(i) {
+				deliver(response[K, V]{Index: i, Key: keys[i], Err: context.Canceled})
+				continue
+			}
+			value, src, err := c.get(ctx, keys[i], nil)
+			deliver(response[K, V]{Index: i, Key: keys[i], Value: value, Err: err, FromCache: src == sourceCache})
+		}
+		return responses
+	}
+
+	workers := c.settings.Load().concurrency
+	if workers > len(missed) {
+		workers = len(missed)
+	}
+
+	// every worker takes the next missed key until there are none left, delivering its response right away: no two
+	// keys share a position, so the workers never write to the same responses
+	var next int64
+	var wg sync.WaitGroup
+	worker := func() {
+		defer wg.Done()
+		for {
+			n := int(atomic.AddInt64(&next, 1)) - 1
+			if n >= len(missed) {
+				return
+			}
+			i := missed[n]
+			keyCtx, done, ok := ff.start(ctx, i)
+			if !ok {
+				deliver(response[K, V]{Index: i, Key: keys[i], Err: context.Canceled})
+				continue
+			}
+			value, src, err := c.get(keyCtx, keys[i], nil)
+			done()
+			deliver(response[K, V]{
+				Index:     i,
+				Key:       keys[i],
+				Value:     value,
+				Err:       err,
+				FromCache: src == sourceCache,
+			})
+		}
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+	if !early {
+		wg.Wait()
+		return responses
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return responses
+	case err := <-failure:
+		// the keys not done yet get the error too, so GetMany returns it along with the values done before them
+		ff.abandon()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, ok := range delivered {
+			if !ok {
+				responses[i] = response[K, V]{Index: i, Key: keys[i], Err: err}
+			}
+		}
+		returned = true
+		return responses
+	}
+}
+
+// failFastGroup cancels the lookups of the keys after the first one failing, in the order they were given, since
+// only the values before it and its error are returned. A nil group never cancels anything
+type failFastGroup struct {
+	mutex   sync.Mutex
+	first   int                        // position of the first key failing so far
+	cancels map[int]context.CancelFunc // lookups going on, by position
+}
+
+// start returns the context to look up the key at position i with, and the func to call once done
+// It reports false when the key comes after a failing one, so it does not need to be looked up
+func (g *failFastGroup) start(ctx context.Context, i int) (context.Context, func(), bool) {
+	if g == nil {
+		return ctx, func() {}, true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if i > g.first {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	g.cancels[i] = cancel
+	return ctx, func() {
+		g.mutex.Lock()
+		delete(g.cancels, i)
+		g.mutex.Unlock()
+		cancel()
+	}, true
+}
+
+// skips reports whether the key at position i comes after a failing one, so it does not need to be looked up
+func (g *failFastGroup) skips(i int) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return i > g.first
+}
+
+// abandon cancels the lookups of every key, the ones not started yet included, for a batch returning without
+// waiting for them, see WithFailFast
+func (g *failFastGroup) abandon() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.first = -1
+	for _, cancel := range g.cancels {
+		cancel()
+	}
+}
+
+// failed cancels the lookups of the keys after position i
+func (g *failFastGroup) failed(i int) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if i >= g.first {
+		return
+	}
+	g.first = i
+	for j, cancel := range g.cancels {
+		if j > i {
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,795 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type product struct {
+	Name  string
+	Stock int
+}
+
+// Check that the cache works with struct values and non string keys
+func TestCache_StructValuesAndIntKeys(t *testing.T) {
+	var calls int64
+	products := map[int]product{
+		1: {Name: "shoe", Stock: 3},
+		2: {Name: "sock", Stock: 10},
+	}
+	fetcher := FetcherFunc[int, product](func(id int) (product, error) {
+		atomic.AddInt64(&calls, 1)
+		p, ok := products[id]
+		if !ok {
+			return product{}, fmt.Errorf("product %v not found", id)
+		}
+		return p, nil
+	})
+	cache := NewCache[int, product](fetcher, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		p, err := cache.Get(1)
+		if err != nil {
+			t.Error("error getting product", 1)
+		}
+		if p != products[1] {
+			t.Errorf("wrong product returned, expected : %v, got : %v", products[1], p)
+		}
+	}
+	assertInt(t, 1, int(atomic.LoadInt64(&calls)), "wrong number of fetcher calls")
+
+	values, err := cache.GetMany(2, 1)
+	if err != nil {
+		t.Error("error getting products", err)
+	}
+	if len(values) != 2 || values[0] != products[2] || values[1] != products[1] {
+		t.Errorf("wrong products returned, got : %v", values)
+	}
+	assertInt(t, 2, int(atomic.LoadInt64(&calls)), "wrong number of fetcher calls")
+
+	if _, err := cache.Get(3); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+// Check that closing the cache waits for its background goroutines and rejects further calls
+func TestClose_StopsBackgroundGoroutines(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 50 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	goroutines := runtime.NumGoroutine()
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	cache.SetRefreshThreshold(30 * time.Second)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(45 * time.Second)
+	// served from the cache, starting a background refresh
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+
+	cache.Close()
+	assertInt(t, goroutines, runtime.NumGoroutine(), "wrong number of goroutines after close")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	if _, err := cache.GetPriceFor("p1"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if _, err := cache.GetPricesFor("p1"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	cache.Close()
+}
+
+// Check that the cached keys can be inspected
+func TestKeys_ListsCachedItems(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+	getPricesWithNoErr(t, cache, "p3", "p1", "p2")
+	assertInt(t, 3, cache.Len(), "wrong number of cached items")
+
+	keys := cache.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "p1,p2,p3" {
+		t.Errorf("wrong keys, expected : [p1 p2 p3], got : %v", keys)
+	}
+	// the returned keys are a copy
+	keys[0] = "changed"
+	if _, ok := cache.peek("p1"); !ok {
+		t.Error("expected cache not to change when mutating the returned keys")
+	}
+}
+
+// Check that the eviction callback is told about evicted and invalidated prices
+func TestOnEvict_ReportsRemovedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 2)
+	evicted := map[string]float64{}
+	cache.OnEvict(func(itemCode string, price float64) {
+		evicted[itemCode] = price
+		cache.Len() // the callback can use the cache without deadlocking
+	})
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p3") // evicts "p1", the least recently used
+	if len(evicted) != 1 || evicted["p1"] != 5 {
+		t.Errorf("wrong evicted prices, expected : map[p1:5], got : %v", evicted)
+	}
+
+	cache.Invalidate("p3")
+	if len(evicted) != 2 || evicted["p3"] != 9 {
+		t.Errorf("wrong evicted prices, expected : map[p1:5 p3:9], got : %v", evicted)
+	}
+}
+
+// Check that only the prices matching the predicate by their price or age are evicted, telling the eviction callback
+func TestEvictIf_RemovesMatchingPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 70, err: nil},
+			"p3": {price: 9, err: nil},
+			"p4": {price: 0, err: errors.New("p4 error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	cache.SetNegativeTTL(time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p3")
+	cache.GetPriceFor("p4")
+	evicted := map[string]float64{}
+	cache.OnEvict(func(itemCode string, price float64) {
+		evicted[itemCode] = price
+	})
+
+	n := cache.EvictIf(func(itemCode string, price float64, age time.Duration) bool {
+		return price > 50 || age >= 30*time.Second
+	})
+	assertInt(t, 2, n, "wrong number of evicted prices")
+	if len(evicted) != 2 || evicted["p1"] != 5 || evicted["p2"] != 70 {
+		t.Errorf("wrong evicted prices, expected : map[p1:5 p2:70], got : %v", evicted)
+	}
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+	if _, ok := cache.peek("p3"); !ok {
+		t.Error("expected p3 to be kept")
+	}
+}
+
+// Check that refreshing always calls the service and stores the new price
+func TestRefresh_AlwaysFetches(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(10 * time.Second)
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+
+	price, err := cache.Refresh("p1")
+	if err != nil {
+		t.Error("error refreshing price for", "p1")
+	}
+	assertFloat(t, 6, price, "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	if e, _ := cache.peek("p1"); !e.CreatedAt.Equal(clock.Now()) {
+		t.Error("expected the fetch time to be updated")
+	}
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that only the prices expiring within the threshold, or already expired, are fetched again, and that failures
+// are reported
+func TestRefreshExpiring_RefreshesNearExpiry(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	clock.Advance(20 * time.Second)
+	getPriceWithNoErr(t, cache, "p3")
+	clock.Advance(15 * time.Second)
+	for itemCode, price := range map[string]float64{"p1": 6, "p2": 8, "p3": 10} {
+		mockService.setResult(itemCode, mockResult{price: price, err: nil})
+	}
+
+	// p1 expired 5s ago, p2 expires in 25s and p3 in 45s
+	if err := cache.RefreshExpiring(30 * time.Second); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assertInt(t, 5, mockService.getNumCalls(), "wrong number of service calls")
+	assertFloats(t, []float64{6, 8, 9}, getPricesWithNoErr(t, cache, "p1", "p2", "p3"), "wrong prices returned")
+	assertInt(t, 5, mockService.getNumCalls(), "wrong number of service calls")
+
+	clock.Advance(time.Second)
+	mockService.setResult("p3", mockResult{price: 0, err: errors.New("some error")})
+	if err := cache.RefreshExpiring(time.Minute); err == nil {
+		t.Error("expected the failure to be reported")
+	}
+	assertInt(t, 8, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the age of a cached price follows the clock, and that absent prices have none
+func TestAgeOf_FollowsClock(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(42 * time.Second)
+
+	age, ok := cache.AgeOf("p1")
+	if !ok || age != 42*time.Second {
+		t.Errorf("wrong age, expected : 42s true, got : %v %v", age, ok)
+	}
+	if _, ok := cache.AgeOf("p2"); ok {
+		t.Error("expected no age for an absent price")
+	}
+}
+
+// Check that every response carries its key and lands at its position, even when the first keys finish last
+func TestGetAll_MatchesResponsesToKeys(t *testing.T) {
+	cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		time.Sleep(time.Duration(10-key) * 2 * time.Millisecond)
+		return key * 10, nil
+	}), time.Minute)
+	keys := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	next := 0
+	cache.getAll(context.Background(), keys, false, func(r response[int, int]) {
+		assertInt(t, next, r.Index, "wrong response index")
+		assertInt(t, keys[next], r.Key, "wrong response key")
+		assertInt(t, keys[next]*10, r.Value, "wrong response value")
+		next++
+	})
+	assertInt(t, len(keys), next, "wrong number of responses")
+}
+
+// Check that a batch of several chunks of keys keeps them in order, repeated ones across chunks included, and that
+// a failing key in a chunk keeps the chunks after it from being looked up
+func TestGetMany_LargeBatchInChunks(t *testing.T) {
+	var calls int64
+	failing := batchChunkSize + batchChunkSize/2
+	cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		if key == failing {
+			return 0, errors.New("failing key")
+		}
+		return key * 10, nil
+	}), time.Minute)
+	keys := make([]int, 2*batchChunkSize+batchChunkSize/2)
+	for i := range keys {
+		keys[i] = i % failing // the keys of the last chunk are repeated from the first ones
+	}
+	values, err := cache.GetMany(keys...)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertInt(t, len(keys), len(values), "wrong number of values")
+	for i, value := range values {
+		if value != keys[i]*10 {
+			t.Fatalf("wrong value at %v, expected : %v, got : %v", i, keys[i]*10, value)
+		}
+	}
+	assertInt(t, failing, int(atomic.LoadInt64(&calls)), "wrong number of fetcher calls")
+
+	for i := range keys {
+		keys[i] = failing + i
+	}
+	values, err = cache.GetMany(keys...)
+	if err == nil || values != nil && len(values) != 0 {
+		t.Errorf("expected the failing key error and no values, got %v values, %v", len(values), err)
+	}
+	if calls := int(atomic.LoadInt64(&calls)) - failing; calls > batchChunkSize {
+		t.Errorf("expected the chunks after the failing key not to be looked up, got %v fetcher calls", calls)
+	}
+}
+
+// Check that a snapshot has the fresh prices only, and mutating it does not change the cache
+func TestSnapshot_CopiesFreshPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	clock.Advance(40 * time.Second) // "p1" expired
+
+	snapshot := cache.Snapshot()
+	if len(snapshot) != 1 || snapshot["p2"] != 7 {
+		t.Errorf("wrong snapshot, expected : map[p2:7], got : %v", snapshot)
+	}
+	snapshot["p2"] = 100
+	snapshot["p3"] = 9
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+}
+
+// Check that the estimated size of the cached values never goes over the limit, evicting the least recently used
+func TestWithMaxBytes_EvictsBySize(t *testing.T) {
+	values := map[string]string{"a": "xxxx", "b": "xxx", "c": "xxxxxx", "d": "xxxxxxxxxxxx", "e": "x"}
+	cache := NewCacheWith[string, string](FetcherFunc[string, string](func(key string) (string, error) {
+		return values[key], nil
+	}), WithMaxBytes(10, func(value string) int { return len(value) }))
+
+	for _, key := range []string{"a", "b", "a", "c", "e", "d", "e"} {
+		if _, err := cache.Get(key); err != nil {
+			t.Fatalf("unexpected error getting %v: %v", key, err)
+		}
+		if bytes := cache.Stats().Bytes; bytes > 10 {
+			t.Errorf("cached bytes over the limit after getting %v: %d", key, bytes)
+		}
+	}
+	// "c" made room by evicting "b", the least recently used, and "d" evicted everything as it did not fit on its own
+	keys := cache.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "e" {
+		t.Errorf("wrong keys, expected : [e], got : %v", keys)
+	}
+	assertInt(t, 1, cache.Stats().Bytes, "wrong cached bytes")
+}
+
+// Check that the compute function only runs on a miss, concurrent misses sharing a single run
+func TestGetOrCompute_ComputesOnMiss(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	var runs int64
+	compute := func() (float64, error) {
+		atomic.AddInt64(&runs, 1)
+		time.Sleep(10 * time.Millisecond)
+		return 3, nil
+	}
+
+	done := make(chan float64)
+	for i := 0; i < 5; i++ {
+		go func() {
+			price, _ := cache.GetOrCompute("promo", compute)
+			done <- price
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		assertFloat(t, 3, <-done, "wrong price returned")
+	}
+	price, err := cache.GetOrCompute("promo", compute)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assertFloat(t, 3, price, "wrong price returned")
+	assertInt(t, 1, int(atomic.LoadInt64(&runs)), "wrong number of compute runs")
+
+	// expires under the same rules
+	clock.Advance(time.Minute)
+	cache.GetOrCompute("promo", compute)
+	assertInt(t, 2, int(atomic.LoadInt64(&runs)), "wrong number of compute runs")
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that every cached price is visited with its age, leaving out negatively cached errors
+func TestForEach_VisitsCachedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock), WithNegativeTTL(time.Minute))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(10 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	cache.GetPriceFor("p3")
+	clock.Advance(5 * time.Second)
+
+	prices := map[string]float64{}
+	ages := map[string]time.Duration{}
+	cache.ForEach(func(itemCode string, price float64, age time.Duration) bool {
+		prices[itemCode] = price
+		ages[itemCode] = age
+		return true
+	})
+	if len(prices) != 2 || prices["p1"] != 5 || prices["p2"] != 7 {
+		t.Errorf("wrong prices visited, expected : map[p1:5 p2:7], got : %v", prices)
+	}
+	if ages["p1"] != 15*time.Second || ages["p2"] != 5*time.Second {
+		t.Errorf("wrong ages, expected : map[p1:15s p2:5s], got : %v", ages)
+	}
+}
+
+// Check that iterating stops as soon as the callback returns false
+func TestForEach_StopsEarly(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := []string{}
+	for i := 0; i < 50; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPricesWithNoErr(t, cache, codes...)
+
+	visited := 0
+	cache.ForEach(func(itemCode string, price float64, age time.Duration) bool {
+		visited++
+		return visited < 3
+	})
+	assertInt(t, 3, visited, "wrong number of visited prices")
+}
+
+// Check that a batch mixing fresh and missing prices serves each at its position, counting the hits and misses
+func TestGetPricesFor_ServesHitsAndMisses(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+			"p4": {price: 11, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPricesWithNoErr(t, cache, "p1", "p3")
+	prices := getPricesWithNoErr(t, cache, "p3", "p2", "p1", "p4", "p3")
+	assertFloatsInOrder(t, []float64{9, 7, 5, 11, 9}, prices, "wrong prices returned")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+	stats := cache.Stats()
+	assertInt(t, 2, int(stats.Hits), "wrong number of hits")
+	assertInt(t, 4, int(stats.Misses), "wrong number of misses")
+}
+
+// Check that peeking only reports fresh prices and never calls the service nor changes the stats
+func TestPeek_NoSideEffects(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	clock.Advance(40 * time.Second) // "p1" expired
+	stats := cache.Stats()
+
+	if price, ok := cache.Peek("p2"); !ok || price != 7 {
+		t.Errorf("wrong peeked price, expected : 7 true, got : %v %v", price, ok)
+	}
+	if price, ok := cache.Peek("p1"); ok || price != 0 {
+		t.Errorf("expected no price for a stale item, got : %v %v", price, ok)
+	}
+	if price, ok := cache.Peek("p3"); ok || price != 0 {
+		t.Errorf("expected no price for a missing item, got : %v %v", price, ok)
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	if cache.Stats().Hits != stats.Hits || cache.Stats().Misses != stats.Misses {
+		t.Errorf("expected the stats not to change, before : %+v, after : %+v", stats, cache.Stats())
+	}
+}
+
+// Check that a refresh finishing after a price was set does not overwrite it with the older value it fetched
+func TestRefresh_DoesNotOverwriteNewerPrice(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	mockService.setResult("p1", mockResult{price: 6, err: nil})
+	mockService.callDelay = 50 * time.Millisecond
+
+	done := make(chan float64)
+	go func() {
+		price, _ := cache.Refresh("p1")
+		done <- price
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cache.SetPrice("p1", 9) // set while the refresh is in-flight
+	assertFloat(t, 6, <-done, "wrong refreshed price returned")
+	assertFloat(t, 9, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+
+	// a refresh started after the price was set is the newer one
+	if _, err := cache.Refresh("p1"); err != nil {
+		t.Error("error refreshing price for", "p1")
+	}
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+}
+
+// Check that of two fetches of a cold item going on at the same time, the first one to complete is kept, so the
+// later one does not extend its lifetime
+func TestRefresh_ConcurrentColdFetchesKeepFirst(t *testing.T) {
+	clock := newFakeClock()
+	release := map[float64]chan struct{}{1: make(chan struct{}), 2: make(chan struct{})}
+	var calls int64
+	fetcher := FetcherFunc[string, float64](func(key string) (float64, error) {
+		n := float64(atomic.AddInt64(&calls, 1))
+		<-release[n]
+		return n, nil
+	})
+	cache := NewCacheWith[string, float64](fetcher, WithMaxAge(time.Minute), WithClock(clock))
+
+	first, second := make(chan float64), make(chan float64)
+	go func() {
+		price, _ := cache.Refresh("p1")
+		first <- price
+	}()
+	for atomic.LoadInt64(&calls) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		price, _ := cache.Refresh("p1")
+		second <- price
+	}()
+	for atomic.LoadInt64(&calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release[1])
+	assertFloat(t, 1, <-first, "wrong price returned")
+	clock.Advance(20 * time.Second)
+	close(release[2])
+	assertFloat(t, 2, <-second, "wrong price returned")
+
+	clock.Advance(10 * time.Second)
+	age, ok := cache.AgeOf("p1")
+	if !ok {
+		t.Fatal("expected the item to be cached")
+	}
+	if age != 30*time.Second {
+		t.Errorf("expected the age to follow the first fetch, got %v", age)
+	}
+	price, err := cache.Get("p1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFloat(t, 1, price, "wrong cached price")
+}
+
+// gatedPriceService counts its calls and holds every one of them until it gets a release, or the release is closed
+type gatedPriceService struct {
+	calls   int64
+	release chan struct{}
+}
+
+func (s *gatedPriceService) GetPriceFor(itemCode string) (float64, error) {
+	n := atomic.AddInt64(&s.calls, 1)
+	<-s.release
+	return float64(n), nil
+}
+
+// Check that two concurrent cold lookups of an item keep the price of the first fetch to complete, with its age, so
+// the second one does not extend its lifetime
+func TestGetPriceFor_ConcurrentColdLookupsKeepFirstFetch(t *testing.T) {
+	clock := newFakeClock()
+	service := &gatedPriceService{release: make(chan struct{})}
+	cache := NewCacheWithOptions(service, WithMaxAge(time.Minute), WithClock(clock))
+	lookup := func() chan float64 {
+		done := make(chan float64)
+		go func() {
+			price, _ := cache.GetPriceFor("p1")
+			done <- price
+		}()
+		return done
+	}
+	first := lookup()
+	for atomic.LoadInt64(&service.calls) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	second := lookup()
+	for cache.Stats().Misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	service.release <- struct{}{}
+	assertFloat(t, 1, <-first, "wrong price returned")
+	clock.Advance(20 * time.Second)
+	close(service.release) // a second fetch, if any, completes after the first one
+	<-second
+
+	clock.Advance(10 * time.Second)
+	age, ok := cache.AgeOf("p1")
+	if !ok || age != 30*time.Second {
+		t.Errorf("expected the age to follow the first fetch, got %v", age)
+	}
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p1"), "wrong cached price")
+	assertInt(t, 1, int(atomic.LoadInt64(&service.calls)), "wrong number of service calls")
+}
+
+// Check that the remaining TTL follows the clock and the TTL set for the item, and that expired items have none
+func TestTTL_ReportsRemainingLifetime(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	cache.SetPriceTTL("p2", 2*time.Minute)
+	getPricesWithNoErr(t, cache, "p1", "p2")
+	clock.Advance(20 * time.Second)
+
+	if ttl, ok := cache.TTL("p1"); !ok || ttl != 40*time.Second {
+		t.Errorf("wrong TTL, expected : 40s true, got : %v %v", ttl, ok)
+	}
+	if ttl, ok := cache.TTL("p2"); !ok || ttl != 100*time.Second {
+		t.Errorf("wrong TTL, expected : 1m40s true, got : %v %v", ttl, ok)
+	}
+	clock.Advance(40 * time.Second)
+	if ttl, ok := cache.TTL("p1"); ok || ttl != 0 {
+		t.Errorf("expected no TTL for an expired price, got : %v %v", ttl, ok)
+	}
+	if _, ok := cache.TTL("p3"); ok {
+		t.Error("expected no TTL for an absent price")
+	}
+}
+
+// Check that seeding many prices at once caches them all as fetched at the same time, respecting the max entries
+func TestSetPrices_SeedsPrices(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	prices := map[string]float64{}
+	for i := 0; i < 100; i++ {
+		prices[fmt.Sprintf("p%d", i)] = float64(i)
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock))
+	cache.SetPrices(prices)
+	assertInt(t, 100, cache.Len(), "wrong number of cached items")
+	for code, price := range prices {
+		assertFloat(t, price, getPriceWithNoErr(t, cache, code), "wrong price returned")
+		if e, _ := cache.peek(code); !e.CreatedAt.Equal(clock.Now()) {
+			t.Errorf("wrong fetch time for %v, expected : %v, got : %v", code, clock.Now(), e.CreatedAt)
+		}
+	}
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+
+	bounded := NewCacheWithOptions(mockService, WithMaxEntries(10))
+	bounded.SetPrices(prices)
+	assertInt(t, 10, bounded.Len(), "wrong number of cached items")
+	assertInt(t, 90, int(bounded.Stats().Evictions), "wrong number of evictions")
+}
+
+// BenchmarkGetMany_AllHits measures a batch of keys that are all fresh in the cache
+func BenchmarkGetMany_AllHits(b *testing.B) {
+	cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		return key, nil
+	}), time.Hour)
+	keys := make([]int, 100)
+	for i := range keys {
+		keys[i] = i
+	}
+	if _, err := cache.GetMany(keys...); err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetMany(keys...)
+	}
+}
+
+// BenchmarkGetMany_Chunks measures batches of growing sizes of cached keys, reporting the peak heap each batch takes
+// on top of the values it returns: it stays about the same beyond a chunk, since the state kept to look the keys up
+// at once is bounded by the chunk size, while the values returned grow with the keys
+func BenchmarkGetMany_Chunks(b *testing.B) {
+	for _, size := range []int{batchChunkSize, 10 * batchChunkSize, 100 * batchChunkSize} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+				return key, nil
+			}), time.Hour)
+			// the keys repeat every chunk, so the cache itself stays as small as a chunk and its heap does not hide the
+			// one of the batch
+			keys := make([]int, size)
+			for i := range keys {
+				keys[i] = i % batchChunkSize
+			}
+			if _, err := cache.GetMany(keys...); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			returned := uint64(size) * uint64(unsafe.Sizeof(0))
+			// collecting often keeps the heap in use close to what is live, rather than to the garbage left so far
+			defer debug.SetGCPercent(debug.SetGCPercent(1))
+
+			var extra uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				runtime.GC()
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				base := stats.HeapInuse
+				var peak atomic.Uint64
+				done := make(chan struct{})
+				sampled := make(chan struct{})
+				go func() {
+					defer close(sampled)
+					var stats runtime.MemStats
+					for {
+						runtime.ReadMemStats(&stats)
+						if stats.HeapInuse > peak.Load() {
+							peak.Store(stats.HeapInuse)
+						}
+						select {
+						case <-done:
+							return
+						case <-time.After(100 * time.Microsecond):
+						}
+					}
+				}()
+				b.StartTimer()
+				cache.GetMany(keys...)
+				b.StopTimer()
+				close(done)
+				<-sampled
+				if p := peak.Load(); p > base+returned && p-base-returned > extra {
+					extra = p - base - returned
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(extra), "peak-extra-B")
+		})
+	}
+}
+
+// BenchmarkGetMany_LargeBatch measures a batch of 100k keys that all have to be fetched
+func BenchmarkGetMany_LargeBatch(b *testing.B) {
+	cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		return key, nil
+	}), 0)
+	keys := make([]int, 100000)
+	for i := range keys {
+		keys[i] = i
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetMany(keys...)
+	}
+}
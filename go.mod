@@ -1,3 +1,3 @@
 module github.com/ariel17/Golang-Challenge
 
-go 1.16
+go 1.24
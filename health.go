@@ -0,0 +1,38 @@
+package sample1
+
+import (
+	"context"
+	"fmt"
+)
+
+// HealthCheck reports whether the cache is usable, for readiness probes: it fails once the cache is closed, or while
+// the circuit breaker is open since the fetcher keeps failing
+// With WithHealthProbe it also fetches the probe key, without caching it, failing if the fetcher does. It stops
+// waiting on the fetcher once ctx is done, returning ctx.Err()
+func (c *Cache[K, V]) HealthCheck(ctx context.Context) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	if c.breaker.current(c.now()) == CircuitOpen {
+		return ErrCircuitOpen
+	}
+	if !c.probe {
+		return nil
+	}
+	result := make(chan error, 1)
+	if !c.spawn(func() {
+		_, _, err := c.load(ctx, c.key(c.probeKey))
+		result <- err
+	}) {
+		return ErrClosed
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("probing fetcher : %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Check that the health check follows the probe key fetches, and that a closed cache is never healthy
+func TestHealthCheck_ProbesService(t *testing.T) {
+	errDown := errors.New("service down")
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"health": {price: 1, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithHealthProbe("health"))
+	if err := cache.HealthCheck(context.Background()); err != nil {
+		t.Errorf("expected the cache to be healthy, got %v", err)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+
+	mockService.setResult("health", mockResult{price: 0, err: errDown})
+	if err := cache.HealthCheck(context.Background()); !errors.Is(err, errDown) {
+		t.Errorf("expected the service error, got %v", err)
+	}
+
+	cache.Close()
+	if err := cache.HealthCheck(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// Check that the health check stops waiting on a slow probe at the context deadline
+func TestHealthCheck_RespectsDeadline(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 200 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"health": {price: 1, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithHealthProbe("health"))
+	defer cache.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cache.HealthCheck(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// Check that without a probe the health check follows the circuit breaker
+func TestHealthCheck_FollowsCircuitBreaker(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: fmt.Errorf("some error")},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithCircuitBreaker(1, time.Minute))
+	if err := cache.HealthCheck(context.Background()); err != nil {
+		t.Errorf("expected the cache to be healthy, got %v", err)
+	}
+	cache.GetPriceFor("p1")
+	if err := cache.HealthCheck(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
@@ -0,0 +1,93 @@
+package sample1
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many of the latest fetch durations are kept to work out the percentiles
+const latencySamples = 1024
+
+// LatencyStats summarizes how long the fetcher calls took
+// Min, Avg and Max cover every call, P50 and P95 only the latest latencySamples ones
+type LatencyStats struct {
+	Count int64
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+	P50   time.Duration
+	P95   time.Duration
+}
+
+// latencies records the fetcher call durations
+type latencies struct {
+	mutex   sync.Mutex
+	count   int64
+	total   time.Duration
+	min     time.Duration
+	max     time.Duration
+	samples []time.Duration // ring of the latest durations
+	next    int             // where the next duration goes once samples is full
+}
+
+func (l *latencies) observe(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.total += d
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+func (l *latencies) stats() LatencyStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.statsLocked()
+}
+
+// reset returns the stats of the durations observed so far and forgets them, with no duration observed in between
+func (l *latencies) reset() LatencyStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := l.statsLocked()
+	l.count, l.total, l.min, l.max = 0, 0, 0, 0
+	l.samples, l.next = nil, 0
+	return stats
+}
+
+// statsLocked is stats for a caller holding the lock
+func (l *latencies) statsLocked() LatencyStats {
+	if l.count == 0 {
+		return LatencyStats{}
+	}
+	sorted := append([]time.Duration{}, l.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return LatencyStats{
+		Count: l.count,
+		Min:   l.min,
+		Avg:   l.total / time.Duration(l.count),
+		Max:   l.max,
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
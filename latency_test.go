@@ -0,0 +1,83 @@
+package sample1
+
+import (
+	"testing"
+	"time"
+)
+
+func assertLatency(t *testing.T, expected LatencyStats, actual LatencyStats) {
+	if actual != expected {
+		t.Errorf("wrong latency, expected : %+v, got : %+v", expected, actual)
+	}
+}
+
+// Check that no duration observed tells zero stats, both read and reset
+func TestLatencies_Empty(t *testing.T) {
+	l := &latencies{}
+	assertLatency(t, LatencyStats{}, l.stats())
+	assertLatency(t, LatencyStats{}, l.reset())
+}
+
+// Check that the min, average, max and nearest-rank percentiles are worked out whatever the order observed
+func TestLatencies_SummarizesDurations(t *testing.T) {
+	l := &latencies{}
+	for i := 0; i < 100; i++ {
+		l.observe(time.Duration((i*37)%100+1) * time.Millisecond) // 1 to 100ms, shuffled
+	}
+	assertLatency(t, LatencyStats{
+		Count: 100,
+		Min:   time.Millisecond,
+		Avg:   50500 * time.Microsecond,
+		Max:   100 * time.Millisecond,
+		P50:   50 * time.Millisecond,
+		P95:   95 * time.Millisecond,
+	}, l.stats())
+
+	l = &latencies{}
+	l.observe(time.Second)
+	assertLatency(t, LatencyStats{
+		Count: 1,
+		Min:   time.Second,
+		Avg:   time.Second,
+		Max:   time.Second,
+		P50:   time.Second,
+		P95:   time.Second,
+	}, l.stats())
+}
+
+// Check that once the window wrapped the percentiles cover the latest durations only, the rest every one of them
+func TestLatencies_WrappedWindow(t *testing.T) {
+	l := &latencies{}
+	for i := 0; i < 100; i++ {
+		l.observe(time.Hour)
+	}
+	for i := 1; i <= latencySamples; i++ {
+		l.observe(time.Duration(i) * time.Millisecond)
+	}
+	total := 100*time.Hour + time.Duration(latencySamples*(latencySamples+1)/2)*time.Millisecond
+	assertLatency(t, LatencyStats{
+		Count: 100 + latencySamples,
+		Min:   time.Millisecond,
+		Avg:   total / time.Duration(100+latencySamples),
+		Max:   time.Hour,
+		P50:   latencySamples / 2 * time.Millisecond,
+		P95:   time.Duration((95*latencySamples+99)/100) * time.Millisecond,
+	}, l.stats())
+
+	// wrapping again drops the oldest of the window
+	l.observe(2 * latencySamples * time.Millisecond)
+	if p50 := l.stats().P50; p50 != (latencySamples/2+1)*time.Millisecond {
+		t.Errorf("wrong P50 once wrapped again, got : %v", p50)
+	}
+
+	l.reset()
+	l.observe(time.Second)
+	assertLatency(t, LatencyStats{
+		Count: 1,
+		Min:   time.Second,
+		Avg:   time.Second,
+		Max:   time.Second,
+		P50:   time.Second,
+		P95:   time.Second,
+	}, l.stats())
+}
@@ -0,0 +1,51 @@
+package sample1
+
+import (
+	"context"
+	"time"
+)
+
+// DistributedLock is a lock shared by several instances of a cache, like every replica of a service, so only one of
+// them calls the fetcher for a missed key while the rest wait for its value, see WithDistributedLock
+// It is called concurrently, so it must be safe for concurrent use
+//
+// Acquire reports whether the lock for the key was taken, along with the func to release it once the value is
+// fetched. A lock whose backend is unavailable should report it taken, with a release doing nothing, so every
+// instance falls back to calling the fetcher on its own instead of waiting for a value no one is fetching
+type DistributedLock[K comparable] interface {
+	Acquire(key K) (acquired bool, release func())
+}
+
+// DefaultLockPoll is how often an instance waiting on the distributed lock checks for the value unless
+// WithDistributedLock says otherwise
+const DefaultLockPoll = 50 * time.Millisecond
+
+// locked fetches the value for the key holding the distributed lock, if there is one
+// While another instance holds it the value is looked up in the secondary cache every lockPoll, as that is where the
+// holder leaves it, until found or until the lock is taken, fetching the value then unless it showed up meanwhile
+// Without a secondary cache the instances still call the fetcher, but one at a time
+func (c *Cache[K, V]) locked(ctx context.Context, key K, compute func() (V, error)) (V, error) {
+	if c.lock == nil {
+		return c.fetch(ctx, key, compute)
+	}
+	for {
+		if acquired, release := c.lock.Acquire(key); acquired {
+			defer release()
+			if value, ok := c.promote(key); ok {
+				return value, nil
+			}
+			return c.fetch(ctx, key, compute)
+		}
+		timer := time.NewTimer(c.lockPoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			var zero V
+			return zero, ctx.Err()
+		case <-timer.C:
+		}
+		if value, ok := c.promote(key); ok {
+			return value, nil
+		}
+	}
+}
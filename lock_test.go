@@ -0,0 +1,78 @@
+package sample1
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockLock is a DistributedLock kept in memory, shared by the caches of a test as if they were on different hosts
+type mockLock struct {
+	mutex sync.Mutex
+	held  map[string]bool
+}
+
+func (m *mockLock) Acquire(itemCode string) (bool, func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.held[itemCode] {
+		return false, nil
+	}
+	m.held[itemCode] = true
+	return true, func() {
+		m.mutex.Lock()
+		delete(m.held, itemCode)
+		m.mutex.Unlock()
+	}
+}
+
+// Check that two caches sharing a lock and a secondary cache call the service once for an item both miss
+func TestWithDistributedLock_FetchesOnceAcrossCaches(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 50 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	lock := &mockLock{held: map[string]bool{}}
+	secondary := &mockSecondaryCache{prices: map[string]float64{}}
+	caches := []*TransparentCache{
+		NewCacheWithOptions(mockService, WithSecondaryPriceCache(secondary),
+			WithDistributedPriceLock(lock, 5*time.Millisecond)),
+		NewCacheWithOptions(mockService, WithSecondaryPriceCache(secondary),
+			WithDistributedPriceLock(lock, 5*time.Millisecond)),
+	}
+
+	var wg sync.WaitGroup
+	for _, cache := range caches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+		}()
+	}
+	wg.Wait()
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 0, len(lock.held), "wrong number of locks held")
+}
+
+// unavailableLock is a DistributedLock whose backend cannot be reached, so it lets every caller go on
+type unavailableLock struct{}
+
+func (unavailableLock) Acquire(itemCode string) (bool, func()) {
+	return true, func() {}
+}
+
+// Check that a lock backend that is unavailable falls back to calling the service from every cache
+func TestWithDistributedLock_FallsBackWhenUnavailable(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		cache := NewCacheWithOptions(mockService, WithDistributedPriceLock(unavailableLock{}, 0))
+		assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
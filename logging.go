@@ -0,0 +1,74 @@
+package sample1
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// logMiss logs the key missed at now, with the age of the entry too old to be served if there was one
+// The attributes are only built when the logger wants debug logs, since misses are frequent
+func (c *Cache[K, V]) logMiss(key K, e entry[V], now time.Time) {
+	ctx := context.Background()
+	if !c.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{slog.Any("key", key)}
+	if !e.CreatedAt.IsZero() {
+		attrs = append(attrs, slog.Duration("age", now.Sub(e.CreatedAt)))
+	}
+	c.logger.LogAttrs(ctx, slog.LevelDebug, "cache miss", attrs...)
+}
+
+// logFetch logs a fetcher call for the key, which took d and failed with err if it is not nil
+func (c *Cache[K, V]) logFetch(ctx context.Context, key K, d time.Duration, err error) {
+	if !c.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	if err != nil {
+		c.logger.LogAttrs(ctx, slog.LevelDebug, "cache fetch failed", slog.Any("key", key), slog.Duration("duration", d),
+			slog.Any("error", err))
+		return
+	}
+	c.logger.LogAttrs(ctx, slog.LevelDebug, "cache fetch", slog.Any("key", key), slog.Duration("duration", d))
+}
+
+// logSkew warns about the entry for the key created after now, see skewed
+func (c *Cache[K, V]) logSkew(key K, e entry[V], now time.Time) {
+	ctx := context.Background()
+	if !c.logger.Enabled(ctx, slog.LevelWarn) {
+		return
+	}
+	c.logger.LogAttrs(ctx, slog.LevelWarn, "cache entry created in the future", slog.Any("key", key),
+		slog.Duration("skew", e.CreatedAt.Sub(now)))
+}
+
+// logRefresh logs the value refreshed for the key by the refresh fetcher when it differs from the previous entry, so
+// both fetchers can be compared, see WithRefreshFetcher
+func (c *Cache[K, V]) logRefresh(key K, previous entry[V], cl *call[V]) {
+	ctx := context.Background()
+	if c.refresher == nil || cl.err != nil || cl.failure != nil || !c.logger.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	if previous.Err == nil && reflect.DeepEqual(previous.Value, cl.value) {
+		return
+	}
+	c.logger.LogAttrs(ctx, slog.LevelInfo, "cache refresh differs", slog.Any("key", key),
+		slog.Any("previous", previous.Value), slog.Any("error", previous.Err), slog.Any("value", cl.value))
+}
+
+// logEvict logs the key removed from the cache
+func (c *Cache[K, V]) logEvict(key K) {
+	ctx := context.Background()
+	if !c.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	c.logger.LogAttrs(ctx, slog.LevelDebug, "cache evict", slog.Any("key", key))
+}
+
+// logAutoSave logs the error saving the values to the file at path in the background, see StartAutoSave
+func (c *Cache[K, V]) logAutoSave(path string, err error) {
+	c.logger.LogAttrs(context.Background(), slog.LevelError, "cache auto save failed", slog.String("path", path),
+		slog.Any("error", err))
+}
@@ -0,0 +1,116 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturingHandler is a slog.Handler keeping every record, with the attributes by key
+type capturingHandler struct {
+	mutex   sync.Mutex
+	records []capturedRecord
+}
+
+type capturedRecord struct {
+	message string
+	level   slog.Level
+	attrs   map[string]slog.Value
+}
+
+func (h *capturingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *capturingHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := map[string]slog.Value{}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	h.mutex.Lock()
+	h.records = append(h.records, capturedRecord{message: r.Message, level: r.Level, attrs: attrs})
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *capturingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *capturingHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// find returns the first record with the message, and whether there is one
+func (h *capturingHandler) find(message string) (capturedRecord, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, r := range h.records {
+		if r.message == message {
+			return r, true
+		}
+	}
+	return capturedRecord{}, false
+}
+
+// Check that misses, fetches, failures and evictions are logged at the debug level with their attributes
+func TestWithLogger_LogsFetches(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 10 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 0, err: errors.New("not found")},
+		},
+	}
+	clock := newFakeClock()
+	handler := &capturingHandler{}
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock),
+		WithLogger(slog.New(handler)))
+	getPriceWithNoErr(t, cache, "p1")
+
+	r, ok := handler.find("cache fetch")
+	if !ok {
+		t.Fatal("expected the fetch to be logged")
+	}
+	if r.level != slog.LevelDebug || r.attrs["key"].String() != "p1" {
+		t.Errorf("wrong fetch record, got %v", r)
+	}
+	if _, ok := r.attrs["duration"]; !ok {
+		t.Errorf("expected the fetch duration, got %v", r.attrs)
+	}
+
+	clock.Advance(90 * time.Second)
+	getPriceWithNoErr(t, cache, "p1")
+	r, _ = handler.find("cache miss")
+	if r.attrs["key"].String() != "p1" {
+		t.Errorf("wrong miss record, got %v", r)
+	}
+	handler.mutex.Lock()
+	age := time.Duration(0)
+	for _, r := range handler.records {
+		if r.message == "cache miss" && r.attrs["age"].Kind() == slog.KindDuration {
+			age = r.attrs["age"].Duration()
+		}
+	}
+	handler.mutex.Unlock()
+	if age != 90*time.Second {
+		t.Errorf("wrong age of the expired price, expected : %v, got : %v", 90*time.Second, age)
+	}
+
+	if _, err := cache.GetPriceFor("p2"); err == nil {
+		t.Error("expected an error for p2")
+	}
+	r, ok = handler.find("cache fetch failed")
+	if !ok || r.attrs["key"].String() != "p2" || r.attrs["error"].Any() == nil {
+		t.Errorf("wrong failure record, got %v", r)
+	}
+
+	cache.Invalidate("p1")
+	if r, ok = handler.find("cache evict"); !ok || r.attrs["key"].String() != "p1" {
+		t.Errorf("wrong evict record, got %v", r)
+	}
+}
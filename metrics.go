@@ -0,0 +1,69 @@
+package sample1
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsCollector is told what the cache does, so it can be exported to a monitoring system
+// An adapter to Prometheus would just increment a counter or observe a histogram on each call
+// It is called while serving lookups, so it must be safe for concurrent use and fast
+type MetricsCollector interface {
+	IncHit()
+	IncMiss()
+	ObserveFetchDuration(d time.Duration)
+}
+
+// NopMetrics is a MetricsCollector ignoring everything, the default of every cache
+type NopMetrics struct{}
+
+func (NopMetrics) IncHit()                              {}
+func (NopMetrics) IncMiss()                             {}
+func (NopMetrics) ObserveFetchDuration(d time.Duration) {}
+
+// MemoryMetrics is a MetricsCollector keeping everything in memory, mostly useful for tests and debugging
+type MemoryMetrics struct {
+	mutex     sync.Mutex
+	hits      int64
+	misses    int64
+	durations []time.Duration
+}
+
+func (m *MemoryMetrics) IncHit() {
+	m.mutex.Lock()
+	m.hits++
+	m.mutex.Unlock()
+}
+
+func (m *MemoryMetrics) IncMiss() {
+	m.mutex.Lock()
+	m.misses++
+	m.mutex.Unlock()
+}
+
+func (m *MemoryMetrics) ObserveFetchDuration(d time.Duration) {
+	m.mutex.Lock()
+	m.durations = append(m.durations, d)
+	m.mutex.Unlock()
+}
+
+// Hits returns how many hits were collected
+func (m *MemoryMetrics) Hits() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.hits
+}
+
+// Misses returns how many misses were collected
+func (m *MemoryMetrics) Misses() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.misses
+}
+
+// FetchDurations returns a copy of every fetch duration collected, in the order they were observed
+func (m *MemoryMetrics) FetchDurations() []time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]time.Duration{}, m.durations...)
+}
@@ -0,0 +1,52 @@
+package sample1
+
+import (
+	"testing"
+	"time"
+)
+
+// slowPriceService takes "took" to answer according to the fake clock
+type slowPriceService struct {
+	mockPriceService
+	clock *fakeClock
+	took  time.Duration
+}
+
+func (s *slowPriceService) GetPriceFor(itemCode string) (float64, error) {
+	s.clock.Advance(s.took)
+	return s.mockPriceService.GetPriceFor(itemCode)
+}
+
+// Check that the collector is told about every hit, miss and fetch duration
+func TestWithMetrics_CollectsMixedWorkload(t *testing.T) {
+	clock := newFakeClock()
+	service := &slowPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+			},
+		},
+		clock: clock,
+		took:  3 * time.Second,
+	}
+	metrics := &MemoryMetrics{}
+	cache := NewCacheWithOptions(service, WithClock(clock), WithMetrics(metrics))
+
+	getPriceWithNoErr(t, cache, "p1") // miss
+	getPriceWithNoErr(t, cache, "p1") // hit
+	getPriceWithNoErr(t, cache, "p2") // miss
+	getPriceWithNoErr(t, cache, "p2") // hit
+	getPriceWithNoErr(t, cache, "p1") // hit
+
+	if metrics.Hits() != 3 || metrics.Misses() != 2 {
+		t.Errorf("wrong hits and misses, expected : 3 2, got : %v %v", metrics.Hits(), metrics.Misses())
+	}
+	durations := metrics.FetchDurations()
+	assertInt(t, 2, len(durations), "wrong number of fetch durations")
+	for _, d := range durations {
+		if d != 3*time.Second {
+			t.Errorf("wrong fetch duration, expected : 3s, got : %v", d)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package sample1
+
+import (
+	"log/slog"
+	"math"
+	"time"
+)
+
+// DefaultMaxAge is how old a cached value can be unless WithMaxAge says otherwise
+const DefaultMaxAge = 5 * time.Minute
+
+// Option configures a cache built by NewCacheWith or NewCacheWithOptions
+//
+// Unless told otherwise a cache:
+//   - keeps values for DefaultMaxAge
+//   - is unbounded, and once bounded admits every new key evicting the least recently used one
+//   - looks up DefaultConcurrency keys at the same time in batches
+//   - uses the system clock
+//   - does not collect metrics beyond Stats, nor log anything
+//   - does not refresh values ahead of time, negatively cache errors, nor sweep expired values
+//   - expires values exactly at their max age, counted from when they were fetched
+//   - does not limit how many fetcher calls are in-flight, nor how often they are made
+//   - does not retry failed fetcher calls, nor stop calling the fetcher when it keeps failing
+//   - returns the fetcher error when it fails, even if there is an expired, last good or default value to serve
+//   - fetches every missed key on its own
+//   - returns from GetMany, along with an error, the values of the keys before the first failing one
+//   - uses the keys exactly as given
+//   - reports itself healthy without calling the fetcher
+type Option func(*config)
+
+type config struct {
+	maxAge           time.Duration
+	maxEntries       int
+	initialCapacity  int
+	maxBytes         int
+	size             any // func(V) int, checked once the value type is known
+	normalizeKey     any // func(K) K, checked once the key type is known
+	probeKey         any // K, checked once the key type is known
+	tagResolver      any // func(K) []string, checked once the key type is known
+	keyResolver      any // func(K) (K, error), checked once the key type is known
+	refreshThreshold time.Duration
+	negativeTTL      time.Duration
+	negativeTTLFor   func(err error) time.Duration
+	concurrency      int
+	sequentialBatch  bool
+	failFast         bool
+	expiryJitter     float64
+	expiryBeta       float64
+	maxInFlight      int
+	failWhenBusy     bool
+	rateLimit        float64
+	staleIfError     bool
+	staleRefetch     bool
+	singleFlightWait time.Duration
+	maxStaleness     time.Duration
+	lastGood         bool
+	slidingExpiry    bool
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retryable        func(err error) bool
+	errorResults     ErrorResults
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	metrics          MetricsCollector
+	logger           *slog.Logger
+	batchWindow      time.Duration
+	clock            Clock
+	sweepInterval    time.Duration
+	admission        bool
+	policy           any // func() EvictionPolicy[K], checked once the key type is known
+	lock             any // DistributedLock[K], checked once the key type is known
+	lockPoll         time.Duration
+	pressure         func() bool
+	shedFraction     float64
+	gzipSnapshots    bool
+	resetStatsOnLoad bool
+	copyOnWrite      bool
+	hooks            []any // func(*Cache[K, V]) applied once the key and value types are known
+}
+
+func defaultConfig() config {
+	return config{
+		maxAge:      DefaultMaxAge,
+		concurrency: DefaultConcurrency,
+		clock:       realClock{},
+		metrics:     NopMetrics{},
+		logger:      slog.New(slog.DiscardHandler),
+	}
+}
+
+// WithMaxAge sets how old a cached value can be, a negative one taken as zero, see SetMaxAge
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(c *config) {
+		c.maxAge = max(maxAge, 0)
+	}
+}
+
+// WithMaxEntries bounds the cache to n keys, evicting the least recently used one to make room for new ones
+// Zero means unbounded
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// WithInitialCapacity makes room for n keys upfront, so a cache expected to hold that many does not grow its maps
+// again and again while warming up. More keys than n can still be stored
+func WithInitialCapacity(n int) Option {
+	return func(c *config) {
+		c.initialCapacity = n
+	}
+}
+
+// WithMaxBytes bounds the estimated size of the cached values to maxBytes, as told by size, evicting the least
+// recently used keys until a new value fits. It can be combined with WithMaxEntries
+// The value type of size must match the one of the cache, otherwise it is ignored
+func WithMaxBytes[V any](maxBytes int, size func(value V) int) Option {
+	return func(c *config) {
+		c.maxBytes = maxBytes
+		c.size = size
+	}
+}
+
+// WithFrequencyAdmission makes a bounded cache only admit a new key, when it would evict the key the eviction policy
+// chooses, if the new key was used more often lately, as estimated by a small frequency sketch like TinyLFU does
+// Keys used once, like the ones of a scan, then do not evict the ones used all the time. Uses are counted for every
+// lookup and store, admitted or not, and forgotten over time
+// It takes no effect on an unbounded cache, nor with an eviction policy not telling its victim, see EvictionPolicy
+func WithFrequencyAdmission() Option {
+	return func(c *config) {
+		c.admission = true
+	}
+}
+
+// WithEvictionPolicy makes a bounded cache evict the keys chosen by a policy created by newPolicy, like NewLFUPolicy
+// or NewFIFOPolicy, instead of the least recently used ones. Every cache built with the option gets a policy of its
+// own. The key type of the policy must match the one of the cache, otherwise it is ignored
+func WithEvictionPolicy[K comparable](newPolicy func() EvictionPolicy[K]) Option {
+	return func(c *config) {
+		c.policy = newPolicy
+	}
+}
+
+// WithDistributedLock makes a miss take the distributed lock for the key before calling the fetcher, so among the
+// caches sharing it only one calls the fetcher at a time for any key, the rest waiting for the value to show up in
+// their secondary cache, checking every poll, see DistributedLock. Poll defaults to DefaultLockPoll
+// The key type of the lock must match the one of the cache, otherwise it is ignored
+func WithDistributedLock[K comparable](lock DistributedLock[K], poll time.Duration) Option {
+	return func(c *config) {
+		c.lock = lock
+		c.lockPoll = poll
+	}
+}
+
+// WithKeyNormalizer makes every key go through normalize before being looked up, stored or invalidated, so keys
+// normalizing to the same one, like "SHOE-42" and "shoe-42" with strings.ToLower, share a single cached value
+// The fetcher is given the normalized keys. The key type of normalize must match the one of the cache, otherwise it
+// is ignored
+func WithKeyNormalizer[K comparable](normalize func(key K) K) Option {
+	return func(c *config) {
+		c.normalizeKey = normalize
+	}
+}
+
+// WithKeyResolver makes every key, once normalized, go through resolve before being looked up, stored or
+// invalidated, like an alias resolved to the canonical ID of a product, so aliases of the same one share a single
+// cached value. Every key resolved is remembered, so resolve is called once per key. Lookups of a key failing to
+// resolve return its error without calling the fetcher, and the rest of the methods use the key as given
+// The fetcher is given the resolved keys. The key type of resolve must match the one of the cache, otherwise it is
+// ignored
+func WithKeyResolver[K comparable](resolve func(key K) (K, error)) Option {
+	return func(c *config) {
+		c.keyResolver = resolve
+	}
+}
+
+// WithTagResolver tags every value stored with the tags returned by resolve for its key, unless it was given its
+// own by SetWithTags, see InvalidateTag. The key type of resolve must match the one of the cache, otherwise it is
+// ignored
+func WithTagResolver[K comparable](resolve func(key K) []string) Option {
+	return func(c *config) {
+		c.tagResolver = resolve
+	}
+}
+
+// WithSnapshotCompression makes SaveTo and SaveToWith gzip compress the values they write, for smaller snapshots
+// Loading them tells compressed snapshots apart on its own, so it does not need this option
+func WithSnapshotCompression(gzip bool) Option {
+	return func(c *config) {
+		c.gzipSnapshots = gzip
+	}
+}
+
+// WithResetStatsOnLoad makes LoadFrom and LoadFromWith zero the stats counters of the cache instead of restoring the
+// ones saved in the snapshot, see ResetStats
+func WithResetStatsOnLoad() Option {
+	return func(c *config) {
+		c.resetStatsOnLoad = true
+	}
+}
+
+// WithHealthProbe makes HealthCheck fetch key to tell whether the fetcher is reachable, so it should be a key that is
+// cheap to fetch. The type of key must match the key type of the cache, otherwise it is ignored
+func WithHealthProbe[K comparable](key K) Option {
+	return func(c *config) {
+		c.probeKey = key
+	}
+}
+
+// WithRefreshThreshold enables refresh-ahead, see SetRefreshThreshold
+func WithRefreshThreshold(threshold time.Duration) Option {
+	return func(c *config) {
+		c.refreshThreshold = threshold
+	}
+}
+
+// WithNegativeTTL enables negative caching, see SetNegativeTTL
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithNegativeTTLFunc enables negative caching with a TTL for every error, like a long one for an item not found and
+// a short one for a timeout, zero meaning the error is not cached. It takes the place of WithNegativeTTL and
+// SetNegativeTTL
+func WithNegativeTTLFunc(negativeTTL func(err error) time.Duration) Option {
+	return func(c *config) {
+		c.negativeTTLFor = negativeTTL
+	}
+}
+
+// WithConcurrency sets how many keys are looked up at the same time in batches, values lower than one are ignored
+func WithConcurrency(n int) Option {
+	return func(c *config) {
+		if n >= 1 {
+			c.concurrency = n
+		}
+	}
+}
+
+// WithCopyOnWriteReads makes lookups of cached values read them without taking any lock, from a copy of their shard
+// that writes replace as a whole, for caches read far more often than written: every write copies the shard of its
+// key, so it costs as much as the keys in it
+func WithCopyOnWriteReads() Option {
+	return func(c *config) {
+		c.copyOnWrite = true
+	}
+}
+
+// WithFailFast makes GetMany, and the methods built on it like GetPricesFor, return the first error as soon as a key
+// fails, cancelling the lookups of the rest of the keys instead of waiting for the ones before the failing key. Keys
+// not done by then count as failed for what is returned along with the error, see WithErrorResults
+func WithFailFast() Option {
+	return func(c *config) {
+		c.failFast = true
+	}
+}
+
+// WithSequentialBatch makes batches look up the keys one after the other, in the order given, in the calling
+// goroutine rather than with a pool of workers, trading throughput for determinism. The concurrency is then ignored,
+// except by Stream which still looks up the keys in a goroutine of its own, one at a time
+func WithSequentialBatch() Option {
+	return func(c *config) {
+		c.sequentialBatch = true
+	}
+}
+
+// WithExpiryJitter makes every value live up to ±fraction of its max age longer or shorter, chosen at random when
+// it is stored, so keys fetched together do not expire together. The fraction is clamped between 0 and 1
+func WithExpiryJitter(fraction float64) Option {
+	return func(c *config) {
+		c.expiryJitter = math.Max(0, math.Min(1, fraction))
+	}
+}
+
+// WithProbabilisticExpiry makes values expire early at random, the XFetch algorithm: every lookup of a fresh value
+// refreshes it ahead of time with a chance growing as it gets closer to expire, weighted by how long it took to
+// fetch, so hot keys are not all missed when they expire. A beta above 1 favours earlier refreshes, and of zero or
+// less disables it. Values set directly, whose fetch time is unknown, are never refreshed early
+func WithProbabilisticExpiry(beta float64) Option {
+	return func(c *config) {
+		c.expiryBeta = math.Max(0, beta)
+	}
+}
+
+// WithMaxInFlight limits how many fetcher calls can be in-flight at the same time, counting the ones started by
+// every method of the cache. Once at the limit, callers wait for a call to finish unless WithFailWhenBusy is set
+// Zero means unlimited
+func WithMaxInFlight(n int) Option {
+	return func(c *config) {
+		c.maxInFlight = n
+	}
+}
+
+// WithFailWhenBusy makes callers get ErrTooManyInFlight instead of waiting when the limit set by WithMaxInFlight is
+// reached, and ErrRateLimited when the one set by WithRateLimit is
+func WithFailWhenBusy() Option {
+	return func(c *config) {
+		c.failWhenBusy = true
+	}
+}
+
+// WithRetry makes a failed fetcher call be tried up to maxAttempts times in total, waiting backoff before the first
+// retry and twice as long before every next one. Retries stop early once the context of the lookup is done, or its
+// deadline would pass while waiting
+func WithRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.retryAttempts = maxAttempts
+		c.retryBackoff = backoff
+	}
+}
+
+// WithRetryableError makes WithRetry only retry the errors retryable reports true for, like timeouts, so the ones
+// that are not going to get better, like an item not found, fail right away. By default every error is retried
+func WithRetryableError(retryable func(err error) bool) Option {
+	return func(c *config) {
+		c.retryable = retryable
+	}
+}
+
+// ErrorResults tells what GetMany returns along with an error, see WithErrorResults
+type ErrorResults int
+
+const (
+	// PartialResults returns the values of the keys before the first failing one, in the order they were given
+	PartialResults ErrorResults = iota
+	// NoResults returns nil, so no value can be used by mistake
+	NoResults
+	// ZeroFilledResults returns a value for every key, the zero value for the ones that failed or were not looked up
+	// once another one failed
+	ZeroFilledResults
+)
+
+// WithErrorResults sets what GetMany returns along with an error, PartialResults by default
+func WithErrorResults(results ErrorResults) Option {
+	return func(c *config) {
+		c.errorResults = results
+	}
+}
+
+// WithCircuitBreaker stops calling the fetcher after "failures" consecutive failures: for the following cooldown
+// lookups missing the cache get ErrCircuitOpen right away, or the expired value with WithStaleIfError. Once the
+// cooldown ends a single call probes the fetcher, closing the breaker if it succeeds or opening it again if not
+// The breaker state is reported by Stats
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.breakerThreshold = failures
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithRateLimit limits the fetcher calls to rps per second, spread evenly, on top of the limit of calls in-flight
+// Calls over the rate wait for their turn, unless WithFailWhenBusy makes them fail with ErrRateLimited
+// Zero disables it
+func WithRateLimit(rps float64) Option {
+	return func(c *config) {
+		c.rateLimit = rps
+	}
+}
+
+// WithSlidingExpiry makes the max age of a value count from the last time it was served instead of when it was
+// fetched, so only values nobody asks for expire. AgeOf then tells how long ago the value was last used
+func WithSlidingExpiry() Option {
+	return func(c *config) {
+		c.slidingExpiry = true
+	}
+}
+
+// WithStaleIfError makes a lookup return the expired cached value, if there is one, when the fetcher fails to get a
+// new one. GetWithStale tells these values apart
+func WithStaleIfError() Option {
+	return func(c *config) {
+		c.staleIfError = true
+	}
+}
+
+// WithServeStaleWhileRefreshing makes a lookup of an expired value return it right away, flagged as stale by
+// GetWithStale, when the value is already being fetched again for another caller, instead of waiting for the new
+// one. The caller missing it first still waits for the new value, and once fetched it is served to every lookup
+func WithServeStaleWhileRefreshing() Option {
+	return func(c *config) {
+		c.staleRefetch = true
+	}
+}
+
+// WithSingleFlightTimeout limits how long a lookup waits on the fetcher call started by another one for the same key,
+// so a pathologically slow call does not keep every caller waiting: past d it gets the fallback value, like the
+// stale one WithStaleIfError, if there is one, or else ErrFetchTimeout. The call itself keeps going, so its value is
+// still cached, and the caller that started it waits for it as usual. Zero disables it
+func WithSingleFlightTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.singleFlightWait = d
+	}
+}
+
+// WithMaxStaleness limits how old a value served by WithStaleIfError or WithLastGoodFallback can be, counted from
+// when it was fetched. Beyond that the fetcher error is returned rather than a value too old to be trusted
+// Zero disables it
+func WithMaxStaleness(d time.Duration) Option {
+	return func(c *config) {
+		c.maxStaleness = d
+	}
+}
+
+// WithLastGoodFallback makes the cache remember the last value fetched for every key, served like a stale one when
+// the fetcher fails, see WithStaleIfError. Unlike the cached value it does not expire nor is it swept, it is only
+// forgotten when the key is invalidated or evicted to make room for others
+// The last good values are not counted by WithMaxEntries nor WithMaxBytes
+func WithLastGoodFallback() Option {
+	return func(c *config) {
+		c.lastGood = true
+	}
+}
+
+// WithBatchWindow makes the keys missed within window of each other be fetched in a single call, as long as the
+// fetcher is a BatchFetcher. Every miss waits up to window longer, in exchange for fewer calls
+// Zero disables it
+func WithBatchWindow(window time.Duration) Option {
+	return func(c *config) {
+		c.batchWindow = window
+	}
+}
+
+// WithMetrics makes the cache report its hits, misses and fetch durations to the collector
+func WithMetrics(collector MetricsCollector) Option {
+	return func(c *config) {
+		c.metrics = collector
+	}
+}
+
+// WithLogger makes the cache log its misses, fetcher calls, failures and evictions to logger at the debug level,
+// with the key, the age of the value missed, how long the call took and its error as attributes
+// A nil logger is ignored
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// WithClock replaces the system clock, mostly useful for tests
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithMemoryPressureHook makes the sweeper ask underPressure, every time it runs, whether memory runs low, like
+// runtime.ReadMemStats or a container memory signal would tell, evicting the fraction of the keys chosen by the
+// eviction policy when it does. The fraction is clamped between 0 and 1
+// It takes no effect without a sweeper, see WithSweepInterval. The eviction policy is told about the keys for it as
+// with WithMaxEntries, even if the cache is otherwise unbounded
+func WithMemoryPressureHook(underPressure func() bool, fraction float64) Option {
+	return func(c *config) {
+		c.pressure = underPressure
+		c.shedFraction = math.Max(0, math.Min(1, fraction))
+	}
+}
+
+// WithSweepInterval starts a sweeper removing expired values every interval, see StartSweeper
+func WithSweepInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.sweepInterval = interval
+	}
+}
+
+// WithOnEvict sets the eviction callback, see OnEvict
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithOnEvict[K comparable, V any](fn func(key K, value V)) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.onEvict = fn
+	})
+}
+
+// WithDefault makes a lookup return the value given by fn, when it reports one, if the fetcher fails and there is
+// no stale value to serve instead. Default values are not cached
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithDefault[K comparable, V any](fn func(key K) (V, bool)) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.defaultValue = fn
+	})
+}
+
+// WithSecondaryCache puts the secondary cache between the cache and the fetcher: misses look it up before calling
+// the fetcher, promoting the values found, and fetched values are set in it too
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithSecondaryCache[K comparable, V any](secondary SecondaryCache[K, V]) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.secondary = secondary
+	})
+}
+
+// WithValidation makes the fetched values go through validate, the ones it returns an error for are handled as if
+// the fetcher had failed with it, so they are never cached
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithValidation[K comparable, V any](validate func(key K, value V) error) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.validate = validate
+	})
+}
+
+// WithTransform makes every value the fetcher returns go through transform before being validated, cached and
+// returned, like a markup applied to prices. Cached values are served as they were stored, so transform is only
+// called once per value fetched, and neither values set directly nor computed ones go through it
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithTransform[K comparable, V any](transform func(key K, value V) V) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.transform = transform
+	})
+}
+
+// WithRefreshFetcher makes the background refreshes call fetcher instead of the fetcher of the cache, while misses
+// keep calling the latter, like a new service validated before moving to it. With a logger, refreshed values
+// differing from the ones they replace are logged at the info level, see WithLogger
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithRefreshFetcher[K comparable, V any](fetcher Fetcher[K, V]) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.refresher = fetcher
+	})
+}
+
+// WithRelatedKeys makes a miss warm the keys returned by related for the missed key, in the background so the
+// lookup does not wait for them. Keys warmed this way do not warm their own related keys
+// Its key and value types must match the ones of the cache, otherwise it is ignored
+func WithRelatedKeys[K comparable, V any](related func(key K) []K) Option {
+	return withHook(func(c *Cache[K, V]) {
+		c.related = related
+	})
+}
+
+// withHook adds an option that needs to know the key and value types of the cache
+func withHook[K comparable, V any](hook func(*Cache[K, V])) Option {
+	return func(c *config) {
+		c.hooks = append(c.hooks, hook)
+	}
+}
@@ -0,0 +1,526 @@
+package sample1
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// orderedPriceService returns as price how many calls were made to it, keeping the item code of every call and how
+// many goroutines were running then
+type orderedPriceService struct {
+	mutex      sync.Mutex
+	calls      []string
+	goroutines []int
+}
+
+func (s *orderedPriceService) GetPriceFor(itemCode string) (float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = append(s.calls, itemCode)
+	s.goroutines = append(s.goroutines, runtime.NumGoroutine())
+	return float64(len(s.calls)), nil
+}
+
+// clockedPriceService takes "took" by the fake clock to return the price of every item, counting its calls
+type clockedPriceService struct {
+	clock *fakeClock
+	took  time.Duration
+	calls int64
+}
+
+func (s *clockedPriceService) GetPriceFor(itemCode string) (float64, error) {
+	s.clock.Advance(s.took)
+	return float64(atomic.AddInt64(&s.calls, 1)), nil
+}
+
+// Check that a price expires early more and more often as it gets closer to expire, and that a lookup close enough
+// refreshes it before its max age
+func TestWithProbabilisticExpiry_RefreshesBeforeExpiry(t *testing.T) {
+	clock := newFakeClock()
+	service := &clockedPriceService{clock: clock, took: 10 * time.Second}
+	cache := NewCacheWithOptions(service, WithMaxAge(100*time.Second), WithProbabilisticExpiry(1), WithClock(clock))
+	random := rand.New(rand.NewSource(42))
+	var mutex sync.Mutex
+	cache.random = func() float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return random.Float64()
+	}
+	assertFloat(t, 1, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+
+	// the chance to refresh with 10s of fetch time and r left is e^(-r/10s)
+	e, _ := cache.peek("p1")
+	previous := -1
+	for _, left := range []time.Duration{90 * time.Second, 50 * time.Second, 20 * time.Second, 5 * time.Second} {
+		refreshes := 0
+		for i := 0; i < 1000; i++ {
+			if _, _, refresh := cache.cached("p1", e.CreatedAt.Add(100*time.Second-left)); refresh {
+				refreshes++
+			}
+		}
+		if refreshes <= previous {
+			t.Errorf("expected more refreshes with %v left than %v, got %v", left, previous, refreshes)
+		}
+		previous = refreshes
+	}
+	if previous == 1000 {
+		t.Error("expected some lookups close to expire not to refresh")
+	}
+
+	clock.Advance(95 * time.Second)
+	for i := 0; i < 100 && atomic.LoadInt64(&service.calls) == 1; i++ {
+		getPriceWithNoErr(t, cache, "p1")
+		time.Sleep(time.Millisecond)
+	}
+	cache.Close()
+	assertInt(t, 2, int(atomic.LoadInt64(&service.calls)), "wrong number of service calls")
+	price, _ := cache.Peek("p1")
+	assertFloat(t, 2, price, "wrong refreshed price")
+}
+
+// Check that a lookup waiting on the slow call of another one gives up after the timeout, getting the stale price if
+// there is one, while the call keeps going and caches the new price
+func TestWithSingleFlightTimeout_FollowersGiveUp(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithStaleIfError(),
+		WithSingleFlightTimeout(50*time.Millisecond))
+	getPriceWithNoErr(t, cache, "p2")
+	clock.Advance(2 * time.Minute)
+	mockService.setResult("p2", mockResult{price: 8, err: nil})
+	mockService.callDelay = 200 * time.Millisecond
+
+	for _, code := range []string{"p1", "p2"} {
+		leader := make(chan float64)
+		go func() {
+			price, _ := cache.GetPriceFor(code)
+			leader <- price
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		start := time.Now()
+		price, err := cache.GetPriceFor(code)
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > 150*time.Millisecond {
+			t.Errorf("expected %v to wait for the timeout only, took %v", code, elapsed)
+		}
+		if code == "p1" && !errors.Is(err, ErrFetchTimeout) {
+			t.Errorf("expected ErrFetchTimeout, got %v", err)
+		}
+		if code == "p2" {
+			if err != nil {
+				t.Errorf("expected the stale price, got error %v", err)
+			}
+			assertFloat(t, 7, price, "wrong stale price returned")
+		}
+
+		expected := map[string]float64{"p1": 5, "p2": 8}[code]
+		assertFloat(t, expected, <-leader, "wrong price returned to the leader")
+		assertFloat(t, expected, getPriceWithNoErr(t, cache, code), "wrong cached price returned")
+	}
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that failing fast returns the error of the failing item without waiting for a slow one before it, as the
+// default does, counting the slow one as failed
+func TestWithFailFast_ReturnsBeforeSlowItems(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		mockService := &mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+				"p3": {price: 0, err: fmt.Errorf("p3 error")},
+			},
+			itemDelays: map[string]time.Duration{"p2": 300 * time.Millisecond, "p3": 10 * time.Millisecond},
+		}
+		opts := []Option{WithErrorResults(ZeroFilledResults)}
+		if failFast {
+			opts = append(opts, WithFailFast())
+		}
+		cache := NewCacheWithOptions(mockService, opts...)
+		getPriceWithNoErr(t, cache, "p1")
+		start := time.Now()
+		prices, err := cache.GetPricesFor("p1", "p2", "p3")
+		elapsed := time.Since(start)
+		if err == nil || !strings.Contains(err.Error(), "p3 error") {
+			t.Errorf("expected the p3 error, got %v", err)
+		}
+		if failFast && elapsed > 200*time.Millisecond {
+			t.Errorf("expected to return once p3 failed, took %v", elapsed)
+		}
+		if !failFast && elapsed < 300*time.Millisecond {
+			t.Errorf("expected to wait for p2, took %v", elapsed)
+		}
+		expected := []float64{5, 7, 0}
+		if failFast {
+			expected = []float64{5, 0, 0}
+		}
+		assertFloatsInOrder(t, expected, prices, "wrong prices returned")
+		cache.Close()
+	}
+}
+
+// Check that a sequential batch calls the service in the order given, without starting any goroutine
+func TestWithSequentialBatch_FetchesInOrder(t *testing.T) {
+	service := &orderedPriceService{}
+	cache := NewCacheWithOptions(service, WithSequentialBatch())
+	cache.SetPrice("p2", 10)
+	before := runtime.NumGoroutine()
+	prices, err := cache.GetPricesFor("p4", "p2", "p1", "p3", "p1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFloatsInOrder(t, []float64{1, 10, 2, 3, 2}, prices, "wrong prices returned")
+	if strings.Join(service.calls, ",") != "p4,p1,p3" {
+		t.Errorf("expected the service to be called in order, got %v", service.calls)
+	}
+	for _, during := range service.goroutines {
+		if during > before {
+			t.Errorf("expected no goroutine to be started, %d running before and %d during", before, during)
+		}
+	}
+}
+
+// Check that every error is cached for the TTL told for it, and not at all when zero
+func TestWithNegativeTTLFunc_CachesEveryErrorForItsOwnTTL(t *testing.T) {
+	errNotFound := errors.New("not found")
+	errTimeout := errors.New("timeout")
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: errNotFound},
+			"p2": {price: 0, err: errTimeout},
+			"p3": {price: 0, err: errors.New("unknown")},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock), WithNegativeTTL(time.Minute),
+		WithNegativeTTLFunc(func(err error) time.Duration {
+			switch {
+			case errors.Is(err, errNotFound):
+				return time.Hour
+			case errors.Is(err, errTimeout):
+				return 5 * time.Second
+			}
+			return 0
+		}))
+	get := func(itemCode string) {
+		if _, err := cache.GetPriceFor(itemCode); err == nil {
+			t.Errorf("expected an error for %v", itemCode)
+		}
+	}
+	get("p1")
+	get("p2")
+	get("p3")
+	get("p1")
+	get("p2")
+	get("p3")
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+
+	clock.Advance(5 * time.Second)
+	get("p1")
+	get("p2")
+	assertInt(t, 5, mockService.getNumCalls(), "wrong number of service calls")
+
+	clock.Advance(time.Hour)
+	get("p1")
+	assertInt(t, 6, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a cache built with options has the defaults for everything not set
+func TestNewCacheWithOptions_Defaults(t *testing.T) {
+	cache := NewCacheWithOptions(&mockPriceService{})
+	if cache.MaxAge() != DefaultMaxAge {
+		t.Errorf("wrong max age, expected : %v, got : %v", DefaultMaxAge, cache.MaxAge())
+	}
+	assertInt(t, 0, cache.maxEntries, "wrong max entries")
+	s := cache.settings.Load()
+	assertInt(t, DefaultConcurrency, s.concurrency, "wrong concurrency")
+	if _, ok := s.clock.(realClock); !ok {
+		t.Errorf("expected the system clock, got %T", s.clock)
+	}
+}
+
+// Check that every option takes effect
+func TestNewCacheWithOptions_AppliesOptions(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	evicted := []string{}
+	cache := NewCacheWithOptions(mockService,
+		WithMaxAge(time.Minute),
+		WithMaxEntries(1),
+		WithConcurrency(4),
+		WithClock(clock),
+		WithRefreshThreshold(10*time.Second),
+		WithNegativeTTL(time.Second),
+		WithOnEvict(func(itemCode string, price float64) {
+			evicted = append(evicted, itemCode)
+		}),
+	)
+	s := cache.settings.Load()
+	assertInt(t, 4, s.concurrency, "wrong concurrency")
+	if s.refreshThreshold != 10*time.Second || s.negativeTTL != time.Second {
+		t.Errorf("wrong refresh threshold or negative TTL, got : %v, %v", s.refreshThreshold, s.negativeTTL)
+	}
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(time.Minute)
+	// expired by the max age and the fake clock
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	// evicted by the max entries
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	if len(evicted) != 1 || evicted[0] != "p1" {
+		t.Errorf("wrong evicted items, expected : [p1], got : %v", evicted)
+	}
+}
+
+// Check that the old constructors still work on top of the options
+func TestNewTransparentCache_UsesOptions(t *testing.T) {
+	cache := NewBoundedTransparentCache(&mockPriceService{}, time.Second, 3)
+	if cache.MaxAge() != time.Second {
+		t.Errorf("wrong max age, expected : %v, got : %v", time.Second, cache.MaxAge())
+	}
+	assertInt(t, 3, cache.maxEntries, "wrong max entries")
+}
+
+// Check that with jitter the prices fetched together do not all expire at the same time
+func TestWithExpiryJitter_SpreadsExpiry(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := []string{}
+	for i := 0; i < 20; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	maxAge := 100 * time.Second
+	cache := NewCacheWithOptions(mockService, WithMaxAge(maxAge), WithClock(newFakeClock()), WithExpiryJitter(0.5))
+	getPricesWithNoErr(t, cache, codes...)
+
+	lifetimes := map[time.Duration]bool{}
+	for _, code := range cache.Keys() {
+		e, _ := cache.peek(code)
+		lifetime := cache.lifetime(code, e)
+		if lifetime < maxAge/2 || lifetime > maxAge*3/2 {
+			t.Errorf("lifetime out of the jitter range: %v", lifetime)
+		}
+		lifetimes[lifetime] = true
+	}
+	if len(lifetimes) < 2 {
+		t.Errorf("expected different lifetimes, got %v", lifetimes)
+	}
+}
+
+// Check that single and batch lookups together never run more service calls than the in-flight limit
+func TestWithMaxInFlight_LimitsEveryMethod(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay:   20 * time.Millisecond,
+		mockResults: map[string]mockResult{},
+	}
+	codes := []string{}
+	for i := 0; i < 20; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	cache := NewCacheWithOptions(mockService, WithMaxInFlight(3))
+
+	var wg sync.WaitGroup
+	for _, code := range codes[:10] {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			getPriceWithNoErr(t, cache, code)
+		}(code)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		getPricesWithNoErr(t, cache, codes[10:]...)
+	}()
+	wg.Wait()
+	assertInt(t, 20, mockService.getNumCalls(), "wrong number of service calls")
+	if mockService.getMaxInFlight() > 3 {
+		t.Errorf("too many parallel service calls, expected at most 3, got %v", mockService.getMaxInFlight())
+	}
+}
+
+// Check that callers can fail instead of waiting when the in-flight limit is reached
+func TestWithFailWhenBusy_FailsFast(t *testing.T) {
+	mockService := &mockPriceService{
+		callDelay: 100 * time.Millisecond,
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithMaxInFlight(1), WithFailWhenBusy())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		getPriceWithNoErr(t, cache, "p1")
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := cache.GetPriceFor("p2"); !errors.Is(err, ErrTooManyInFlight) {
+		t.Errorf("expected ErrTooManyInFlight, got %v", err)
+	}
+	<-done
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+}
+
+// Check that with sliding expiry a price asked for often stays fresh past the max age while an idle one expires
+func TestWithSlidingExpiry_KeepsUsedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock), WithSlidingExpiry())
+	getPricesWithNoErr(t, cache, "p1", "p2")
+	for i := 0; i < 5; i++ {
+		clock.Advance(40 * time.Second)
+		getPriceWithNoErr(t, cache, "p1")
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+
+	// "p2" was idle for longer than the max age
+	getPriceWithNoErr(t, cache, "p2")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that item codes normalizing to the same one share a single cached price, whatever the method used
+func TestWithKeyNormalizer_SharesEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"shoe-42": {price: 5, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithKeyNormalizer(strings.ToLower))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "SHOE-42"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "shoe-42"), "wrong price returned")
+	assertFloats(t, []float64{5, 5}, getPricesWithNoErr(t, cache, "Shoe-42", "sHOE-42"), "wrong prices returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 1, cache.Len(), "wrong number of cached items")
+
+	cache.SetPrice("SHOE-42", 6)
+	assertFloat(t, 6, getPriceWithNoErr(t, cache, "shoe-42"), "wrong price returned")
+	cache.Invalidate("Shoe-42")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "SHOE-42"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that aliases of the same product share a single cached price, fetched by its canonical ID, each alias
+// resolved once, and that an alias failing to resolve fails without calling the service
+func TestWithCanonicalItemCodes_SharesEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"shoe-42": {price: 5, err: nil},
+		},
+	}
+	aliases := map[string]string{"sku-1": "shoe-42", "ean-7790": "shoe-42", "shoe-42": "shoe-42"}
+	resolutions := map[string]int{}
+	cache := NewCacheWithOptions(mockService, WithCanonicalItemCodes(func(itemCode string) (string, error) {
+		resolutions[itemCode]++
+		canonical, ok := aliases[itemCode]
+		if !ok {
+			return "", fmt.Errorf("unknown alias %v", itemCode)
+		}
+		return canonical, nil
+	}))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "sku-1"), "wrong price returned")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "ean-7790"), "wrong price returned")
+	assertFloats(t, []float64{5, 5}, getPricesWithNoErr(t, cache, "sku-1", "ean-7790"), "wrong prices returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertInt(t, 1, cache.Len(), "wrong number of cached items")
+	if keys := cache.Keys(); keys[0] != "shoe-42" {
+		t.Errorf("expected the price to be cached by its canonical ID, got %v", keys)
+	}
+	assertInt(t, 1, resolutions["sku-1"], "wrong number of resolutions")
+	assertInt(t, 1, resolutions["ean-7790"], "wrong number of resolutions")
+
+	if _, err := cache.GetPriceFor("sku-2"); err == nil {
+		t.Error("expected an error for the unknown alias")
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that a fetched price is cached and returned transformed, without transforming it again on hits
+func TestWithTransform_TransformsFetchedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 10, err: nil},
+			"p2": {price: 20, err: nil},
+		},
+	}
+	var transforms int
+	cache := NewCacheWithOptions(mockService, WithTransform(func(itemCode string, price float64) float64 {
+		transforms++
+		return math.Round(price*1.15*100) / 100
+	}))
+	assertFloat(t, 11.5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloat(t, 11.5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertFloats(t, []float64{11.5, 23}, getPricesWithNoErr(t, cache, "p1", "p2"), "wrong prices returned")
+	if price, _ := cache.Peek("p1"); price != 11.5 {
+		t.Errorf("expected the transformed price to be cached, got %v", price)
+	}
+	assertInt(t, 2, transforms, "wrong number of transforms")
+
+	cache.SetPrice("p1", 10)
+	assertFloat(t, 10, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 2, transforms, "wrong number of transforms")
+}
+
+// Check the prices returned along with the error of a batch with a failing item, for every error results mode
+func TestWithErrorResults_ShapesResults(t *testing.T) {
+	for _, tc := range []struct {
+		mode     ErrorResults
+		expected []float64
+		invalid  int // how many prices when an item code is invalid, so none is looked up
+	}{
+		{PartialResults, []float64{5}, 0},
+		{NoResults, nil, 0},
+		{ZeroFilledResults, []float64{5, 0, 9}, 3},
+	} {
+		mockService := &mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 0, err: errors.New("not found")},
+				"p3": {price: 9, err: nil},
+			},
+		}
+		cache := NewCacheWithOptions(mockService, WithErrorResults(tc.mode))
+		// cached, so it is not cancelled once "p2" fails
+		getPricesWithNoErr(t, cache, "p1", "p3")
+
+		prices, err := cache.GetPricesFor("p1", "p2", "p3")
+		if err == nil {
+			t.Errorf("expected an error for mode %v", tc.mode)
+		}
+		if (tc.expected == nil) != (prices == nil) {
+			t.Errorf("wrong prices for mode %v, expected : %v, got : %v", tc.mode, tc.expected, prices)
+		}
+		assertFloatsInOrder(t, tc.expected, prices, fmt.Sprintf("wrong prices for mode %v", tc.mode))
+
+		prices, _ = cache.GetPricesFor("p1", "", "p3")
+		assertInt(t, tc.invalid, len(prices), fmt.Sprintf("wrong number of prices for mode %v", tc.mode))
+	}
+}
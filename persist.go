@@ -0,0 +1,271 @@
+package sample1
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// StoredEntry is a cached value as saved by SaveToWith and loaded by LoadFromWith
+type StoredEntry[V any] struct {
+	Value     V
+	CreatedAt time.Time     // when the value was fetched, so it expires on time once loaded
+	TTL       time.Duration // the TTL told by a TTLFetcher, zero when there is none
+}
+
+// EntryCodec writes and reads the cached values in some format, so they can be saved and loaded again
+type EntryCodec[K comparable, V any] interface {
+	Encode(w io.Writer, entries map[K]StoredEntry[V]) error
+	Decode(r io.Reader) (map[K]StoredEntry[V], error)
+}
+
+// StoredStats are the stats counters of the cache as saved by SaveToWith and loaded by LoadFromWith
+// The rest of the stats are not saved: the entries and bytes follow the values loaded, while the fetcher latencies
+// and the failures counted by ErrorCounts start over, like the circuit breaker
+type StoredStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// StatsCodec is an EntryCodec that also writes and reads the stats counters of the cache along with the values, so
+// they survive a restart. SaveToWith and LoadFromWith use these methods instead when the codec has them
+// DecodeWithStats returns nil stats when there were none saved, like in a snapshot written before they were
+type StatsCodec[K comparable, V any] interface {
+	EntryCodec[K, V]
+	EncodeWithStats(w io.Writer, entries map[K]StoredEntry[V], stats StoredStats) error
+	DecodeWithStats(r io.Reader) (map[K]StoredEntry[V], *StoredStats, error)
+}
+
+// JSONCodec is the EntryCodec used by SaveTo and LoadFrom, a StatsCodec
+// The values are written as a list, so keys do not need to be strings
+// Snapshots tell the version of their format, and fields unknown to it are ignored, so snapshots written by newer
+// versions can still be read. The ones written before the stats were saved are read without stats
+type JSONCodec[K comparable, V any] struct{}
+
+// snapshotVersion is the version of the format JSONCodec writes, raised every time fields are added to it
+const snapshotVersion = 2
+
+// snapshot is what JSONCodec writes and reads
+type snapshot[K comparable, V any] struct {
+	Version int                   `json:"version,omitempty"` // zero for the first format, without stats
+	Entries []snapshotEntry[K, V] `json:"entries"`
+	Stats   *StoredStats          `json:"stats,omitempty"`
+}
+
+type snapshotEntry[K comparable, V any] struct {
+	Key       K             `json:"key"`
+	Value     V             `json:"value"`
+	CreatedAt time.Time     `json:"created_at"`
+	TTL       time.Duration `json:"ttl,omitempty"`
+}
+
+func (codec JSONCodec[K, V]) Encode(w io.Writer, entries map[K]StoredEntry[V]) error {
+	return codec.encode(w, entries, nil)
+}
+
+func (codec JSONCodec[K, V]) EncodeWithStats(w io.Writer, entries map[K]StoredEntry[V], stats StoredStats) error {
+	return codec.encode(w, entries, &stats)
+}
+
+func (JSONCodec[K, V]) encode(w io.Writer, entries map[K]StoredEntry[V], stats *StoredStats) error {
+	s := snapshot[K, V]{Version: snapshotVersion, Entries: []snapshotEntry[K, V]{}, Stats: stats}
+	for key, e := range entries {
+		s.Entries = append(s.Entries, snapshotEntry[K, V]{
+			Key:       key,
+			Value:     e.Value,
+			CreatedAt: e.CreatedAt,
+			TTL:       e.TTL,
+		})
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+func (codec JSONCodec[K, V]) Decode(r io.Reader) (map[K]StoredEntry[V], error) {
+	entries, _, err := codec.DecodeWithStats(r)
+	return entries, err
+}
+
+func (JSONCodec[K, V]) DecodeWithStats(r io.Reader) (map[K]StoredEntry[V], *StoredStats, error) {
+	var s snapshot[K, V]
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, nil, err
+	}
+	entries := make(map[K]StoredEntry[V], len(s.Entries))
+	for _, se := range s.Entries {
+		entries[se.Key] = StoredEntry[V]{Value: se.Value, CreatedAt: se.CreatedAt, TTL: se.TTL}
+	}
+	return entries, s.Stats, nil
+}
+
+// SaveTo writes the cached values to w as JSON, see SaveToWith
+func (c *Cache[K, V]) SaveTo(w io.Writer) error {
+	return c.SaveToWith(w, JSONCodec[K, V]{})
+}
+
+// SaveToWith writes the cached values to w with codec, including when they were fetched so they expire on time once
+// loaded. Negatively cached errors are not saved
+// The stats counters are written too when codec is a StatsCodec
+// With WithSnapshotCompression what codec writes is gzip compressed
+func (c *Cache[K, V]) SaveToWith(w io.Writer, codec EntryCodec[K, V]) error {
+	entries := map[K]StoredEntry[V]{}
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		for key, e := range sh.entries {
+			if e.Err != nil {
+				continue
+			}
+			entries[key] = StoredEntry[V]{Value: e.Value, CreatedAt: e.CreatedAt, TTL: e.TTL}
+		}
+		sh.mutex.RUnlock()
+	}
+	encode := codec.Encode
+	if statsCodec, ok := codec.(StatsCodec[K, V]); ok {
+		stats := StoredStats{
+			Hits:      atomic.LoadInt64(&c.counters.hits),
+			Misses:    atomic.LoadInt64(&c.counters.misses),
+			Evictions: atomic.LoadInt64(&c.counters.evictions),
+		}
+		encode = func(w io.Writer, entries map[K]StoredEntry[V]) error {
+			return statsCodec.EncodeWithStats(w, entries, stats)
+		}
+	}
+	if !c.compress {
+		return encode(w, entries)
+	}
+	zw := gzip.NewWriter(w)
+	if err := encode(zw, entries); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// gzipMagic is how gzip compressed data starts
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// LoadFrom reads values written by SaveTo into the cache, see LoadFromWith
+func (c *Cache[K, V]) LoadFrom(r io.Reader) error {
+	return c.LoadFromWith(r, JSONCodec[K, V]{})
+}
+
+// LoadFromWith reads values written by SaveToWith with the same codec into the cache, decompressing them if they
+// were compressed, whether the cache compresses its snapshots or not
+// Values that already expired are skipped, and so are the ones older than what the cache already has
+// When codec is a StatsCodec and stats were saved, the stats counters of the cache are restored to the ones read,
+// replacing what they counted so far, or else they are left as they are, unless told to reset them instead by
+// WithResetStatsOnLoad
+func (c *Cache[K, V]) LoadFromWith(r io.Reader, codec EntryCodec[K, V]) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	var entries map[K]StoredEntry[V]
+	var stats *StoredStats
+	var err error
+	if statsCodec, ok := codec.(StatsCodec[K, V]); ok {
+		entries, stats, err = statsCodec.DecodeWithStats(r)
+	} else {
+		entries, err = codec.Decode(r)
+	}
+	if err != nil {
+		return err
+	}
+	if c.resetOnLoad {
+		c.ResetStats()
+	} else if stats != nil {
+		atomic.StoreInt64(&c.counters.hits, stats.Hits)
+		atomic.StoreInt64(&c.counters.misses, stats.Misses)
+		atomic.StoreInt64(&c.counters.evictions, stats.Evictions)
+	}
+	now := c.now()
+	for key, se := range entries {
+		key = c.key(key)
+		e := entry[V]{Value: se.Value, CreatedAt: se.CreatedAt, TTL: se.TTL}
+		sh := c.shardFor(key)
+		sh.mutex.RLock()
+		current, ok := sh.entries[key]
+		expired := !c.fresh(key, e, now)
+		sh.mutex.RUnlock()
+		if expired || (ok && !current.CreatedAt.Before(e.CreatedAt)) {
+			continue
+		}
+		c.store(key, e)
+	}
+	return nil
+}
+
+// SaveFile writes the cached values to the file at path, see SaveTo
+// The values are written to a temporary file first and then renamed, so the file is never left half written
+func (c *Cache[K, V]) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed, which is fine
+	if err := c.SaveTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// StartAutoSave saves the cached values to the file at path every interval, see SaveFile, so they can be loaded
+// back after a crash. It stops when the cache is closed
+// Failures are told to the OnAutoSaveError callback, or logged by the logger of the cache if there is none, see
+// WithLogger. The saves follow the cache clock when it is a TickerClock. An interval of zero or less saves nothing
+func (c *Cache[K, V]) StartAutoSave(interval time.Duration, path string) {
+	if interval <= 0 {
+		return
+	}
+	ticks, stop := c.ticker(interval)
+	if !c.spawn(func() {
+		defer stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticks:
+				if err := c.SaveFile(path); err != nil {
+					c.autoSaveFailed(path, err)
+				}
+			}
+		}
+	}) {
+		stop() // the cache is closed
+	}
+}
+
+// OnAutoSaveError sets a callback called every time saving the values started by StartAutoSave fails
+func (c *Cache[K, V]) OnAutoSaveError(fn func(err error)) {
+	c.mutex.Lock()
+	c.onAutoSaveError = fn
+	c.mutex.Unlock()
+}
+
+func (c *Cache[K, V]) autoSaveFailed(path string, err error) {
+	c.mutex.RLock()
+	onError := c.onAutoSaveError
+	c.mutex.RUnlock()
+	if onError == nil {
+		c.logAutoSave(path, err)
+		return
+	}
+	onError(err)
+}
@@ -0,0 +1,310 @@
+package sample1
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Check that saved prices can be loaded into a new cache, skipping the ones that expired
+func TestSaveTo_LoadFrom_RoundTrip(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(30 * time.Second)
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+
+	var buf bytes.Buffer
+	if err := cache.SaveTo(&buf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// by the time it is loaded "p1" expired but "p2" is still fresh
+	clock.Advance(40 * time.Second)
+	loaded := NewTransparentCache(mockService, time.Minute)
+	loaded.SetClock(clock)
+	if err := loaded.LoadFrom(&buf); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	assertInt(t, 1, loaded.Len(), "wrong number of loaded items")
+	assertFloat(t, 7, getPriceWithNoErr(t, loaded, "p2"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	loadedEntry, _ := loaded.peek("p2")
+	savedEntry, _ := cache.peek("p2")
+	if !loadedEntry.CreatedAt.Equal(savedEntry.CreatedAt) {
+		t.Error("expected the fetch time to be kept")
+	}
+}
+
+// Check that auto saving writes the fresh prices to the file, and that failures are told to the callback
+func TestStartAutoSave_WritesSnapshot(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	defer cache.Close()
+	getPriceWithNoErr(t, cache, "p1")
+	clock.Advance(30 * time.Second)
+	getPriceWithNoErr(t, cache, "p2")
+	clock.Advance(40 * time.Second) // "p1" expired
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prices.json")
+	failures := make(chan error, 10)
+	cache.OnAutoSaveError(func(err error) { failures <- err })
+	cache.StartAutoSave(time.Second, path)
+	// a missing directory cannot be written to
+	cache.StartAutoSave(time.Second, filepath.Join(dir, "missing", "prices.json"))
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("expected nothing to be saved before the first tick")
+	}
+
+	clock.Advance(time.Second)
+	clock.Advance(time.Second) // only taken once the saves of the first tick are done
+	if len(failures) == 0 {
+		t.Fatal("expected saving to a missing directory to fail")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("expected the snapshot file to be written: %v", err)
+	}
+	defer file.Close()
+	loaded := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	if err := loaded.LoadFrom(file); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	assertInt(t, 1, loaded.Len(), "wrong number of loaded items")
+	assertFloat(t, 7, getPriceWithNoErr(t, loaded, "p2"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	cache.Close() // no save is left half way
+	assertInt(t, 2, len(failures), "wrong number of failed saves")
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	if len(matches) != 0 {
+		t.Errorf("expected no temporary files left, got %v", matches)
+	}
+}
+
+// gobCodec is a PriceCodec writing the prices with encoding/gob
+type gobCodec struct{}
+
+func (gobCodec) Encode(w io.Writer, entries map[string]PriceEntry) error {
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+func (gobCodec) Decode(r io.Reader) (map[string]PriceEntry, error) {
+	entries := map[string]PriceEntry{}
+	err := gob.NewDecoder(r).Decode(&entries)
+	return entries, err
+}
+
+// Check that auto saving failures are logged by the logger of the cache when there is no callback
+func TestStartAutoSave_LogsFailures(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	clock := newFakeClock()
+	handler := &capturingHandler{}
+	cache := NewCacheWithOptions(mockService, WithClock(clock), WithLogger(slog.New(handler)))
+	path := filepath.Join(t.TempDir(), "missing", "prices.json")
+	cache.StartAutoSave(time.Second, path)
+	clock.Advance(time.Second)
+	cache.Close()
+
+	r, ok := handler.find("cache auto save failed")
+	if !ok {
+		t.Fatal("expected the failure to be logged")
+	}
+	if r.level != slog.LevelError || r.attrs["path"].String() != path {
+		t.Errorf("wrong failure record, got %v", r)
+	}
+	if _, ok := r.attrs["error"]; !ok {
+		t.Errorf("expected the error, got %v", r.attrs)
+	}
+}
+
+// Check that saving with an interval of zero or less is not started, instead of panicking
+func TestStartAutoSave_NonPositiveInterval(t *testing.T) {
+	cache := NewTransparentCache(&mockPriceService{}, time.Minute)
+	path := filepath.Join(t.TempDir(), "prices.json")
+	cache.StartAutoSave(0, path)
+	cache.StartAutoSave(-time.Second, path)
+	cache.Close()
+	if _, err := os.Stat(path); err == nil {
+		t.Error("expected nothing to be saved")
+	}
+}
+
+// Check that prices saved with a custom codec can be loaded back with it, keeping their fetch time and TTL
+func TestSaveToWith_LoadFromWith_GobRoundTrip(t *testing.T) {
+	mockService := &ttlPriceService{
+		mockPriceService: mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+			},
+		},
+		ttls: map[string]time.Duration{"p2": 2 * time.Minute},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	getPricesWithNoErr(t, cache, "p1", "p2")
+
+	var buf bytes.Buffer
+	if err := cache.SaveToWith(&buf, gobCodec{}); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// by the time it is loaded "p1" expired but "p2" is still fresh thanks to its TTL
+	clock.Advance(90 * time.Second)
+	loaded := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	if err := loaded.LoadFromWith(&buf, gobCodec{}); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	assertInt(t, 1, loaded.Len(), "wrong number of loaded items")
+	assertFloat(t, 7, getPriceWithNoErr(t, loaded, "p2"), "wrong price returned")
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	loadedEntry, _ := loaded.peek("p2")
+	savedEntry, _ := cache.peek("p2")
+	if !loadedEntry.CreatedAt.Equal(savedEntry.CreatedAt) || loadedEntry.TTL != savedEntry.TTL {
+		t.Error("expected the fetch time and TTL to be kept")
+	}
+}
+
+// Check that a compressed snapshot is smaller and loads back the same prices, with or without compression enabled
+func TestWithSnapshotCompression_RoundTrip(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	clock := newFakeClock()
+	plain := NewCacheWithOptions(mockService, WithClock(clock))
+	compressed := NewCacheWithOptions(mockService, WithClock(clock), WithSnapshotCompression(true))
+	for i := 0; i < 1000; i++ {
+		plain.SetPrice(fmt.Sprintf("item-%d", i), float64(i))
+		compressed.SetPrice(fmt.Sprintf("item-%d", i), float64(i))
+	}
+
+	var plainBuf, compressedBuf bytes.Buffer
+	if err := plain.SaveTo(&plainBuf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if err := compressed.SaveTo(&compressedBuf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if compressedBuf.Len() >= plainBuf.Len() {
+		t.Errorf("expected the compressed snapshot to be smaller, got %d bytes against %d", compressedBuf.Len(),
+			plainBuf.Len())
+	}
+
+	loaded := NewCacheWithOptions(mockService, WithClock(clock))
+	if err := loaded.LoadFrom(&compressedBuf); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if !reflect.DeepEqual(plain.Snapshot(), loaded.Snapshot()) {
+		t.Error("expected the loaded prices to be the saved ones")
+	}
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the stats counters are saved along with the prices, restored on load unless told to reset them
+func TestSaveTo_LoadFrom_Stats(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p2")
+
+	var buf bytes.Buffer
+	if err := cache.SaveTo(&buf); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	saved := buf.Bytes()
+
+	restored := NewTransparentCache(mockService, time.Minute)
+	if err := restored.LoadFrom(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	stats := restored.Stats()
+	assertInt(t, 2, int(stats.Hits), "wrong number of restored hits")
+	assertInt(t, 2, int(stats.Misses), "wrong number of restored misses")
+
+	// loading into the cache that saved them, after counting more, restores them rather than adding them up
+	getPriceWithNoErr(t, cache, "p2")
+	if err := cache.LoadFrom(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	stats = cache.Stats()
+	assertInt(t, 2, int(stats.Hits), "wrong number of restored hits")
+	assertInt(t, 2, int(stats.Misses), "wrong number of restored misses")
+
+	reset := NewCacheWithOptions(mockService, WithResetStatsOnLoad())
+	getPriceWithNoErr(t, reset, "p2")
+	if err := reset.LoadFrom(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	stats = reset.Stats()
+	assertInt(t, 0, int(stats.Hits), "wrong number of hits after reset")
+	assertInt(t, 0, int(stats.Misses), "wrong number of misses after reset")
+	assertInt(t, 2, reset.Len(), "wrong number of cached items")
+}
+
+// Check that a snapshot written before the stats were saved still loads, leaving the stats counters as they were
+func TestLoadFrom_UnversionedSnapshot(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{"p2": {price: 7, err: nil}}}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithClock(clock))
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p2")
+	old := fmt.Sprintf(`{"entries":[{"key":"p1","value":5,"created_at":%q,"extra":true}]}`,
+		clock.Now().Format(time.RFC3339Nano))
+	if err := cache.LoadFrom(bytes.NewBufferString(old)); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+	assertInt(t, 1, int(cache.Stats().Hits), "wrong number of hits")
+	assertInt(t, 1, int(cache.Stats().Misses), "wrong number of misses")
+}
+
+// Check that loading with a codec not saving the stats leaves the stats counters as they were
+func TestLoadFromWith_KeepsStatsWithoutStatsCodec(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	saved := NewTransparentCache(mockService, time.Minute)
+	saved.SetPrice("p2", 7)
+	var buf bytes.Buffer
+	if err := saved.SaveToWith(&buf, gobCodec{}); err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	if err := cache.LoadFromWith(&buf, gobCodec{}); err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+	assertInt(t, 1, int(cache.Stats().Hits), "wrong number of hits")
+	assertInt(t, 1, int(cache.Stats().Misses), "wrong number of misses")
+}
@@ -0,0 +1,38 @@
+package sample1
+
+// Pin keeps the key from being evicted to make room for others, or shed under memory pressure, and from being swept
+// once expired, so an always hot key is not fetched again after being pushed out. An expired pinned value is still
+// fetched again when asked for, and Invalidate still removes it. A key can be pinned before it is cached
+// Pinned keys count towards "maxEntries" and the max bytes: once every cached key is pinned the cache grows past
+// them, evicting nothing, until a key is unpinned
+func (c *Cache[K, V]) Pin(key K) {
+	key = c.key(key)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pinned == nil {
+		c.pinned = map[K]struct{}{}
+	}
+	c.pinned[key] = struct{}{}
+	// the policy is never told about a pinned key, so it cannot choose it
+	c.policy.RecordRemove(key)
+}
+
+// Unpin lets the key be evicted and swept again, see Pin
+func (c *Cache[K, V]) Unpin(key K) {
+	key = c.key(key)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.isPinned(key) {
+		return
+	}
+	delete(c.pinned, key)
+	if _, ok := c.peek(key); ok && c.bounded() {
+		c.policy.RecordInsert(key)
+	}
+}
+
+// isPinned reports whether the key is pinned, the caller must hold the cache-wide lock
+func (c *Cache[K, V]) isPinned(key K) bool {
+	_, ok := c.pinned[key]
+	return ok
+}
@@ -0,0 +1,61 @@
+package sample1
+
+import (
+	"testing"
+	"time"
+)
+
+// Check that a pinned price survives the evictions making room for new ones, while the unpinned ones are evicted,
+// and that it can be evicted again once unpinned
+func TestPin_KeepsPriceFromEviction(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+			"p4": {price: 11, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, time.Minute, 2)
+	getPriceWithNoErr(t, cache, "p1")
+	cache.Pin("p1")
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p3")
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+	if _, ok := cache.Peek("p1"); !ok {
+		t.Error("expected the pinned price to be kept")
+	}
+	if _, ok := cache.Peek("p2"); ok {
+		t.Error("expected the unpinned price to be evicted")
+	}
+
+	cache.Unpin("p1")
+	getPriceWithNoErr(t, cache, "p3")
+	getPriceWithNoErr(t, cache, "p4")
+	if _, ok := cache.Peek("p1"); ok {
+		t.Error("expected the unpinned price to be evicted")
+	}
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that once every price is pinned the cache grows past its bound, and that a pinned price is not swept once
+// expired but still fetched again
+func TestPin_GrowsAndSkipsSweeper(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithMaxEntries(1), WithClock(clock))
+	cache.Pin("p1")
+	cache.Pin("p2")
+	getPricesWithNoErr(t, cache, "p1", "p2")
+	assertInt(t, 2, cache.Len(), "wrong number of cached items")
+
+	clock.Advance(time.Minute)
+	assertInt(t, 0, cache.sweep(), "wrong number of prices swept")
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
@@ -0,0 +1,180 @@
+package sample1
+
+import "container/list"
+
+// EvictionPolicy chooses the key to evict when a bounded cache is full, see WithEvictionPolicy
+// The cache tells it about every key it keeps and every hit, always holding its cache-wide lock, so a policy does not
+// need to be safe for concurrent use. Keys it does not know about are ignored
+//
+// A policy can also tell the key it would evict next, without forgetting it, with a Victim() (K, bool) method, so
+// WithFrequencyAdmission can weigh new keys against it. Without one every new key is admitted
+type EvictionPolicy[K comparable] interface {
+	RecordAccess(key K) // a cached key was served, or stored again
+	RecordInsert(key K) // a new key was stored
+	RecordRemove(key K) // a key left the cache other than by Evict, like invalidated or swept
+	Evict() (K, bool)   // chooses and forgets the key to evict, reporting false when there is none
+}
+
+// victimPolicy is an EvictionPolicy telling the key it would evict next, see EvictionPolicy
+type victimPolicy[K comparable] interface {
+	Victim() (K, bool)
+}
+
+// NewLRUPolicy returns a policy evicting the least recently used key, the default of every cache
+func NewLRUPolicy[K comparable]() EvictionPolicy[K] {
+	return &lruPolicy[K]{order: list.New(), elements: map[K]*list.Element{}}
+}
+
+// lruPolicy keeps the keys most recently used first
+type lruPolicy[K comparable] struct {
+	order    *list.List
+	elements map[K]*list.Element // key position in order
+}
+
+func (p *lruPolicy[K]) RecordAccess(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lruPolicy[K]) RecordInsert(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy[K]) RecordRemove(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.order.Remove(el)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy[K]) Evict() (K, bool) {
+	key, ok := p.Victim()
+	if ok {
+		p.RecordRemove(key)
+	}
+	return key, ok
+}
+
+func (p *lruPolicy[K]) Victim() (K, bool) {
+	if p.order.Len() == 0 {
+		var zero K
+		return zero, false
+	}
+	return p.order.Back().Value.(K), true
+}
+
+// NewFIFOPolicy returns a policy evicting the key stored first, however often it is used
+func NewFIFOPolicy[K comparable]() EvictionPolicy[K] {
+	return &fifoPolicy[K]{lruPolicy[K]{order: list.New(), elements: map[K]*list.Element{}}}
+}
+
+// fifoPolicy is a lruPolicy ignoring the accesses, so the keys stay in the order they were stored
+type fifoPolicy[K comparable] struct {
+	lruPolicy[K]
+}
+
+func (p *fifoPolicy[K]) RecordAccess(key K) {}
+
+func (p *fifoPolicy[K]) RecordInsert(key K) {
+	if _, ok := p.elements[key]; !ok {
+		p.elements[key] = p.order.PushFront(key)
+	}
+}
+
+// NewLFUPolicy returns a policy evicting the least frequently used key, the least recently used among the ones used
+// as often
+func NewLFUPolicy[K comparable]() EvictionPolicy[K] {
+	return &lfuPolicy[K]{elements: map[K]*list.Element{}, buckets: map[int]*list.List{}}
+}
+
+// lfuPolicy keeps the keys in buckets by how many times they were used, most recently used first in every bucket,
+// so the key to evict is found without going through them all
+type lfuPolicy[K comparable] struct {
+	elements map[K]*list.Element // key position in its bucket
+	buckets  map[int]*list.List  // keys by use count, only the ones holding keys
+	min      int                 // lowest use count with a bucket, when there are keys
+}
+
+type lfuItem[K comparable] struct {
+	key  K
+	uses int
+}
+
+func (p *lfuPolicy[K]) RecordAccess(key K) {
+	el, ok := p.elements[key]
+	if !ok {
+		return
+	}
+	item := el.Value.(*lfuItem[K])
+	p.unlink(el, item.uses)
+	if p.buckets[item.uses] == nil && p.min == item.uses {
+		p.min++
+	}
+	item.uses++
+	p.elements[key] = p.bucket(item.uses).PushFront(item)
+}
+
+func (p *lfuPolicy[K]) RecordInsert(key K) {
+	if _, ok := p.elements[key]; ok {
+		p.RecordAccess(key)
+		return
+	}
+	p.elements[key] = p.bucket(1).PushFront(&lfuItem[K]{key: key, uses: 1})
+	p.min = 1
+}
+
+func (p *lfuPolicy[K]) RecordRemove(key K) {
+	if el, ok := p.elements[key]; ok {
+		p.unlink(el, el.Value.(*lfuItem[K]).uses)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lfuPolicy[K]) Evict() (K, bool) {
+	key, ok := p.Victim()
+	if ok {
+		p.RecordRemove(key)
+	}
+	return key, ok
+}
+
+func (p *lfuPolicy[K]) Victim() (K, bool) {
+	if len(p.elements) == 0 {
+		var zero K
+		return zero, false
+	}
+	if p.buckets[p.min] == nil {
+		// the bucket of the lowest count was emptied by a removal, so the next lowest one has to be found
+		p.min = 0
+		for uses := range p.buckets {
+			if p.min == 0 || uses < p.min {
+				p.min = uses
+			}
+		}
+	}
+	return p.buckets[p.min].Back().Value.(*lfuItem[K]).key, true
+}
+
+// bucket returns the bucket of the keys used uses times, creating it if there is none
+func (p *lfuPolicy[K]) bucket(uses int) *list.List {
+	b, ok := p.buckets[uses]
+	if !ok {
+		b = list.New()
+		p.buckets[uses] = b
+	}
+	return b
+}
+
+// unlink takes the element out of the bucket of the keys used uses times, dropping the bucket once empty
+func (p *lfuPolicy[K]) unlink(el *list.Element, uses int) {
+	b := p.buckets[uses]
+	b.Remove(el)
+	if b.Len() == 0 {
+		delete(p.buckets, uses)
+	}
+}
@@ -0,0 +1,62 @@
+package sample1
+
+import (
+	"testing"
+	"time"
+)
+
+// Check that given the same lookups every policy evicts the key it is meant to
+func TestWithEvictionPolicy_EvictsExpectedKey(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		newPolicy func() EvictionPolicy[string]
+		expected  string
+	}{
+		{"LRU", NewLRUPolicy[string], "p1"},
+		{"LFU", NewLFUPolicy[string], "p2"},
+		{"FIFO", NewFIFOPolicy[string], "p3"},
+	} {
+		mockService := &mockPriceService{
+			mockResults: map[string]mockResult{
+				"p1": {price: 5, err: nil},
+				"p2": {price: 7, err: nil},
+				"p3": {price: 9, err: nil},
+				"p4": {price: 11, err: nil},
+			},
+		}
+		cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithMaxEntries(3),
+			WithEvictionPolicy(tc.newPolicy))
+		evicted := []string{}
+		cache.OnEvict(func(itemCode string, price float64) {
+			evicted = append(evicted, itemCode)
+		})
+		// "p3" is stored first and "p1" most often, while "p2" was used as often as "p3" but longer ago
+		for _, code := range []string{"p3", "p1", "p2", "p1", "p1", "p1", "p2", "p3"} {
+			getPriceWithNoErr(t, cache, code)
+		}
+		assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+
+		getPriceWithNoErr(t, cache, "p4")
+		if len(evicted) != 1 || evicted[0] != tc.expected {
+			t.Errorf("wrong evicted items for %v, expected : [%v], got : %v", tc.name, tc.expected, evicted)
+		}
+		assertInt(t, 3, cache.Len(), "wrong number of cached items")
+	}
+}
+
+// Check that the least frequently used policy forgets removed keys, even the only ones used that few times
+func TestLFUPolicy_ForgetsRemovedKeys(t *testing.T) {
+	p := NewLFUPolicy[string]()
+	p.RecordInsert("a")
+	p.RecordInsert("b")
+	p.RecordAccess("a")
+	p.RecordAccess("unknown")
+	p.RecordRemove("b")
+
+	if key, ok := p.Evict(); !ok || key != "a" {
+		t.Errorf("wrong evicted key, expected : a, got : %v", key)
+	}
+	if key, ok := p.Evict(); ok {
+		t.Errorf("expected no key to evict, got %v", key)
+	}
+}
@@ -0,0 +1,69 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned instead of waiting when the fetcher calls are over the rate limit, see WithRateLimit and
+// WithFailWhenBusy
+var ErrRateLimited = errors.New("fetcher calls over the rate limit")
+
+// limiter is a token bucket holding a single token, refilled every interval, so fetcher calls are evenly spread
+// A nil limiter never limits anything
+type limiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time // when the next token is available
+}
+
+func newLimiter(rps float64) *limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// reserve takes the next token, returning how long to wait until it is available
+// Unless wait is set, it takes none and reports false when it is not available right away
+func (l *limiter) reserve(now time.Time, wait bool) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	if delay > 0 && !wait {
+		return 0, false
+	}
+	l.next = l.next.Add(l.interval)
+	return delay, true
+}
+
+// throttle waits until the next fetcher call is within the rate limit, or fails with ErrRateLimited right away when
+// failing when busy. It gives up when ctx is done or the cache is closed
+// It uses the system clock, since it has to actually wait
+func (c *Cache[K, V]) throttle(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+	delay, ok := c.limiter.reserve(time.Now(), !c.failWhenBusy)
+	if !ok {
+		return ErrRateLimited
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Check that a burst of misses is spread out so the service is called at most at the configured rate
+func TestWithRateLimit_SpreadsCalls(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := []string{}
+	for i := 0; i < 5; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	cache := NewCacheWithOptions(mockService, WithRateLimit(20), WithMaxInFlight(2))
+	start := time.Now()
+	getPricesWithNoErr(t, cache, codes...)
+	// the first call goes right away, every next one 50ms after the previous
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the calls to take at least 200ms at 20 per second, took %v", elapsed)
+	}
+	assertInt(t, 5, mockService.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that waiting for the rate limit stops once the context is done, and that it can fail right away instead
+func TestWithRateLimit_ContextAndFailWhenBusy(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithRateLimit(1))
+	getPriceWithNoErr(t, cache, "p1")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cache.GetPriceForContext(ctx, "p2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	busy := NewCacheWithOptions(mockService, WithRateLimit(1), WithFailWhenBusy())
+	getPriceWithNoErr(t, busy, "p1")
+	if _, err := busy.GetPriceFor("p2"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+	assertInt(t, 2, mockService.getNumCalls(), "wrong number of service calls")
+	cache.Close()
+}
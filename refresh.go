@@ -0,0 +1,24 @@
+package sample1
+
+import "context"
+
+// refreshingAhead marks the context of the background refreshes, so they call the refresh fetcher when there is one
+type refreshingAhead struct{}
+
+// refreshContext returns the context of a background refresh, see WithRefreshFetcher
+func (c *Cache[K, V]) refreshContext() context.Context {
+	if c.refresher == nil {
+		return context.Background()
+	}
+	return context.WithValue(context.Background(), refreshingAhead{}, true)
+}
+
+// fetcherFor returns the fetcher to call with ctx, along with its batch calls when the misses are batched, which the
+// refresh fetcher never is
+func (c *Cache[K, V]) fetcherFor(ctx context.Context) (Fetcher[K, V], BatchFetcher[K, V]) {
+	if c.refresher != nil && ctx.Value(refreshingAhead{}) != nil {
+		return c.refresher, nil
+	}
+	up := c.upstream.Load()
+	return up.fetcher, up.batcher
+}
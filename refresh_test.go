@@ -0,0 +1,52 @@
+package sample1
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// Check that misses get prices from the actual service while the background refreshes get them from the refresh one,
+// logging the prices that differ
+func TestWithRefreshService_RefreshesFromAlternateService(t *testing.T) {
+	primary := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	alternate := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 6, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	handler := &capturingHandler{}
+	cache := NewCacheWithOptions(primary, WithMaxAge(time.Minute), WithRefreshThreshold(10*time.Second),
+		WithRefreshService(alternate), WithClock(clock), WithLogger(slog.New(handler)))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, primary.getNumCalls(), "wrong number of primary service calls")
+	assertInt(t, 0, alternate.getNumCalls(), "wrong number of refresh service calls")
+
+	// within the refresh window, the price is served while the refresh service is asked for it
+	clock.Advance(55 * time.Second)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	for i := 0; i < 50 && alternate.getNumCalls() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.Close()
+	assertInt(t, 1, primary.getNumCalls(), "wrong number of primary service calls")
+	assertInt(t, 1, alternate.getNumCalls(), "wrong number of refresh service calls")
+	price, ok := cache.Peek("p1")
+	if !ok {
+		t.Fatal("expected the refreshed price to be cached")
+	}
+	assertFloat(t, 6, price, "wrong refreshed price")
+
+	r, ok := handler.find("cache refresh differs")
+	if !ok {
+		t.Fatal("expected the differing price to be logged")
+	}
+	if r.attrs["previous"].Float64() != 5 || r.attrs["value"].Float64() != 6 {
+		t.Errorf("wrong refresh record, got %v", r)
+	}
+}
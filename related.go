@@ -0,0 +1,21 @@
+package sample1
+
+import "context"
+
+// warmingRelated marks the context of the lookups warming related keys, so they do not warm their own
+type warmingRelated struct{}
+
+// warmRelated warms the keys related to the missed key in the background, unless the miss comes from warming
+// another key. They are looked up like WarmUp does, with at most "concurrency" at the same time
+func (c *Cache[K, V]) warmRelated(ctx context.Context, key K) {
+	if c.related == nil || ctx.Value(warmingRelated{}) != nil {
+		return
+	}
+	keys := c.related(key)
+	if len(keys) == 0 {
+		return
+	}
+	c.spawn(func() {
+		c.getAll(context.WithValue(context.Background(), warmingRelated{}, true), keys, false, nil)
+	})
+}
@@ -0,0 +1,46 @@
+package sample1
+
+import (
+	"testing"
+	"time"
+)
+
+// Check that a miss warms the related items in the background, without changing the result of the lookup
+func TestWithRelatedItems_WarmsInBackground(t *testing.T) {
+	mockService := &mockPriceService{
+		itemDelays: map[string]time.Duration{
+			"SHOE-41": 20 * time.Millisecond,
+			"SHOE-43": 20 * time.Millisecond,
+		},
+		mockResults: map[string]mockResult{
+			"SHOE-42": {price: 5, err: nil},
+			"SHOE-41": {price: 4, err: nil},
+			"SHOE-43": {price: 6, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithRelatedItems(func(itemCode string) []string {
+		if itemCode == "SHOE-42" {
+			return []string{"SHOE-41", "SHOE-43"}
+		}
+		// related items have their own related ones, which would panic in the mock if warmed
+		return []string{itemCode + "-unknown"}
+	}))
+
+	start := time.Now()
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "SHOE-42"), "wrong price returned")
+	if time.Since(start) >= 20*time.Millisecond {
+		t.Error("expected the lookup not to wait for the related items")
+	}
+	for _, code := range []string{"SHOE-41", "SHOE-43"} {
+		warmed := false
+		for i := 0; i < 50 && !warmed; i++ {
+			_, warmed = cache.peek(code)
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !warmed {
+			t.Errorf("expected %v to be warmed", code)
+		}
+	}
+	cache.Close()
+	assertInt(t, 3, mockService.getNumCalls(), "wrong number of service calls")
+}
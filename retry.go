@@ -0,0 +1,35 @@
+package sample1
+
+import (
+	"context"
+	"time"
+)
+
+// retry calls fn until it succeeds or the retries set by WithRetry run out, returning its last result
+// It gives up early when ctx is done, its deadline would pass before the next attempt, or the cache is closed
+func (c *Cache[K, V]) retry(ctx context.Context, fn func() (V, error)) (V, error) {
+	value, err := fn()
+	backoff := c.backoff
+	for attempt := 0; attempt < c.retries && err != nil; attempt++ {
+		// being busy or short-circuited is not going to get better by trying again right away
+		if busy(err) || (c.retryable != nil && !c.retryable(err)) {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return value, err
+		case <-c.done:
+			timer.Stop()
+			return value, err
+		case <-timer.C:
+		}
+		value, err = fn()
+		backoff *= 2
+	}
+	return value, err
+}
@@ -0,0 +1,98 @@
+package sample1
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyPriceService fails the first "failures" calls, then returns the price
+type flakyPriceService struct {
+	mutex    sync.Mutex
+	failures int
+	price    float64
+	numCalls int
+}
+
+func (f *flakyPriceService) GetPriceFor(itemCode string) (float64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.numCalls++
+	if f.numCalls <= f.failures {
+		return 0, errors.New("temporary error")
+	}
+	return f.price, nil
+}
+
+func (f *flakyPriceService) getNumCalls() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.numCalls
+}
+
+// Check that a failing service is retried until it succeeds
+func TestWithRetry_RetriesUntilSuccess(t *testing.T) {
+	service := &flakyPriceService{failures: 2, price: 5}
+	cache := NewCacheWithOptions(service, WithRetry(3, time.Millisecond))
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 3, service.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that the error is returned once the attempts run out
+func TestWithRetry_GivesUp(t *testing.T) {
+	service := &flakyPriceService{failures: 5, price: 5}
+	cache := NewCacheWithOptions(service, WithRetry(3, time.Millisecond))
+	if _, err := cache.GetPriceFor("p1"); err == nil {
+		t.Error("expected error, got nil")
+	}
+	assertInt(t, 3, service.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that no retry is made once the context is cancelled, or when its deadline would pass while waiting
+func TestWithRetry_RespectsContext(t *testing.T) {
+	service := &flakyPriceService{failures: 5, price: 5}
+	cache := NewCacheWithOptions(service, WithRetry(3, time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cache.GetPriceForContext(ctx, "p1"); err == nil {
+		t.Error("expected error, got nil")
+	}
+	assertInt(t, 1, service.getNumCalls(), "wrong number of service calls")
+
+	cache = NewCacheWithOptions(service, WithRetry(3, 50*time.Millisecond))
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := cache.GetPriceForContext(ctx, "p1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	cache.Close() // waits for the call running in the background
+	assertInt(t, 2, service.getNumCalls(), "wrong number of service calls")
+}
+
+// Check that only the errors classified as retryable are retried
+func TestWithRetryableError_RetriesTransientErrorsOnly(t *testing.T) {
+	errNotFound := errors.New("not found")
+	errTimeout := errors.New("timeout")
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: errNotFound},
+			"p2": {price: 0, err: errTimeout},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithRetry(3, time.Millisecond), WithRetryableError(func(err error) bool {
+		return !errors.Is(err, errNotFound)
+	}))
+	if _, err := cache.GetPriceFor("p1"); !errors.Is(err, errNotFound) {
+		t.Errorf("expected the not found error, got %v", err)
+	}
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	if _, err := cache.GetPriceFor("p2"); !errors.Is(err, errTimeout) {
+		t.Errorf("expected the timeout error, got %v", err)
+	}
+	assertInt(t, 4, mockService.getNumCalls(), "wrong number of service calls")
+}
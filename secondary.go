@@ -0,0 +1,22 @@
+package sample1
+
+// SecondaryCache is a slower but bigger cache behind the in-memory one, asked before the fetcher on a miss
+// Values it returns are trusted to be fresh enough, they are cached again as if they had just been fetched
+// It is called concurrently, so it must be safe for concurrent use
+type SecondaryCache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Set(key K, value V)
+}
+
+// promote looks the key up in the secondary cache, storing the value found in memory
+func (c *Cache[K, V]) promote(key K) (V, bool) {
+	if c.secondary == nil {
+		var zero V
+		return zero, false
+	}
+	value, ok := c.secondary.Get(key)
+	if ok {
+		c.set(key, value)
+	}
+	return value, ok
+}
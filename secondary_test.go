@@ -0,0 +1,89 @@
+package sample1
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSecondaryCache keeps prices in a map, counting the lookups
+type mockSecondaryCache struct {
+	mutex   sync.Mutex
+	prices  map[string]float64
+	lookups int
+}
+
+func (m *mockSecondaryCache) Get(itemCode string) (float64, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lookups++
+	price, ok := m.prices[itemCode]
+	return price, ok
+}
+
+func (m *mockSecondaryCache) Set(itemCode string, price float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.prices[itemCode] = price
+}
+
+// Check that a miss found in the secondary cache does not call the service and is promoted to memory
+func TestWithSecondaryCache_PromotesHits(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p2": {price: 7, err: nil},
+		},
+	}
+	secondary := &mockSecondaryCache{prices: map[string]float64{"p1": 5}}
+	cache := NewCacheWithOptions(mockService, WithSecondaryPriceCache(secondary))
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 0, mockService.getNumCalls(), "wrong number of service calls")
+	if _, ok := cache.peek("p1"); !ok {
+		t.Error("expected the price to be promoted to memory")
+	}
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, secondary.lookups, "wrong number of secondary lookups")
+
+	// a miss in both is fetched and set in the secondary cache as well
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	assertInt(t, 1, mockService.getNumCalls(), "wrong number of service calls")
+	assertFloat(t, 7, secondary.prices["p2"], "wrong price in the secondary cache")
+}
+
+// Check that refreshing skips the secondary cache, going to the service
+func TestWithSecondaryCache_RefreshSkipsIt(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 6, err: nil},
+		},
+	}
+	secondary := &mockSecondaryCache{prices: map[string]float64{"p1": 5}}
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithSecondaryPriceCache(secondary))
+	price, err := cache.Refresh("p1")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	assertFloat(t, 6, price, "wrong price returned")
+	assertInt(t, 0, secondary.lookups, "wrong number of secondary lookups")
+	assertFloat(t, 6, secondary.prices["p1"], "wrong price in the secondary cache")
+}
+
+// Check that a price promoted from the secondary cache is cached by its canonical ID, resolving the alias only
+func TestWithSecondaryCache_PromotesByCanonicalItemCode(t *testing.T) {
+	secondary := &mockSecondaryCache{prices: map[string]float64{"p1": 5}}
+	resolutions := map[string]int{}
+	cache := NewCacheWithOptions(&mockPriceService{}, WithSecondaryPriceCache(secondary),
+		WithCanonicalItemCodes(func(itemCode string) (string, error) {
+			resolutions[itemCode]++
+			return strings.TrimPrefix(itemCode, "sku-"), nil
+		}))
+
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "sku-p1"), "wrong price returned")
+	assertInt(t, 1, resolutions["sku-p1"], "wrong number of resolutions")
+	assertInt(t, 0, resolutions["p1"], "wrong number of resolutions")
+	if _, ok := cache.peek("p1"); !ok {
+		t.Error("expected the price to be promoted to memory by its canonical ID")
+	}
+}
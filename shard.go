@@ -0,0 +1,69 @@
+package sample1
+
+import (
+	"hash/maphash"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is how many shards the keys are spread over
+const shardCount = 32
+
+// shard holds the state of a subset of the keys behind its own lock, so lookups and fetches for keys in different
+// shards do not contend with each other
+type shard[K comparable, V any] struct {
+	mutex    sync.RWMutex
+	entries  map[K]entry[V]
+	ttls     map[K]time.Duration
+	inflight map[K]*call[V] // shared by every method missing the key, single and batch lookups alike
+	lastGood map[K]entry[V] // see WithLastGoodFallback
+	failures map[K]int      // fetcher calls failed in a row, see ErrorCounts
+	cow      bool           // whether entries and ttls are published to view, see WithCopyOnWriteReads
+	dirty    bool           // whether entries or ttls changed since they were last published
+	view     atomic.Pointer[shardView[K, V]]
+}
+
+// shardView is a copy of the entries and TTLs of a shard that is never changed once published, so it can be read
+// without taking any lock
+type shardView[K comparable, V any] struct {
+	entries map[K]entry[V]
+	ttls    map[K]time.Duration
+}
+
+// newShards returns n empty shards, with room for capacity keys between them all, see WithInitialCapacity
+func newShards[K comparable, V any](n, capacity int) []*shard[K, V] {
+	shards := make([]*shard[K, V], n)
+	perShard := (max(capacity, 0) + n - 1) / n
+	for i := range shards {
+		shards[i] = &shard[K, V]{
+			entries:  make(map[K]entry[V], perShard),
+			ttls:     map[K]time.Duration{},
+			inflight: map[K]*call[V]{},
+			lastGood: map[K]entry[V]{},
+			failures: map[K]int{},
+		}
+	}
+	return shards
+}
+
+// changed tells the shard its entries or TTLs changed, the caller must hold the write lock
+func (sh *shard[K, V]) changed() {
+	sh.dirty = sh.cow
+}
+
+// unlock releases the write lock of the shard, publishing a copy of its entries and TTLs first if they changed, so
+// writes copy the whole shard once however many keys they changed
+func (sh *shard[K, V]) unlock() {
+	if sh.dirty {
+		sh.view.Store(&shardView[K, V]{entries: maps.Clone(sh.entries), ttls: maps.Clone(sh.ttls)})
+		sh.dirty = false
+	}
+	sh.mutex.Unlock()
+}
+
+// shardFor returns the shard the key belongs to
+func (c *Cache[K, V]) shardFor(key K) *shard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
@@ -0,0 +1,196 @@
+package sample1
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Check that keys are spread over the shards and each one always lands on the same shard
+func TestShardFor_SpreadsKeys(t *testing.T) {
+	cache := NewCache[string, int](FetcherFunc[string, int](func(key string) (int, error) {
+		return len(key), nil
+	}), time.Minute)
+	used := map[*shard[string, int]]bool{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if cache.shardFor(key) != cache.shardFor(key) {
+			t.Fatalf("expected %v to always land on the same shard", key)
+		}
+		used[cache.shardFor(key)] = true
+	}
+	if len(used) < shardCount/2 {
+		t.Errorf("expected keys spread over the shards, only %d of %d used", len(used), shardCount)
+	}
+}
+
+// Check that lookups, stores and removals of many keys from many goroutines keep the cache consistent, run with -race
+func TestCache_ConcurrentDistinctKeys(t *testing.T) {
+	var calls int64
+	cache := NewBoundedCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		return key * 2, nil
+	}), time.Minute, 50)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := (g*200 + i) % 100
+				value, err := cache.Get(key)
+				if err != nil || value != key*2 {
+					t.Errorf("wrong value for %d, got : %v, %v", key, value, err)
+				}
+				if i%10 == 0 {
+					cache.Invalidate(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() > 50 {
+		t.Errorf("expected at most 50 cached keys, got %d", cache.Len())
+	}
+	assertInt(t, cache.Len(), len(cache.Keys()), "wrong number of keys")
+}
+
+// BenchmarkGet_DistinctKeys measures fetching and looking up many distinct keys from many goroutines. "single"
+// keeps every key in one shard, like a single cache-wide lock would, to compare it with the sharded cache
+func BenchmarkGet_DistinctKeys(b *testing.B) {
+	for _, single := range []bool{false, true} {
+		name := "sharded"
+		if single {
+			name = "single"
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := NewCache[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+				return key, nil
+			}), time.Hour)
+			if single {
+				cache.shards = newShards[int, int](1, 0)
+			}
+			var next int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := int(atomic.AddInt64(&next, 1) % 10000)
+					cache.Get(key)
+					if key%4 == 0 {
+						cache.Invalidate(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSet_WarmUp measures storing many new keys into an empty cache, with its maps growing as the keys are
+// stored or sized for all of them upfront by WithInitialCapacity
+func BenchmarkSet_WarmUp(b *testing.B) {
+	const keys = 100000
+	for _, presized := range []bool{false, true} {
+		name := "growing"
+		opts := []Option{WithMaxAge(time.Hour)}
+		if presized {
+			name = "presized"
+			opts = append(opts, WithInitialCapacity(keys))
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cache := NewCacheWith[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+					return key, nil
+				}), opts...)
+				for key := 0; key < keys; key++ {
+					cache.Set(key, key)
+				}
+			}
+		})
+	}
+}
+
+// Check that lookups reading copied shards see every value set, invalidated or expired, also from many readers while
+// some writers keep replacing values, run with -race
+func TestWithCopyOnWriteReads_SeesWrites(t *testing.T) {
+	var calls int64
+	clock := newFakeClock()
+	cache := NewCacheWith[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		return key * 2, nil
+	}), WithMaxAge(time.Minute), WithClock(clock), WithCopyOnWriteReads())
+	for key := 0; key < 100; key++ {
+		cache.Set(key, key*2)
+	}
+	cache.Invalidate(1)
+	assertInt(t, 2, getWithNoErr(t, cache, 1), "wrong value returned")
+	cache.Set(2, 5)
+	assertInt(t, 5, getWithNoErr(t, cache, 2), "wrong value returned")
+	cache.SetTTL(3, time.Second)
+	clock.Advance(time.Second)
+	assertInt(t, 6, getWithNoErr(t, cache, 3), "wrong value returned")
+	assertInt(t, 2, int(atomic.LoadInt64(&calls)), "wrong number of fetcher calls")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := (g*500 + i) % 100
+				if g < 2 && i%10 == 0 {
+					cache.Invalidate(key)
+					cache.Set(key, key*2)
+					continue
+				}
+				if value := getWithNoErr(t, cache, key); value != key*2 && !(key == 2 && value == 5) {
+					t.Errorf("wrong value for %d, got : %v", key, value)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assertInt(t, 100, cache.Len(), "wrong number of cached values")
+}
+
+// getWithNoErr gets the value for the key, failing the test on error
+func getWithNoErr[K comparable, V any](t *testing.T, cache *Cache[K, V], key K) V {
+	value, err := cache.Get(key)
+	if err != nil {
+		t.Errorf("error getting %v: %v", key, err)
+	}
+	return value
+}
+
+// BenchmarkGet_CopyOnWriteReads measures fresh hits from many goroutines, with the shards read under their read
+// locks or copied on write and read without any lock
+func BenchmarkGet_CopyOnWriteReads(b *testing.B) {
+	for _, copyOnWrite := range []bool{false, true} {
+		name := "locked"
+		opts := []Option{WithMaxAge(time.Hour)}
+		if copyOnWrite {
+			name = "copy-on-write"
+			opts = append(opts, WithCopyOnWriteReads())
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := NewCacheWith[int, int](FetcherFunc[int, int](func(key int) (int, error) {
+				return key, nil
+			}), opts...)
+			for key := 0; key < 1000; key++ {
+				cache.Set(key, key)
+			}
+			var next int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					cache.Get(int(atomic.AddInt64(&next, 1) % 1000))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package sample1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats is a point in time view of the cache effectiveness
+type Stats struct {
+	Hits      int64 // lookups served with a fresh cached value
+	Misses    int64 // lookups that had to call the fetcher, because the value was absent or too old
+	Evictions int64 // values removed to make room for new ones
+	Entries   int   // values currently cached
+	Bytes     int   // estimated size of the values cached, only tracked with WithMaxBytes
+	Circuit   CircuitState
+	Latency   LatencyStats // of the fetcher calls, as told by the cache clock
+}
+
+// counters are updated atomically so they can be read while the cache is serving traffic
+type counters struct {
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Stats returns the current cache counters
+func (c *Cache[K, V]) Stats() Stats {
+	entries := c.Len()
+	c.mutex.RLock()
+	bytes := c.bytes
+	c.mutex.RUnlock()
+	return Stats{
+		Hits:      atomic.LoadInt64(&c.counters.hits),
+		Misses:    atomic.LoadInt64(&c.counters.misses),
+		Evictions: atomic.LoadInt64(&c.counters.evictions),
+		Entries:   entries,
+		Bytes:     bytes,
+		Circuit:   c.breaker.current(c.now()),
+		Latency:   c.latencies.stats(),
+	}
+}
+
+// ResetStats returns the current cache counters like Stats, zeroing them at the same time, so no lookup is lost
+// between reading and resetting them, for stats over fixed windows. Entries, Bytes and Circuit tell the state of
+// the cache rather than count anything, so they are not reset
+// Every counter is swapped on its own, so each one is exact but they are not a snapshot taken at a single instant:
+// lookups counted while they are swapped can land in the returned hits, and in the misses of the next window
+func (c *Cache[K, V]) ResetStats() Stats {
+	stats := c.Stats()
+	stats.Hits = atomic.SwapInt64(&c.counters.hits, 0)
+	stats.Misses = atomic.SwapInt64(&c.counters.misses, 0)
+	stats.Evictions = atomic.SwapInt64(&c.counters.evictions, 0)
+	stats.Latency = c.latencies.reset()
+	return stats
+}
+
+// ErrorCounts returns how many times in a row the fetcher failed for every key failing, so keys failing for good
+// stand out. A successful fetch resets the count of its key, and calls that did not reach the fetcher, like the
+// ones rate limited or given up by their caller, are not counted
+func (c *Cache[K, V]) ErrorCounts() map[K]int {
+	counts := map[K]int{}
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		for key, n := range sh.failures {
+			counts[key] = n
+		}
+		sh.mutex.RUnlock()
+	}
+	return counts
+}
+
+// countFailure counts the fetcher call for the key looked up with ctx as failed, or resets its count if it did not
+// fail, see ErrorCounts
+func (c *Cache[K, V]) countFailure(ctx context.Context, key K, err error) {
+	if err != nil && (busy(err) || gaveUp(ctx, err)) {
+		return
+	}
+	sh := c.shardFor(key)
+	sh.mutex.Lock()
+	if err != nil {
+		sh.failures[key]++
+	} else {
+		delete(sh.failures, key)
+	}
+	sh.mutex.Unlock()
+}
+
+// MetricsSnapshot returns the stats of the cache by metric name, for sinks taking any numeric metric, like a
+// telemetry client without a typed API. The names are stable, durations are in seconds and the circuit is told by
+// its CircuitState
+func (c *Cache[K, V]) MetricsSnapshot() map[string]float64 {
+	stats := c.Stats()
+	return map[string]float64{
+		"hits":                      float64(stats.Hits),
+		"misses":                    float64(stats.Misses),
+		"evictions":                 float64(stats.Evictions),
+		"entries":                   float64(stats.Entries),
+		"bytes":                     float64(stats.Bytes),
+		"circuit_state":             float64(stats.Circuit),
+		"fetches":                   float64(stats.Latency.Count),
+		"fetch_latency_min_seconds": stats.Latency.Min.Seconds(),
+		"fetch_latency_avg_seconds": stats.Latency.Avg.Seconds(),
+		"fetch_latency_max_seconds": stats.Latency.Max.Seconds(),
+		"fetch_latency_p50_seconds": stats.Latency.P50.Seconds(),
+		"fetch_latency_p95_seconds": stats.Latency.P95.Seconds(),
+	}
+}
+
+// String summarizes the cache in a single line, for logs and test failures
+// The fetcher is only told by its type
+func (c *Cache[K, V]) String() string {
+	return fmt.Sprintf("Cache{fetcher: %T, %s}", c.upstream.Load().fetcher, c.summary())
+}
+
+// summary tells the stats of the cache and the settings that are not their defaults
+func (c *Cache[K, V]) summary() string {
+	stats := c.Stats()
+	s := c.settings.Load()
+	parts := []string{
+		fmt.Sprintf("entries: %d", stats.Entries),
+		fmt.Sprintf("hits: %d", stats.Hits),
+		fmt.Sprintf("misses: %d", stats.Misses),
+		fmt.Sprintf("max age: %v", s.maxAge),
+		fmt.Sprintf("concurrency: %d", s.concurrency),
+	}
+	if c.shards[0].cow {
+		parts = append(parts, "copy on write reads")
+	}
+	if c.sequential {
+		parts = append(parts, "sequential batches")
+	}
+	if c.maxEntries > 0 {
+		parts = append(parts, fmt.Sprintf("max entries: %d", c.maxEntries))
+	}
+	if c.maxBytes > 0 {
+		parts = append(parts, fmt.Sprintf("max bytes: %d", c.maxBytes))
+	}
+	if c.pressure != nil {
+		parts = append(parts, fmt.Sprintf("shed under pressure: %v", c.shedFraction))
+	}
+	if c.admission != nil {
+		parts = append(parts, "frequency admission")
+	}
+	if s.refreshThreshold > 0 {
+		parts = append(parts, fmt.Sprintf("refresh threshold: %v", s.refreshThreshold))
+	}
+	if c.expiryBeta > 0 {
+		parts = append(parts, fmt.Sprintf("probabilistic expiry: %v", c.expiryBeta))
+	}
+	if c.refresher != nil {
+		parts = append(parts, fmt.Sprintf("refresh fetcher: %T", c.refresher))
+	}
+	if c.negativeTTL != nil {
+		parts = append(parts, "negative TTL by error")
+	} else if s.negativeTTL > 0 {
+		parts = append(parts, fmt.Sprintf("negative TTL: %v", s.negativeTTL))
+	}
+	if c.retries > 0 {
+		parts = append(parts, fmt.Sprintf("retries: %d", c.retries))
+	}
+	if c.lock != nil {
+		parts = append(parts, "distributed lock")
+	}
+	if c.breaker != nil {
+		parts = append(parts, fmt.Sprintf("circuit: %v", stats.Circuit))
+	}
+	if c.upstream.Load().batcher != nil {
+		parts = append(parts, fmt.Sprintf("batch window: %v", c.batchWindow))
+	}
+	if c.staleIfError {
+		parts = append(parts, "stale if error")
+	}
+	if c.followerWait > 0 {
+		parts = append(parts, fmt.Sprintf("single flight timeout: %v", c.followerWait))
+	}
+	if c.staleRefetch {
+		parts = append(parts, "stale while refreshing")
+	}
+	if c.isClosed() {
+		parts = append(parts, "closed")
+	}
+	return strings.Join(parts, ", ")
+}
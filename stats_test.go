@@ -0,0 +1,221 @@
+package sample1
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// assertStats compares everything but the latency, which depends on how long the calls took
+func assertStats(t *testing.T, expected Stats, actual Stats) {
+	actual.Latency = expected.Latency
+	if expected != actual {
+		t.Errorf("wrong stats, expected : %+v, got : %+v", expected, actual)
+	}
+}
+
+// Check that hits, misses and evictions are counted after a known sequence of calls
+func TestStats_CountsHitsMissesAndEvictions(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	cache := NewBoundedTransparentCache(mockService, 50*time.Millisecond, 2)
+	assertStats(t, Stats{}, cache.Stats())
+
+	getPriceWithNoErr(t, cache, "p1") // new key, miss
+	getPriceWithNoErr(t, cache, "p1") // fresh, hit
+	getPriceWithNoErr(t, cache, "p2") // new key, miss
+	assertStats(t, Stats{Hits: 1, Misses: 2, Entries: 2}, cache.Stats())
+
+	time.Sleep(80 * time.Millisecond)
+	getPriceWithNoErr(t, cache, "p1") // stale, miss
+	getPriceWithNoErr(t, cache, "p1") // fresh again, hit
+	getPriceWithNoErr(t, cache, "p3") // new key, miss evicting "p2"
+	assertStats(t, Stats{Hits: 2, Misses: 4, Evictions: 1, Entries: 2}, cache.Stats())
+}
+
+// Check that resetting the stats returns the counters so far and zeroes them, keeping the entries, and that no hit is
+// lost when resetting while the cache is serving traffic (run with -race)
+func TestResetStats_ReturnsAndZeroesCounters(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	stats := cache.ResetStats()
+	assertStats(t, Stats{Hits: 1, Misses: 1, Entries: 1}, stats)
+	assertInt(t, 1, int(stats.Latency.Count), "wrong number of fetches")
+	stats = cache.Stats()
+	assertStats(t, Stats{Entries: 1}, stats)
+	assertInt(t, 0, int(stats.Latency.Count), "wrong number of fetches")
+	getPriceWithNoErr(t, cache, "p1")
+	assertStats(t, Stats{Hits: 1, Entries: 1}, cache.Stats())
+
+	cache.ResetStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cache.GetPriceFor("p1")
+			}
+		}()
+	}
+	hits := int64(0)
+	for i := 0; i < 100; i++ {
+		hits += cache.ResetStats().Hits
+	}
+	wg.Wait()
+	hits += cache.ResetStats().Hits
+	assertInt(t, 4000, int(hits), "wrong number of hits across resets")
+}
+
+// Check that the failures of an item are counted until it is fetched again, other items not being counted
+func TestErrorCounts_CountsFailuresUntilSuccess(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 0, err: errors.New("p1 error")},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	getPriceWithNoErr(t, cache, "p2")
+	for i := 1; i <= 3; i++ {
+		if _, err := cache.GetPriceFor("p1"); err == nil {
+			t.Fatal("expected an error for p1")
+		}
+		counts := cache.ErrorCounts()
+		assertInt(t, 1, len(counts), "wrong number of items counted")
+		assertInt(t, i, counts["p1"], "wrong number of failures")
+	}
+
+	mockService.setResult("p1", mockResult{price: 5, err: nil})
+	getPriceWithNoErr(t, cache, "p1")
+	assertInt(t, 0, len(cache.ErrorCounts()), "wrong number of items counted")
+}
+
+// Check that every metric is reported by its name after a known sequence of calls, each fetch taking a second by
+// the cache clock
+func TestMetricsSnapshot_ReportsEveryMetric(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+			"p3": {price: 9, err: nil},
+		},
+	}
+	clock := steppingClock{fakeClock: newFakeClock(), step: time.Second}
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Hour), WithMaxEntries(2), WithClock(clock))
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p1")
+	getPriceWithNoErr(t, cache, "p2")
+	getPriceWithNoErr(t, cache, "p3")
+
+	expected := map[string]float64{
+		"hits":                      1,
+		"misses":                    3,
+		"evictions":                 1,
+		"entries":                   2,
+		"bytes":                     0,
+		"circuit_state":             float64(CircuitClosed),
+		"fetches":                   3,
+		"fetch_latency_min_seconds": 1,
+		"fetch_latency_avg_seconds": 1,
+		"fetch_latency_max_seconds": 1,
+		"fetch_latency_p50_seconds": 1,
+		"fetch_latency_p95_seconds": 1,
+	}
+	metrics := cache.MetricsSnapshot()
+	assertInt(t, len(expected), len(metrics), "wrong number of metrics")
+	for name, value := range expected {
+		if actual, ok := metrics[name]; !ok || actual != value {
+			t.Errorf("wrong %v metric, expected : %v, got : %v", name, value, actual)
+		}
+	}
+}
+
+// Check that stats can be read while the cache is serving traffic (run with -race)
+func TestStats_ConcurrentReads(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	cache := NewTransparentCache(mockService, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cache.Stats()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		getPriceWithNoErr(t, cache, "p1")
+	}
+	<-done
+	assertStats(t, Stats{Hits: 99, Misses: 1, Entries: 1}, cache.Stats())
+}
+
+// Check that the latency of the service calls is summarized, timed with the cache clock
+func TestStats_ReportsLatency(t *testing.T) {
+	clock := newFakeClock()
+	service := &slowPriceService{
+		mockPriceService: mockPriceService{mockResults: map[string]mockResult{}},
+		clock:            clock,
+	}
+	cache := NewCacheWithOptions(service, WithClock(clock))
+	for i, took := range []time.Duration{4, 1, 10, 3, 2} {
+		code := fmt.Sprintf("p%d", i)
+		service.mockResults[code] = mockResult{price: float64(i), err: nil}
+		service.took = took * time.Second
+		getPriceWithNoErr(t, cache, code)
+	}
+	getPriceWithNoErr(t, cache, "p0") // a hit does not count
+
+	expected := LatencyStats{
+		Count: 5,
+		Min:   time.Second,
+		Avg:   4 * time.Second,
+		Max:   10 * time.Second,
+		P50:   3 * time.Second,
+		P95:   10 * time.Second,
+	}
+	if latency := cache.Stats().Latency; latency != expected {
+		t.Errorf("wrong latency, expected : %+v, got : %+v", expected, latency)
+	}
+}
+
+// Check that the cache summary tells the entries, stats and max age, and the service only by its type
+func TestString_SummarizesCache(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithMaxEntries(10))
+	getPricesWithNoErr(t, cache, "p1", "p2")
+	getPriceWithNoErr(t, cache, "p1")
+
+	s := cache.String()
+	for _, expected := range []string{"service: *sample1.mockPriceService", "entries: 2", "hits: 1", "misses: 2",
+		"max age: 1m0s", "max entries: 10"} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("expected the summary to contain %q, got %v", expected, s)
+		}
+	}
+	if strings.Contains(s, "mockResults") {
+		t.Errorf("expected the service not to be dumped, got %v", s)
+	}
+}
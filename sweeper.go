@@ -0,0 +1,94 @@
+package sample1
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// sweepBatchSize is how many keys a sweep checks each time it takes the write lock
+const sweepBatchSize = 100
+
+// StartSweeper removes expired values every interval, so keys that are no longer asked for do not stay in memory
+// forever, and sheds keys under memory pressure, see WithMemoryPressureHook. The sweeper stops when the cache is
+// closed, and follows the cache clock when it is a TickerClock. An interval of zero or less starts no sweeper
+func (c *Cache[K, V]) StartSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticks, stop := c.ticker(interval)
+	if !c.spawn(func() {
+		defer stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticks:
+				c.sweep()
+				c.shed()
+			}
+		}
+	}) {
+		stop() // the cache is closed
+	}
+}
+
+// sweep removes every expired value, returning how many were removed
+// The write locks are held for a batch of keys of a shard at a time, so lookups can go on in between
+func (c *Cache[K, V]) sweep() int {
+	swept := 0
+	var removed []keyValue[K, V]
+	for _, sh := range c.shards {
+		sh.mutex.RLock()
+		keys := make([]K, 0, len(sh.entries))
+		for key := range sh.entries {
+			keys = append(keys, key)
+		}
+		sh.mutex.RUnlock()
+
+		for start := 0; start < len(keys); start += sweepBatchSize {
+			end := start + sweepBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			now := c.now()
+			c.mutex.Lock()
+			sh.mutex.Lock()
+			for _, key := range keys[start:end] {
+				// the entry may have been refreshed or removed since the keys were listed
+				e, ok := sh.entries[key]
+				if ok && !c.fresh(key, e, now) && !c.isPinned(key) {
+					removed = c.expireLocked(sh, key, removed)
+					swept++
+				}
+			}
+			sh.unlock()
+			c.mutex.Unlock()
+		}
+	}
+	c.evicted(removed)
+	return swept
+}
+
+// shed evicts the keys chosen by the eviction policy, as many as the fraction set by WithMemoryPressureHook, when its
+// hook tells memory runs low, returning how many were evicted
+func (c *Cache[K, V]) shed() int {
+	if c.pressure == nil || !c.pressure() {
+		return 0
+	}
+	var removed []keyValue[K, V]
+	c.mutex.Lock()
+	n := int(math.Ceil(float64(c.count) * c.shedFraction))
+	for i := 0; i < n; i++ {
+		key, ok := c.policy.Evict()
+		if !ok {
+			n = i
+			break
+		}
+		removed = c.remove(key, removed)
+		atomic.AddInt64(&c.counters.evictions, 1)
+	}
+	c.mutex.Unlock()
+	c.evicted(removed)
+	return n
+}
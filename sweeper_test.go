@@ -0,0 +1,112 @@
+package sample1
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Check that a sweep removes the expired values only
+func TestSweep_RemovesExpiredEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+			"p2": {price: 7, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	clock.Advance(30 * time.Second)
+	assertFloat(t, 7, getPriceWithNoErr(t, cache, "p2"), "wrong price returned")
+	clock.Advance(30 * time.Second)
+
+	assertInt(t, 1, cache.sweep(), "wrong number of swept entries")
+	if _, ok := cache.peek("p1"); ok {
+		t.Error("expected expired entry to be removed")
+	}
+	if _, ok := cache.peek("p2"); !ok {
+		t.Error("expected fresh entry to be kept")
+	}
+}
+
+// Check that a sweep goes through more entries than fit in a single batch
+func TestSweep_RemovesSeveralBatches(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	codes := []string{}
+	for i := 0; i < sweepBatchSize*2+10; i++ {
+		code := fmt.Sprintf("p%d", i)
+		mockService.mockResults[code] = mockResult{price: float64(i), err: nil}
+		codes = append(codes, code)
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	cache.SetClock(clock)
+	getPricesWithNoErr(t, cache, codes...)
+	clock.Advance(time.Minute)
+	assertInt(t, len(codes), cache.sweep(), "wrong number of swept entries")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+}
+
+// Check that the background sweeper removes expired values on its own
+func TestStartSweeper_RemovesExpiredEntries(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewTransparentCache(mockService, time.Minute)
+	defer cache.Close()
+	cache.SetClock(clock)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	cache.StartSweeper(10 * time.Millisecond)
+	clock.Advance(time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	assertInt(t, 0, cache.Stats().Entries, "wrong number of cached items")
+}
+
+// Check that a sweeper with an interval of zero or less is not started, instead of panicking
+func TestStartSweeper_NonPositiveInterval(t *testing.T) {
+	cache := NewTransparentCache(&mockPriceService{}, time.Minute)
+	cache.StartSweeper(0)
+	cache.StartSweeper(-time.Second)
+	cache.Close()
+}
+
+// Check that under memory pressure the fraction of the least recently used prices is evicted, and none otherwise
+func TestWithMemoryPressureHook_ShedsLeastRecentlyUsed(t *testing.T) {
+	mockService := &mockPriceService{mockResults: map[string]mockResult{}}
+	for i := 0; i < 10; i++ {
+		mockService.mockResults[fmt.Sprintf("p%d", i)] = mockResult{price: float64(i), err: nil}
+	}
+	var underPressure atomic.Bool
+	cache := NewCacheWithOptions(mockService, WithMemoryPressureHook(underPressure.Load, 0.3))
+	for i := 0; i < 10; i++ {
+		getPriceWithNoErr(t, cache, fmt.Sprintf("p%d", i))
+	}
+	// "p0" is now the most recently used
+	getPriceWithNoErr(t, cache, "p0")
+
+	assertInt(t, 0, cache.shed(), "wrong number of evicted entries")
+	assertInt(t, 10, cache.Len(), "wrong number of cached items")
+
+	underPressure.Store(true)
+	assertInt(t, 3, cache.shed(), "wrong number of evicted entries")
+	assertInt(t, 7, cache.Len(), "wrong number of cached items")
+	for _, code := range []string{"p1", "p2", "p3"} {
+		if _, ok := cache.peek(code); ok {
+			t.Errorf("expected %v to be evicted", code)
+		}
+	}
+	if _, ok := cache.peek("p0"); !ok {
+		t.Error("expected the most recently used price to be kept")
+	}
+	assertInt(t, 3, int(cache.Stats().Evictions), "wrong number of evictions")
+
+	underPressure.Store(false)
+	assertInt(t, 0, cache.shed(), "wrong number of evicted entries")
+	assertInt(t, 7, cache.Len(), "wrong number of cached items")
+}
@@ -0,0 +1,71 @@
+package sample1
+
+import "sync"
+
+// tagIndex keeps the keys carrying every tag, so they can be invalidated together, see InvalidateTag
+// Its lock is taken last, after the cache-wide and shard locks
+type tagIndex[K comparable] struct {
+	mutex sync.Mutex
+	keys  map[string]map[K]struct{}
+}
+
+// retag moves the key from the old tags to the new ones
+func (t *tagIndex[K]) retag(key K, old []string, tags []string) {
+	if len(old) == 0 && len(tags) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, tag := range old {
+		delete(t.keys[tag], key)
+		if len(t.keys[tag]) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	if t.keys == nil {
+		t.keys = map[string]map[K]struct{}{}
+	}
+	for _, tag := range tags {
+		if t.keys[tag] == nil {
+			t.keys[tag] = map[K]struct{}{}
+		}
+		t.keys[tag][key] = struct{}{}
+	}
+}
+
+// tagged returns a copy of the keys carrying the tag
+func (t *tagIndex[K]) tagged(tag string) []K {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	keys := make([]K, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetWithTags is like Set but also tags the value, so it can be invalidated along with the other values carrying any
+// of its tags, see InvalidateTag. The tags stay with the key when its value is fetched again, until it is removed
+func (c *Cache[K, V]) SetWithTags(key K, value V, tags ...string) {
+	c.store(c.key(key), entry[V]{Value: value, CreatedAt: c.now(), Jitter: c.jitter(), Tags: tags})
+}
+
+// InvalidateTag removes every key carrying the tag from the cache, returning how many were removed
+// Keys are tagged by SetWithTags or WithTagResolver
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
+	var removed []keyValue[K, V]
+	n := 0
+	c.mutex.Lock()
+	for _, key := range c.tags.tagged(tag) {
+		sh := c.shardFor(key)
+		sh.mutex.Lock()
+		if _, ok := sh.entries[key]; ok {
+			removed = c.removeLocked(sh, key, removed)
+			n++
+		}
+		sh.unlock()
+	}
+	c.mutex.Unlock()
+	c.evicted(removed)
+	return n
+}
@@ -0,0 +1,59 @@
+package sample1
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Check that invalidating a tag removes exactly the prices carrying it, whether set with tags or fetched
+func TestInvalidateTag_RemovesTaggedPrices(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"acme-1": {price: 5, err: nil},
+			"acme-2": {price: 7, err: nil},
+			"zeta-1": {price: 9, err: nil},
+		},
+	}
+	cache := NewCacheWithOptions(mockService, WithTagResolver(func(itemCode string) []string {
+		return []string{"supplier:" + strings.Split(itemCode, "-")[0]}
+	}))
+	evicted := []string{}
+	cache.OnEvict(func(itemCode string, price float64) {
+		evicted = append(evicted, itemCode)
+	})
+	getPricesWithNoErr(t, cache, "acme-1", "acme-2", "zeta-1")
+	cache.SetPriceWithTags("promo-1", 3, "supplier:acme", "promo")
+	cache.SetPrice("other", 1)
+
+	assertInt(t, 3, cache.InvalidateTag("supplier:acme"), "wrong number of removed items")
+	keys := cache.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "other,zeta-1" {
+		t.Errorf("wrong keys, expected : [other zeta-1], got : %v", keys)
+	}
+	sort.Strings(evicted)
+	if strings.Join(evicted, ",") != "acme-1,acme-2,promo-1" {
+		t.Errorf("wrong evicted items, expected : [acme-1 acme-2 promo-1], got : %v", evicted)
+	}
+	// the removed keys left every tag they carried
+	assertInt(t, 0, cache.InvalidateTag("promo"), "wrong number of removed items")
+	assertInt(t, 0, cache.InvalidateTag("supplier:acme"), "wrong number of removed items")
+}
+
+// Check that a price keeps the tags it was set with when it is fetched again
+func TestSetPriceWithTags_KeepsTagsOnRefresh(t *testing.T) {
+	mockService := &mockPriceService{
+		mockResults: map[string]mockResult{
+			"p1": {price: 5, err: nil},
+		},
+	}
+	clock := newFakeClock()
+	cache := NewCacheWithOptions(mockService, WithMaxAge(time.Minute), WithClock(clock))
+	cache.SetPriceWithTags("p1", 4, "supplier:acme")
+	clock.Advance(time.Minute)
+	assertFloat(t, 5, getPriceWithNoErr(t, cache, "p1"), "wrong price returned")
+	assertInt(t, 1, cache.InvalidateTag("supplier:acme"), "wrong number of removed items")
+	assertInt(t, 0, cache.Len(), "wrong number of cached items")
+}